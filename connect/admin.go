@@ -0,0 +1,48 @@
+package connect
+
+import (
+	"github.com/lifenglin/micro-library/helper"
+	"github.com/micro/go-micro/v2/config"
+	"github.com/sirupsen/logrus"
+	"net/http"
+)
+
+func init() {
+	helper.RegisterConfigDump("config", dumpConfigs)
+}
+
+// StartAdmin 按srvName下的admin配置启动helper的admin server，没有配置时监听helper.DefaultAdminAddr
+func StartAdmin(srvName string) (*http.Server, error) {
+	var adminConfig helper.AdminConfig
+	conf, _, err := ConnectConfig(srvName, "admin")
+	if err == nil {
+		err = conf.Get(srvName, "admin").Scan(&adminConfig)
+	}
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"srvName": srvName,
+			"error":   err,
+		}).Warn("read admin config fail, use default")
+	}
+
+	server, err := helper.StartAdminServer(adminConfig)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"srvName": srvName,
+			"addr":    adminConfig.Addr,
+			"error":   err,
+		}).Error("start admin server fail")
+		return nil, err
+	}
+	return server, nil
+}
+
+// dumpConfigs 已加载的所有配置的当前值，key为srvName/配置名
+func dumpConfigs() interface{} {
+	dump := make(map[string]interface{})
+	loadedConfigs.Range(func(key, value interface{}) bool {
+		dump[key.(string)] = value.(config.Config).Map()
+		return true
+	})
+	return dump
+}
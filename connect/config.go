@@ -14,6 +14,9 @@ import (
 
 var configs *configMap
 
+// loadedConfigs 所有通过newConfig加载的配置，用于/debug/config
+var loadedConfigs sync.Map
+
 type configMap struct {
 	sync.RWMutex
 	Map     map[string]config.Config
@@ -73,6 +76,7 @@ func newConfig(name string) (config.Config, config.Watcher, error) {
 		}).Error("read config fail")
 		return conf, nil, fmt.Errorf("read config fail: %w", err)
 	}
+	loadedConfigs.Store(name, conf)
 	//配置发生变化了 执行响应的操作
 	watcher, err := conf.Watch()
 	if err != nil {
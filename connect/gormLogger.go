@@ -0,0 +1,93 @@
+package connect
+
+import (
+	"context"
+	"errors"
+	"github.com/sirupsen/logrus"
+	gorm2 "gorm.io/gorm"
+	"gorm.io/gorm/logger"
+	"gorm.io/gorm/utils"
+	"time"
+)
+
+const gormSlowThreshold = 200 * time.Millisecond
+
+// gormLogger 将gorm v2的日志写入MysqlLog
+type gormLogger struct {
+	log           *logrus.Entry
+	level         logger.LogLevel
+	slowThreshold time.Duration
+}
+
+// detailed为true时记录所有sql，与v1的mysql_detailed_log保持一致
+func newGormLogger(log *logrus.Entry, detailed bool) logger.Interface {
+	level := logger.Warn
+	if detailed {
+		level = logger.Info
+	}
+	return &gormLogger{
+		log:           log,
+		level:         level,
+		slowThreshold: gormSlowThreshold,
+	}
+}
+
+func (l *gormLogger) LogMode(level logger.LogLevel) logger.Interface {
+	newLogger := *l
+	newLogger.level = level
+	return &newLogger
+}
+
+func (l *gormLogger) Info(ctx context.Context, msg string, data ...interface{}) {
+	if l.level >= logger.Info {
+		l.log.WithField("file", utils.FileWithLineNum()).Infof(msg, data...)
+	}
+}
+
+func (l *gormLogger) Warn(ctx context.Context, msg string, data ...interface{}) {
+	if l.level >= logger.Warn {
+		l.log.WithField("file", utils.FileWithLineNum()).Warnf(msg, data...)
+	}
+}
+
+func (l *gormLogger) Error(ctx context.Context, msg string, data ...interface{}) {
+	if l.level >= logger.Error {
+		l.log.WithField("file", utils.FileWithLineNum()).Errorf(msg, data...)
+	}
+}
+
+func (l *gormLogger) Trace(ctx context.Context, begin time.Time, fc func() (string, int64), err error) {
+	if l.level <= logger.Silent {
+		return
+	}
+
+	elapsed := time.Since(begin)
+	switch {
+	case err != nil && l.level >= logger.Error && !errors.Is(err, gorm2.ErrRecordNotFound):
+		sql, rows := fc()
+		l.log.WithFields(logrus.Fields{
+			"file":    utils.FileWithLineNum(),
+			"sql":     sql,
+			"rows":    rows,
+			"elapsed": elapsed.String(),
+			"error":   err.Error(),
+		}).Error("gorm query error")
+	case l.slowThreshold != 0 && elapsed > l.slowThreshold && l.level >= logger.Warn:
+		sql, rows := fc()
+		l.log.WithFields(logrus.Fields{
+			"file":      utils.FileWithLineNum(),
+			"sql":       sql,
+			"rows":      rows,
+			"elapsed":   elapsed.String(),
+			"threshold": l.slowThreshold.String(),
+		}).Warn("gorm slow query")
+	case l.level >= logger.Info:
+		sql, rows := fc()
+		l.log.WithFields(logrus.Fields{
+			"file":    utils.FileWithLineNum(),
+			"sql":     sql,
+			"rows":    rows,
+			"elapsed": elapsed.String(),
+		}).Info("gorm query")
+	}
+}
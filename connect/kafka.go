@@ -1,115 +1,392 @@
 package connect
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/lifenglin/micro-library/helper"
 	"github.com/micro/go-micro/v2/config"
 	"github.com/segmentio/kafka-go"
+	"github.com/segmentio/kafka-go/gzip"
+	"github.com/segmentio/kafka-go/lz4"
+	"github.com/segmentio/kafka-go/snappy"
+	"github.com/segmentio/kafka-go/zstd"
+	"github.com/sirupsen/logrus"
+	"io"
 	"strings"
 	"sync"
 	"time"
 )
 
+// kafka配置中的保留key，同一个name下所有topic的默认配置
+const kafkaDefaultConfigKey = "default"
+
+// kafkaConfig kafka.<name>.<topic>可以只配置broker地址字符串，也可以配置为对象覆盖kafka.<name>.default中的配置
+type kafkaConfig struct {
+	Brokers string `json:"brokers"`
+	//hash按key分区，round_robin，least_bytes，默认least_bytes
+	Balancer string `json:"balancer"`
+	//1只等待leader确认，-1等待所有副本确认，不配置时为-1
+	RequiredAcks int    `json:"required_acks"`
+	BatchSize    int    `json:"batch_size"`
+	BatchTimeout string `json:"batch_timeout"`
+	//gzip、snappy、lz4、zstd，不配置不压缩
+	Compression string `json:"compression"`
+	//消费组没有提交过offset时从first还是last开始消费，默认first
+	StartOffset    string          `json:"start_offset"`
+	CommitInterval string          `json:"commit_interval"`
+	MaxWait        string          `json:"max_wait"`
+	MinBytes       int             `json:"min_bytes"`
+	MaxBytes       int             `json:"max_bytes"`
+	ClientID       string          `json:"client_id"`
+	DialTimeout    string          `json:"dial_timeout"`
+	SASL           kafkaSASLConfig `json:"sasl"`
+	TLS            tlsFileConfig   `json:"tls"`
+}
+
 var (
-	brokerMap sync.Map
-	readerMap sync.Map
-	writerMap sync.Map
-	locker    sync.Mutex
+	kafkaConfigMap sync.Map
+	readerMap      sync.Map
+	writerMap      sync.Map
+	kafkaWatchers  sync.Map
+	locker         sync.Mutex
 )
 
-//async设置为true，表示不阻塞， 不需要等待返回值确认
+func init() {
+	helper.RegisterReadyCheck("kafka", kafkaReadyCheck)
+}
+
+// kafkaReadyCheck 对每个已使用的kafka集群连接一个broker，同一个name下只检查一个topic的配置
+func kafkaReadyCheck(ctx context.Context) error {
+	clusters := make(map[kafkaTopicKey]kafkaTopicKey)
+	collect := func(key kafkaTopicKey) {
+		clusters[kafkaTopicKey{svrName: key.svrName, name: key.name}] = key
+	}
+	writerMap.Range(func(key, value interface{}) bool {
+		collect(key.(kafkaWriterKey).kafkaTopicKey)
+		return true
+	})
+	readerMap.Range(func(key, value interface{}) bool {
+		collect(key.(kafkaReaderKey).kafkaTopicKey)
+		return true
+	})
+
+	for _, key := range clusters {
+		conn, err := DialKafka(ctx, key.svrName, key.name, key.topic)
+		if err != nil {
+			return fmt.Errorf("%s: %w", key.name, err)
+		}
+		conn.Close()
+	}
+	return nil
+}
+
+type kafkaTopicKey struct {
+	svrName string
+	name    string
+	topic   string
+}
+
+// kafkaWriterKey 同步和异步的writer分开缓存，异步writer的错误不会返回给调用方
+type kafkaWriterKey struct {
+	kafkaTopicKey
+	async bool
+}
+
+// kafkaReaderKey 每个消费组单独一个reader，不同的消费组各自提交offset
+type kafkaReaderKey struct {
+	kafkaTopicKey
+	groupID string
+}
+
+// async设置为true，表示不阻塞， 不需要等待返回值确认
 func GetKafkaWriter(svrName, name, topic string, async bool) (*kafka.Writer, error) {
-	key := keyName(name, topic)
+	key := kafkaWriterKey{kafkaTopicKey: kafkaTopicKey{svrName: svrName, name: name, topic: topic}, async: async}
 	if writer, ok := writerMap.Load(key); ok {
 		return writer.(*kafka.Writer), nil
 	}
 
-	brokers, err := getBrokers(svrName, name, topic)
+	conf, err := getKafkaConfig(key.kafkaTopicKey)
+	if err != nil {
+		return nil, err
+	}
+	writerConfig, err := conf.writerConfig(topic, async)
 	if err != nil {
 		return nil, err
 	}
 
-	writer := kafka.NewWriter(kafka.WriterConfig{
-		Brokers:  brokers,
-		Topic:    topic,
-		Balancer: &kafka.LeastBytes{},
-		Async:    async,
-	})
-
-	writerMap.Store(key, writer)
+	writer := kafka.NewWriter(writerConfig)
+	if existWriter, loaded := writerMap.LoadOrStore(key, writer); loaded {
+		//并发创建时只保留一个
+		writer.Close()
+		return existWriter.(*kafka.Writer), nil
+	}
 
 	return writer, nil
 }
 
 func GetKafkaReader(svrName, name, topic, groupID string) (*kafka.Reader, error) {
-	key := keyName(name, topic)
+	key := kafkaReaderKey{kafkaTopicKey: kafkaTopicKey{svrName: svrName, name: name, topic: topic}, groupID: groupID}
 	if reader, ok := readerMap.Load(key); ok {
 		return reader.(*kafka.Reader), nil
 	}
 
-	brokers, err := getBrokers(svrName, name, topic)
+	conf, err := getKafkaConfig(key.kafkaTopicKey)
+	if err != nil {
+		return nil, err
+	}
+	readerConfig, err := conf.readerConfig(topic, groupID)
 	if err != nil {
 		return nil, err
 	}
 
-	reader := kafka.NewReader(kafka.ReaderConfig{
-		Brokers:  brokers,
-		GroupID:  groupID,
-		Topic:    topic,
-		MinBytes: 10e3, // 10KB
-		MaxBytes: 10e6, // 10MB
-	})
-
-	readerMap.Store(key, reader)
+	reader := kafka.NewReader(readerConfig)
+	if existReader, loaded := readerMap.LoadOrStore(key, reader); loaded {
+		reader.Close()
+		return existReader.(*kafka.Reader), nil
+	}
+	kafkaMetrics.startLagLoop()
 
 	return reader, nil
 }
 
-func getBrokers(svrName, name, topic string) ([]string, error) {
-	key := keyName(name, topic)
-	brokerValue, ok := brokerMap.Load(key)
+func getKafkaConfig(key kafkaTopicKey) (*kafkaConfig, error) {
+	configValue, ok := kafkaConfigMap.Load(key)
 	if !ok {
 		locker.Lock()
 		defer locker.Unlock()
-		brokerValue, ok := brokerMap.Load(key)
+		configValue, ok := kafkaConfigMap.Load(key)
 		if ok {
-			return brokerValue.([]string), nil
+			return configValue.(*kafkaConfig), nil
 		}
 
-		conf, watcher, err := ConnectConfig(svrName, "kafka")
+		conf, watcher, err := ConnectConfig(key.svrName, "kafka")
 		if err != nil {
 			return nil, err
 		}
 
-		var brokerAddress string
-		err = conf.Get(svrName, "kafka", name, topic).Scan(&brokerAddress)
+		kafkaConf, err := parseKafkaConfig(conf.Get(key.svrName, "kafka", key.name, kafkaDefaultConfigKey).Bytes(),
+			conf.Get(key.svrName, "kafka", key.name, key.topic).Bytes())
 		if err != nil {
-			return nil, err
+			return nil, fmt.Errorf("kafka config %s.%s: %w", key.name, key.topic, err)
+		}
+
+		//同一个服务的kafka配置共用一个watcher，只启动一次
+		if _, loaded := kafkaWatchers.LoadOrStore(key.svrName, true); !loaded && watcher != nil {
+			go closeKafkaOnUpdate(watcher, key.svrName)
+		}
+
+		kafkaConfigMap.Store(key, kafkaConf)
+		return kafkaConf, nil
+	}
+
+	return configValue.(*kafkaConfig), nil
+}
+
+func parseKafkaConfig(defaults []byte, topic []byte) (*kafkaConfig, error) {
+	conf := &kafkaConfig{}
+	if err := conf.merge(defaults); err != nil {
+		return nil, err
+	}
+	if err := conf.merge(topic); err != nil {
+		return nil, err
+	}
+	if conf.Brokers == "" {
+		return nil, errors.New("brokers is empty")
+	}
+	return conf, nil
+}
+
+// merge 用data中配置了的字段覆盖当前配置，data不是对象时只是broker地址。
+// go-micro的Value.Bytes()对字符串值返回的是没有引号的原始内容，所以要先看第一个字符。
+func (c *kafkaConfig) merge(data []byte) error {
+	data = bytes.TrimSpace(data)
+	if len(data) == 0 || string(data) == "null" {
+		return nil
+	}
+	switch data[0] {
+	case '{':
+		return json.Unmarshal(data, c)
+	case '[':
+		var brokers []string
+		if err := json.Unmarshal(data, &brokers); err != nil {
+			return err
 		}
+		c.Brokers = strings.Join(brokers, ",")
+	case '"':
+		return json.Unmarshal(data, &c.Brokers)
+	default:
+		c.Brokers = string(data)
+	}
+	return nil
+}
 
-		go deleteBrokerOnUpdate(watcher, key)
+func (c *kafkaConfig) brokers() []string {
+	brokers := strings.Split(c.Brokers, ",")
+	for i := range brokers {
+		brokers[i] = strings.TrimSpace(brokers[i])
+	}
+	return brokers
+}
 
-		brokers := strings.Split(brokerAddress, ",")
-		brokerMap.Store(key, brokers)
-		return brokers, nil
+func (c *kafkaConfig) writerConfig(topic string, async bool) (kafka.WriterConfig, error) {
+	writerConfig := kafka.WriterConfig{
+		Brokers:      c.brokers(),
+		Topic:        topic,
+		Async:        async,
+		RequiredAcks: c.RequiredAcks,
+		BatchSize:    c.BatchSize,
+	}
+	dialer, err := c.dialer()
+	if err != nil {
+		return writerConfig, err
 	}
+	writerConfig.Dialer = dialer
 
-	return brokerValue.([]string), nil
+	switch c.Balancer {
+	case "", "least_bytes":
+		writerConfig.Balancer = &kafka.LeastBytes{}
+	case "hash":
+		writerConfig.Balancer = &kafka.Hash{}
+	case "round_robin":
+		writerConfig.Balancer = &kafka.RoundRobin{}
+	default:
+		return writerConfig, fmt.Errorf("unknown balancer: %s", c.Balancer)
+	}
+
+	switch c.Compression {
+	case "":
+	case "gzip":
+		writerConfig.CompressionCodec = gzip.NewCompressionCodec()
+	case "snappy":
+		writerConfig.CompressionCodec = snappy.NewCompressionCodec()
+	case "lz4":
+		writerConfig.CompressionCodec = lz4.NewCompressionCodec()
+	case "zstd":
+		writerConfig.CompressionCodec = zstd.NewCompressionCodec()
+	default:
+		return writerConfig, fmt.Errorf("unknown compression: %s", c.Compression)
+	}
+
+	writerConfig.BatchTimeout, err = parseKafkaDuration("batch_timeout", c.BatchTimeout)
+	return writerConfig, err
 }
 
-func keyName(name, topic string) string {
-	return name + "." + topic
+func (c *kafkaConfig) readerConfig(topic string, groupID string) (kafka.ReaderConfig, error) {
+	readerConfig := kafka.ReaderConfig{
+		Brokers:  c.brokers(),
+		GroupID:  groupID,
+		Topic:    topic,
+		MinBytes: 10e3, // 10KB
+		MaxBytes: 10e6, // 10MB
+	}
+	dialer, err := c.dialer()
+	if err != nil {
+		return readerConfig, err
+	}
+	readerConfig.Dialer = dialer
+	if c.MinBytes > 0 {
+		readerConfig.MinBytes = c.MinBytes
+	}
+	if c.MaxBytes > 0 {
+		readerConfig.MaxBytes = c.MaxBytes
+	}
+
+	switch c.StartOffset {
+	case "", "first":
+		readerConfig.StartOffset = kafka.FirstOffset
+	case "last":
+		readerConfig.StartOffset = kafka.LastOffset
+	default:
+		return readerConfig, fmt.Errorf("unknown start_offset: %s", c.StartOffset)
+	}
+
+	if readerConfig.CommitInterval, err = parseKafkaDuration("commit_interval", c.CommitInterval); err != nil {
+		return readerConfig, err
+	}
+	readerConfig.MaxWait, err = parseKafkaDuration("max_wait", c.MaxWait)
+	return readerConfig, err
+}
+
+func parseKafkaDuration(field string, value string) (time.Duration, error) {
+	if value == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", field, err)
+	}
+	return d, nil
 }
 
-func deleteBrokerOnUpdate(watcher config.Watcher, key string) {
+// closeKafkaOnUpdate 配置每次变化都丢弃该服务的kafka配置，10秒后关闭旧的writer和reader，writer关闭前会发送完缓冲的消息
+func closeKafkaOnUpdate(watcher config.Watcher, svrName string) {
 	for {
 		_, err := watcher.Next()
 		if err != nil {
-			time.Sleep(time.Second)
-			continue
+			logrus.WithFields(logrus.Fields{
+				"srvName": svrName,
+				"error":   err,
+			}).Warn("kafka watch error")
+			kafkaWatchers.Delete(svrName)
+			return
 		}
+		logrus.WithFields(logrus.Fields{
+			"srvName": svrName,
+		}).Info("reload kafka")
+
+		kafkaConfigMap.Range(func(key, _ interface{}) bool {
+			if key.(kafkaTopicKey).svrName == svrName {
+				kafkaConfigMap.Delete(key)
+			}
+			return true
+		})
+		var closers []io.Closer
+		writerMap.Range(func(key, value interface{}) bool {
+			if key.(kafkaWriterKey).svrName == svrName {
+				writerMap.Delete(key)
+				closers = append(closers, value.(*kafka.Writer))
+			}
+			return true
+		})
+		readerMap.Range(func(key, value interface{}) bool {
+			if key.(kafkaReaderKey).svrName == svrName {
+				readerMap.Delete(key)
+				closers = append(closers, value.(*kafka.Reader))
+			}
+			return true
+		})
+
+		go func() {
+			//等正在使用旧对象的请求结束
+			time.Sleep(time.Duration(10) * time.Second)
+			for _, closer := range closers {
+				if err := closer.Close(); err != nil {
+					logrus.WithFields(logrus.Fields{
+						"srvName": svrName,
+						"error":   err,
+					}).Warn("close kafka client error")
+				}
+			}
+		}()
+	}
+}
 
-		brokerMap.Delete(key)
-		writerMap.Delete(key)
-		readerMap.Delete(key)
-		break
+// CloseAllKafka 服务退出前调用，发送完所有writer缓冲的消息并关闭所有reader
+func CloseAllKafka() error {
+	var firstErr error
+	closeAll := func(m *sync.Map) {
+		m.Range(func(key, value interface{}) bool {
+			m.Delete(key)
+			if err := value.(io.Closer).Close(); err != nil && firstErr == nil {
+				firstErr = err
+			}
+			return true
+		})
 	}
+	closeAll(&writerMap)
+	closeAll(&readerMap)
+	return firstErr
 }
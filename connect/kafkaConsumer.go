@@ -0,0 +1,340 @@
+package connect
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/opentracing/opentracing-go/ext"
+	"github.com/segmentio/kafka-go"
+	"github.com/sirupsen/logrus"
+	"math/rand"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	HeaderOriginalTopic     = "x-original-topic"
+	HeaderOriginalPartition = "x-original-partition"
+	HeaderOriginalOffset    = "x-original-offset"
+	HeaderError             = "x-error"
+
+	kafkaCommitTimeout = 5 * time.Second
+)
+
+// ConsumerHandler ctx中带有关联到生产者的consumer span和消息头中的request id。返回nil时提交offset，返回错误时按配置重试，重试用完后发到死信topic
+type ConsumerHandler func(ctx context.Context, msg kafka.Message) error
+
+type consumerOptions struct {
+	concurrency int
+	maxRetries  int
+	backoff     time.Duration
+	maxBackoff  time.Duration
+	dlqTopic    string
+	log         *logrus.Entry
+}
+
+type ConsumerOption func(*consumerOptions)
+
+// ConsumerConcurrency 并发处理的worker数，同一个partition的消息总是由同一个worker按顺序处理
+func ConsumerConcurrency(n int) ConsumerOption {
+	return func(o *consumerOptions) {
+		o.concurrency = n
+	}
+}
+
+// ConsumerRetry 失败后的重试次数和首次重试的间隔，间隔按指数增长，最长maxBackoff
+func ConsumerRetry(maxRetries int, backoff time.Duration, maxBackoff time.Duration) ConsumerOption {
+	return func(o *consumerOptions) {
+		o.maxRetries = maxRetries
+		o.backoff = backoff
+		o.maxBackoff = maxBackoff
+	}
+}
+
+// ConsumerDeadLetterTopic 重试用完的消息发到的topic，默认为topic加.dlq后缀，与topic使用同一个kafka配置
+func ConsumerDeadLetterTopic(topic string) ConsumerOption {
+	return func(o *consumerOptions) {
+		o.dlqTopic = topic
+	}
+}
+
+func ConsumerLog(log *logrus.Entry) ConsumerOption {
+	return func(o *consumerOptions) {
+		o.log = log
+	}
+}
+
+type consumer struct {
+	srvName string
+	name    string
+	topic   string
+	groupID string
+	handler ConsumerHandler
+	options consumerOptions
+	//ctx取消后不再拉取消息，但是已拉取的消息处理完再退出
+	stop <-chan struct{}
+}
+
+// RunConsumer 阻塞消费topic直到ctx取消，取消后等待正在处理的消息完成并提交offset后返回。
+// 死信topic默认开启，为topic加.dlq后缀，可以用ConsumerDeadLetterTopic修改。
+// groupID为空时不使用消费组，不提交offset，重启后从start_offset重新开始。
+func RunConsumer(ctx context.Context, srvName string, name string, topic string, groupID string, handler ConsumerHandler, opts ...ConsumerOption) error {
+	options := consumerOptions{
+		concurrency: 1,
+		maxRetries:  3,
+		backoff:     100 * time.Millisecond,
+		maxBackoff:  10 * time.Second,
+		dlqTopic:    topic + ".dlq",
+		log:         logrus.NewEntry(logrus.StandardLogger()),
+	}
+	for _, opt := range opts {
+		opt(&options)
+	}
+	if options.concurrency <= 0 {
+		options.concurrency = 1
+	}
+	options.log = options.log.WithFields(logrus.Fields{
+		"name":    name,
+		"topic":   topic,
+		"groupID": groupID,
+	})
+
+	reader, err := GetKafkaReader(srvName, name, topic, groupID)
+	if err != nil {
+		return err
+	}
+	c := &consumer{
+		srvName: srvName,
+		name:    name,
+		topic:   topic,
+		groupID: groupID,
+		handler: handler,
+		options: options,
+		stop:    ctx.Done(),
+	}
+
+	var wg sync.WaitGroup
+	workers := make([]chan fetchedMessage, options.concurrency)
+	for i := range workers {
+		workers[i] = make(chan fetchedMessage)
+		wg.Add(1)
+		go func(messages <-chan fetchedMessage) {
+			defer wg.Done()
+			for fetched := range messages {
+				c.process(detachContext(ctx), fetched.reader, fetched.msg)
+			}
+		}(workers[i])
+	}
+
+	c.fetch(ctx, reader, workers)
+	for _, worker := range workers {
+		close(worker)
+	}
+	wg.Wait()
+	options.log.Info("consumer stopped")
+	return nil
+}
+
+// fetchedMessage 消息需要由拉取它的reader提交
+type fetchedMessage struct {
+	reader *kafka.Reader
+	msg    kafka.Message
+}
+
+func (c *consumer) fetch(ctx context.Context, reader *kafka.Reader, workers []chan fetchedMessage) {
+	key := kafkaReaderKey{kafkaTopicKey: kafkaTopicKey{svrName: c.srvName, name: c.name, topic: c.topic}, groupID: c.groupID}
+	for {
+		msg, err := fetchKafkaMessage(ctx, reader, key)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			c.options.log.WithFields(logrus.Fields{
+				"error": err,
+			}).Warn("fetch message error")
+			if !c.sleep(time.Second) {
+				return
+			}
+			//配置更新后旧的reader会被关闭，重新获取
+			if newReader, err := GetKafkaReader(c.srvName, c.name, c.topic, c.groupID); err == nil {
+				reader = newReader
+			}
+			continue
+		}
+
+		select {
+		case workers[msg.Partition%len(workers)] <- fetchedMessage{reader: reader, msg: msg}:
+		case <-ctx.Done():
+			//未处理的消息不提交，重启后重新消费
+			return
+		}
+	}
+}
+
+func (c *consumer) process(ctx context.Context, reader *kafka.Reader, msg kafka.Message) {
+	log := c.options.log.WithFields(logrus.Fields{
+		"partition": msg.Partition,
+		"offset":    msg.Offset,
+	})
+
+	ctx, span := ExtractKafkaHeaders(ctx, msg)
+	defer span.Finish()
+
+	var err error
+	for attempt := 0; ; attempt++ {
+		err = c.handle(ctx, msg)
+		if err == nil {
+			break
+		}
+		log.WithFields(logrus.Fields{
+			"attempt": attempt,
+			"error":   err,
+		}).Warn("handle message error")
+		if attempt >= c.options.maxRetries || IsPermanentError(err) {
+			break
+		}
+		if !c.sleep(c.retryBackoff(attempt)) {
+			//退出时不再重试，不提交offset
+			return
+		}
+	}
+
+	if err != nil {
+		ext.Error.Set(span, true)
+		span.LogKV("error", err.Error())
+		if !c.deadLetter(ctx, msg, err, log) {
+			return
+		}
+	}
+	if c.groupID == "" {
+		//没有消费组时CommitMessages总是返回错误
+		return
+	}
+	commitCtx, cancel := context.WithTimeout(ctx, kafkaCommitTimeout)
+	defer cancel()
+	if err := reader.CommitMessages(commitCtx, msg); err != nil {
+		log.WithFields(logrus.Fields{
+			"error": err,
+		}).Error("commit message error")
+	}
+}
+
+// handle handler的panic按失败处理
+func (c *consumer) handle(ctx context.Context, msg kafka.Message) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = &consumerPanic{value: r}
+		}
+	}()
+	return c.handler(ctx, msg)
+}
+
+// deadLetter 一直重试到写入成功，返回false表示退出前没有写入，不能提交offset
+func (c *consumer) deadLetter(ctx context.Context, msg kafka.Message, cause error, log *logrus.Entry) bool {
+	headers := append([]kafka.Header{}, msg.Headers...)
+	headers = append(headers,
+		kafka.Header{Key: HeaderOriginalTopic, Value: []byte(msg.Topic)},
+		kafka.Header{Key: HeaderOriginalPartition, Value: []byte(strconv.Itoa(msg.Partition))},
+		kafka.Header{Key: HeaderOriginalOffset, Value: []byte(strconv.FormatInt(msg.Offset, 10))},
+		kafka.Header{Key: HeaderError, Value: []byte(cause.Error())},
+	)
+	dlq := kafka.Message{
+		Key:     msg.Key,
+		Value:   msg.Value,
+		Headers: headers,
+		Time:    msg.Time,
+	}
+
+	for attempt := 0; ; attempt++ {
+		writer, err := GetKafkaWriter(c.srvName, c.name, c.options.dlqTopic, false)
+		if err == nil {
+			err = writeKafkaMessages(ctx, writer, kafkaTopicKey{svrName: c.srvName, name: c.name, topic: c.options.dlqTopic}, dlq)
+		}
+		if err == nil {
+			log.WithFields(logrus.Fields{
+				"dlqTopic": c.options.dlqTopic,
+				"error":    cause,
+			}).Warn("message sent to dead letter topic")
+			return true
+		}
+		log.WithFields(logrus.Fields{
+			"dlqTopic": c.options.dlqTopic,
+			"error":    err,
+		}).Error("write dead letter error")
+		if !c.sleep(c.retryBackoff(attempt)) {
+			return false
+		}
+	}
+}
+
+func (c *consumer) retryBackoff(attempt int) time.Duration {
+	backoff := c.options.backoff << uint(attempt)
+	if backoff <= 0 || backoff > c.options.maxBackoff {
+		backoff = c.options.maxBackoff
+	}
+	if backoff <= 0 {
+		return 0
+	}
+	//加上最多一半的随机抖动
+	return backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+}
+
+// sleep 返回false表示在等待期间收到了退出信号
+func (c *consumer) sleep(d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-c.stop:
+		return false
+	}
+}
+
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string {
+	return e.err.Error()
+}
+
+func (e *permanentError) Unwrap() error {
+	return e.err
+}
+
+// PermanentError handler返回它包装的错误时不再重试，直接发到死信topic，例如消息格式错误
+func PermanentError(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &permanentError{err: err}
+}
+
+func IsPermanentError(err error) bool {
+	var permanent *permanentError
+	return errors.As(err, &permanent)
+}
+
+type consumerPanic struct {
+	value interface{}
+}
+
+func (p *consumerPanic) Error() string {
+	return fmt.Sprintf("handler panic: %v", p.value)
+}
+
+// detachedContext 保留ctx中的值，但不随ctx取消，用于退出时把正在处理的消息处理完
+type detachedContext struct {
+	context.Context
+	parent context.Context
+}
+
+func detachContext(parent context.Context) context.Context {
+	return detachedContext{Context: context.Background(), parent: parent}
+}
+
+func (c detachedContext) Value(key interface{}) interface{} {
+	return c.parent.Value(key)
+}
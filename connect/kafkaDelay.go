@@ -0,0 +1,329 @@
+package connect
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"github.com/go-redis/redis"
+	"github.com/lifenglin/micro-library/helper"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/segmentio/kafka-go"
+	"github.com/sirupsen/logrus"
+	"strconv"
+	"time"
+)
+
+const (
+	//到期的消息从due移到processing，score为租期结束时间，租期内没有删除会被重新放回due，防止发送前进程退出丢消息
+	delayClaimScript = `local score = redis.call("zscore", KEYS[1], ARGV[1])
+if score and tonumber(score) <= tonumber(ARGV[2]) then
+	redis.call("zrem", KEYS[1], ARGV[1])
+	redis.call("zadd", KEYS[3], ARGV[3], ARGV[1])
+	return redis.call("hget", KEYS[2], ARGV[1])
+end
+return false`
+	//已经被领取的消息返回-1，不能取消
+	delayCancelScript = `if redis.call("zscore", KEYS[3], ARGV[1]) then
+	return -1
+end
+local removed = redis.call("zrem", KEYS[1], ARGV[1])
+redis.call("hdel", KEYS[2], ARGV[1])
+return removed`
+	//发送成功后删除
+	delayDoneScript = `redis.call("zrem", KEYS[3], ARGV[1])
+redis.call("zrem", KEYS[1], ARGV[1])
+redis.call("hdel", KEYS[2], ARGV[1])
+return 1`
+	//发送失败后放回due，score为下次重试的时间
+	delayRetryScript = `if redis.call("zrem", KEYS[3], ARGV[1]) == 1 then
+	redis.call("zadd", KEYS[1], ARGV[2], ARGV[1])
+	return 1
+end
+return 0`
+	//租期已过的消息放回due，马上重新到期
+	delayRecoverScript = `local ids = redis.call("zrangebyscore", KEYS[3], "-inf", ARGV[1], "limit", 0, ARGV[2])
+for _, id in ipairs(ids) do
+	redis.call("zrem", KEYS[3], id)
+	redis.call("zadd", KEYS[1], ARGV[1], id)
+end
+return #ids`
+)
+
+// ErrDelayedMessageClaimed 消息已经被调度器领取，正在发送或者已经发送
+var ErrDelayedMessageClaimed = errors.New("delayed message already claimed")
+
+var (
+	kafkaDelayPending   *prometheus.GaugeVec
+	kafkaDelayOverdue   *prometheus.GaugeVec
+	kafkaDelayDelivered *prometheus.CounterVec
+)
+
+func init() {
+	kafkaDelayPending = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "kafka_delay_pending",
+		Help: "Number of delayed kafka messages waiting for delivery.",
+	}, []string{"service_name", "name"})
+	kafkaDelayOverdue = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "kafka_delay_overdue",
+		Help: "Number of delayed kafka messages past their delivery time.",
+	}, []string{"service_name", "name"})
+	kafkaDelayDelivered = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "kafka_delay_delivered_total",
+		Help: "Number of delayed kafka messages delivered to their topic.",
+	}, []string{"service_name", "name", "topic", "result"})
+	_ = prometheus.Register(kafkaDelayPending)
+	_ = prometheus.Register(kafkaDelayOverdue)
+	_ = prometheus.Register(kafkaDelayDelivered)
+}
+
+// DelayedMessage ID为空时自动生成，相同ID的消息会覆盖之前未发送的消息
+type DelayedMessage struct {
+	ID        string         `json:"id"`
+	KafkaName string         `json:"kafka_name"`
+	Topic     string         `json:"topic"`
+	Key       []byte         `json:"key"`
+	Value     []byte         `json:"value"`
+	Headers   []kafka.Header `json:"headers"`
+	DeliverAt time.Time      `json:"deliver_at"`
+}
+
+// delayKeys due保存等待发送的id和到期时间，hash保存消息内容，processing保存已领取的id和租期结束时间，
+// hash tag保证集群模式下在同一个slot
+func delayKeys(srvName string) []string {
+	prefix := "kafka_delay:{" + srvName + "}:"
+	return []string{prefix + "due", prefix + "msg", prefix + "processing"}
+}
+
+func unixMilli(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+// ScheduleKafka 在DeliverAt之后把消息发到Topic，需要有进程运行RunKafkaScheduler，返回消息ID
+func ScheduleKafka(ctx context.Context, hlp *helper.Helper, srvName string, redisName string, msg DelayedMessage) (string, error) {
+	if msg.Topic == "" || msg.KafkaName == "" {
+		return "", errors.New("delayed message needs kafka name and topic")
+	}
+	if msg.ID == "" {
+		id := make([]byte, 16)
+		if _, err := rand.Read(id); err != nil {
+			return "", err
+		}
+		msg.ID = hex.EncodeToString(id)
+	}
+	kafkaMsg := kafka.Message{Headers: msg.Headers}
+	InjectKafkaHeaders(ctx, &kafkaMsg, "")
+	msg.Headers = kafkaMsg.Headers
+
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return "", err
+	}
+	client, err := ConnectRedis(ctx, hlp, srvName, redisName)
+	if err != nil {
+		return "", err
+	}
+	keys := delayKeys(srvName)
+	_, err = client.TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.HSet(keys[1], msg.ID, data)
+		pipe.ZAdd(keys[0], redis.Z{Score: float64(unixMilli(msg.DeliverAt)), Member: msg.ID})
+		return nil
+	})
+	if err != nil {
+		hlp.RedisLog.WithFields(logrus.Fields{
+			"id":    msg.ID,
+			"topic": msg.Topic,
+			"error": err,
+		}).Warn("schedule kafka message error")
+		return "", err
+	}
+	return msg.ID, nil
+}
+
+// CancelKafka 取消还没有发送的消息，返回false表示消息不存在或者已经发送，
+// 已经被调度器领取的消息返回false和ErrDelayedMessageClaimed
+func CancelKafka(ctx context.Context, hlp *helper.Helper, srvName string, redisName string, id string) (bool, error) {
+	client, err := ConnectRedis(ctx, hlp, srvName, redisName)
+	if err != nil {
+		return false, err
+	}
+	return cancelDelayed(client, delayKeys(srvName), id)
+}
+
+func cancelDelayed(client redis.Cmdable, keys []string, id string) (bool, error) {
+	removed, err := client.Eval(delayCancelScript, keys, id).Int64()
+	if err != nil {
+		return false, err
+	}
+	if removed < 0 {
+		return false, ErrDelayedMessageClaimed
+	}
+	return removed == 1, nil
+}
+
+// claimDelayed 领取到期的消息，返回消息内容，没有到期、已经被领取或者取消时返回false
+func claimDelayed(client redis.Cmdable, keys []string, id string, now int64, leaseEnd int64) (string, bool, error) {
+	result, err := client.Eval(delayClaimScript, keys, id, now, leaseEnd).Result()
+	if err == redis.Nil {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	data, _ := result.(string)
+	//领取后再确认消息内容还在，被删除的消息不发送
+	exists, err := client.HExists(keys[1], id).Result()
+	if err != nil {
+		return "", false, err
+	}
+	if !exists {
+		client.Eval(delayDoneScript, keys, id)
+		return "", false, nil
+	}
+	return data, true, nil
+}
+
+type delaySchedulerOptions struct {
+	pollInterval time.Duration
+	batchSize    int64
+	lease        time.Duration
+	retryBackoff time.Duration
+}
+
+type DelaySchedulerOption func(*delaySchedulerOptions)
+
+// DelayPollInterval 没有到期消息时的轮询间隔，默认1秒，也是投递时间的最大误差
+func DelayPollInterval(d time.Duration) DelaySchedulerOption {
+	return func(o *delaySchedulerOptions) {
+		o.pollInterval = d
+	}
+}
+
+// DelayBatchSize 每次最多领取的到期消息数，默认100
+func DelayBatchSize(n int64) DelaySchedulerOption {
+	return func(o *delaySchedulerOptions) {
+		o.batchSize = n
+	}
+}
+
+// DelayRetryBackoff 发送失败后多久重新到期，默认10秒
+func DelayRetryBackoff(d time.Duration) DelaySchedulerOption {
+	return func(o *delaySchedulerOptions) {
+		o.retryBackoff = d
+	}
+}
+
+// RunKafkaScheduler 阻塞运行直到ctx取消，把到期的消息发到目标topic。
+// 可以在多个pod上同时运行，每条消息只会被一个pod领取；发送后删除前进程退出时会重复发送。
+func RunKafkaScheduler(ctx context.Context, hlp *helper.Helper, srvName string, redisName string, opts ...DelaySchedulerOption) error {
+	options := delaySchedulerOptions{
+		pollInterval: time.Second,
+		batchSize:    100,
+		lease:        time.Minute,
+		retryBackoff: 10 * time.Second,
+	}
+	for _, opt := range opts {
+		opt(&options)
+	}
+	log := hlp.Log.WithFields(logrus.Fields{
+		"srvName":   srvName,
+		"redisName": redisName,
+	})
+
+	for {
+		delivered, err := deliverDueKafka(ctx, hlp, srvName, redisName, options, log)
+		if err != nil {
+			log.WithFields(logrus.Fields{
+				"error": err,
+			}).Warn("kafka scheduler error")
+		}
+		//一批领满时马上领下一批
+		wait := options.pollInterval
+		if int64(delivered) >= options.batchSize {
+			wait = 0
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(wait):
+		}
+	}
+}
+
+func deliverDueKafka(ctx context.Context, hlp *helper.Helper, srvName string, redisName string, options delaySchedulerOptions, log *logrus.Entry) (int, error) {
+	client, err := ConnectRedis(ctx, hlp, srvName, redisName)
+	if err != nil {
+		return 0, err
+	}
+	keys := delayKeys(srvName)
+	now := unixMilli(time.Now())
+	if err := client.Eval(delayRecoverScript, keys, now, options.batchSize).Err(); err != nil {
+		return 0, err
+	}
+	observeDelay(client, srvName, redisName, keys[0], now)
+
+	ids, err := client.ZRangeByScore(keys[0], redis.ZRangeBy{
+		Min:   "-inf",
+		Max:   strconv.FormatInt(now, 10),
+		Count: options.batchSize,
+	}).Result()
+	if err != nil {
+		return 0, err
+	}
+
+	delivered := 0
+	for _, id := range ids {
+		if ctx.Err() != nil {
+			break
+		}
+		data, claimed, err := claimDelayed(client, keys, id, now, now+options.lease.Milliseconds())
+		if err != nil {
+			return delivered, err
+		}
+		if !claimed {
+			//已经被其他pod领取或者取消了
+			continue
+		}
+
+		var msg DelayedMessage
+		if err := json.Unmarshal([]byte(data), &msg); err != nil {
+			log.WithFields(logrus.Fields{
+				"id":    id,
+				"error": err,
+			}).Error("invalid delayed message, dropped")
+			client.Eval(delayDoneScript, keys, id)
+			continue
+		}
+
+		writer, err := GetKafkaWriter(srvName, msg.KafkaName, msg.Topic, false)
+		if err == nil {
+			err = writeKafkaMessages(ctx, writer, kafkaTopicKey{svrName: srvName, name: msg.KafkaName, topic: msg.Topic},
+				kafka.Message{Key: msg.Key, Value: msg.Value, Headers: msg.Headers})
+		}
+		if err != nil {
+			kafkaDelayDelivered.WithLabelValues(srvName, redisName, msg.Topic, "error").Inc()
+			log.WithFields(logrus.Fields{
+				"id":    id,
+				"topic": msg.Topic,
+				"error": err,
+			}).Warn("deliver delayed message error")
+			//只放回还在租期中的消息，租期已过的已经被放回due
+			client.Eval(delayRetryScript, keys, id, unixMilli(time.Now().Add(options.retryBackoff)))
+			continue
+		}
+		kafkaDelayDelivered.WithLabelValues(srvName, redisName, msg.Topic, "success").Inc()
+		client.Eval(delayDoneScript, keys, id)
+		delivered++
+	}
+	return delivered, nil
+}
+
+func observeDelay(client *redis.ClusterClient, srvName string, redisName string, zset string, now int64) {
+	if pending, err := client.ZCard(zset).Result(); err == nil {
+		kafkaDelayPending.WithLabelValues(srvName, redisName).Set(float64(pending))
+	}
+	if overdue, err := client.ZCount(zset, "-inf", strconv.FormatInt(now, 10)).Result(); err == nil {
+		kafkaDelayOverdue.WithLabelValues(srvName, redisName).Set(float64(overdue))
+	}
+}
@@ -0,0 +1,67 @@
+package connect
+
+import (
+	"github.com/go-redis/redis"
+	"os"
+	"testing"
+	"time"
+)
+
+// newDelayTestRedis 需要设置REDIS_ADDR指向一个单机redis，没有时跳过
+func newDelayTestRedis(t *testing.T, srvName string) (*redis.Client, []string) {
+	addr := os.Getenv("REDIS_ADDR")
+	if addr == "" {
+		t.Skip("REDIS_ADDR not set")
+	}
+	client := redis.NewClient(&redis.Options{Addr: addr})
+	if err := client.Ping().Err(); err != nil {
+		t.Skipf("redis not available: %v", err)
+	}
+	keys := delayKeys(srvName)
+	client.Del(keys...)
+	t.Cleanup(func() {
+		client.Del(keys...)
+		client.Close()
+	})
+	return client, keys
+}
+
+func TestCancelDelayedBeforeClaim(t *testing.T) {
+	client, keys := newDelayTestRedis(t, "delay_test_cancel")
+	client.HSet(keys[1], "a", `{"id":"a"}`)
+	client.ZAdd(keys[0], redis.Z{Score: 1, Member: "a"})
+
+	cancelled, err := cancelDelayed(client, keys, "a")
+	if err != nil || !cancelled {
+		t.Fatalf("cancel = %v, %v", cancelled, err)
+	}
+	now := unixMilli(time.Now())
+	if _, claimed, err := claimDelayed(client, keys, "a", now, now+60000); err != nil || claimed {
+		t.Fatalf("cancelled message claimed = %v, %v", claimed, err)
+	}
+}
+
+func TestCancelDelayedAfterClaim(t *testing.T) {
+	client, keys := newDelayTestRedis(t, "delay_test_claimed")
+	client.HSet(keys[1], "a", `{"id":"a"}`)
+	client.ZAdd(keys[0], redis.Z{Score: 1, Member: "a"})
+
+	now := unixMilli(time.Now())
+	data, claimed, err := claimDelayed(client, keys, "a", now, now+60000)
+	if err != nil || !claimed || data != `{"id":"a"}` {
+		t.Fatalf("claim = %q, %v, %v", data, claimed, err)
+	}
+
+	cancelled, err := cancelDelayed(client, keys, "a")
+	if err != ErrDelayedMessageClaimed || cancelled {
+		t.Fatalf("cancel claimed message = %v, %v", cancelled, err)
+	}
+	if exists, _ := client.HExists(keys[1], "a").Result(); !exists {
+		t.Fatal("claimed message should not be deleted by cancel")
+	}
+
+	//第二次领取失败
+	if _, claimed, err := claimDelayed(client, keys, "a", now, now+60000); err != nil || claimed {
+		t.Fatalf("second claim = %v, %v", claimed, err)
+	}
+}
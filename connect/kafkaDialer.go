@@ -0,0 +1,96 @@
+package connect
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/segmentio/kafka-go"
+	"github.com/segmentio/kafka-go/sasl"
+	"github.com/segmentio/kafka-go/sasl/plain"
+	"github.com/segmentio/kafka-go/sasl/scram"
+	"time"
+)
+
+const (
+	SASLPlain       = "plain"
+	SASLScramSHA256 = "scram-sha-256"
+	SASLScramSHA512 = "scram-sha-512"
+)
+
+type kafkaSASLConfig struct {
+	//plain、scram-sha-256、scram-sha-512，不配置不认证
+	Mechanism string `json:"mechanism"`
+	Username  string `json:"username"`
+	Password  string `json:"password"`
+}
+
+func (c kafkaSASLConfig) mechanism() (sasl.Mechanism, error) {
+	switch c.Mechanism {
+	case "":
+		return nil, nil
+	case SASLPlain:
+		return plain.Mechanism{Username: c.Username, Password: c.Password}, nil
+	case SASLScramSHA256:
+		return scram.Mechanism(scram.SHA256, c.Username, c.Password)
+	case SASLScramSHA512:
+		return scram.Mechanism(scram.SHA512, c.Username, c.Password)
+	}
+	return nil, fmt.Errorf("unknown sasl mechanism: %s", c.Mechanism)
+}
+
+// dialer writer、reader和管理连接使用同一个dialer配置
+func (c *kafkaConfig) dialer() (*kafka.Dialer, error) {
+	dialer := &kafka.Dialer{
+		ClientID:  c.ClientID,
+		Timeout:   10 * time.Second,
+		DualStack: true,
+	}
+	if c.ClientID == "" {
+		dialer.ClientID = kafka.DefaultClientID
+	}
+	timeout, err := parseKafkaDuration("dial_timeout", c.DialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	if timeout > 0 {
+		dialer.Timeout = timeout
+	}
+
+	dialer.SASLMechanism, err = c.SASL.mechanism()
+	if err != nil {
+		return nil, err
+	}
+	if c.TLS.Enable {
+		dialer.TLS, err = c.TLS.tlsConfig()
+		if err != nil {
+			return nil, fmt.Errorf("tls: %w", err)
+		}
+	}
+	return dialer, nil
+}
+
+// DialKafka 返回name对应集群的一个broker连接，用于创建topic、查询offset等管理操作，使用完需要Close
+func DialKafka(ctx context.Context, svrName, name, topic string) (*kafka.Conn, error) {
+	conf, err := getKafkaConfig(kafkaTopicKey{svrName: svrName, name: name, topic: topic})
+	if err != nil {
+		return nil, err
+	}
+	dialer, err := conf.dialer()
+	if err != nil {
+		return nil, err
+	}
+	return dialKafkaBroker(ctx, conf, dialer)
+}
+
+// dialKafkaBroker 按顺序尝试配置中的broker，返回第一个连接成功的
+func dialKafkaBroker(ctx context.Context, conf *kafkaConfig, dialer *kafka.Dialer) (*kafka.Conn, error) {
+	err := errors.New("brokers is empty")
+	for _, broker := range conf.brokers() {
+		var conn *kafka.Conn
+		conn, err = dialer.DialContext(ctx, "tcp", broker)
+		if err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
@@ -0,0 +1,146 @@
+package connect
+
+import (
+	"context"
+	"github.com/micro/go-micro/v2/metadata"
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+	"github.com/segmentio/kafka-go"
+	"strings"
+)
+
+const (
+	HeaderRequestID   = "x-request-id"
+	HeaderMessageType = "x-message-type"
+
+	//go-micro请求metadata中的request id
+	RequestIDMetadataKey = "X-Request-Id"
+)
+
+// kafkaHeaderCarrier 让opentracing把span context读写到kafka消息头
+type kafkaHeaderCarrier struct {
+	msg *kafka.Message
+}
+
+func (c kafkaHeaderCarrier) Set(key, val string) {
+	SetKafkaHeader(c.msg, key, []byte(val))
+}
+
+func (c kafkaHeaderCarrier) ForeachKey(handler func(key, val string) error) error {
+	for _, header := range c.msg.Headers {
+		if err := handler(header.Key, string(header.Value)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SetKafkaHeader 设置消息头，已存在同名的头时覆盖
+func SetKafkaHeader(msg *kafka.Message, key string, value []byte) {
+	for i, header := range msg.Headers {
+		if header.Key == key {
+			msg.Headers[i].Value = value
+			return
+		}
+	}
+	msg.Headers = append(msg.Headers, kafka.Header{Key: key, Value: value})
+}
+
+func GetKafkaHeader(msg kafka.Message, key string) ([]byte, bool) {
+	for _, header := range msg.Headers {
+		if header.Key == key {
+			return header.Value, true
+		}
+	}
+	return nil, false
+}
+
+func KafkaMessageType(msg kafka.Message) string {
+	value, _ := GetKafkaHeader(msg, HeaderMessageType)
+	return string(value)
+}
+
+// InjectKafkaHeaders 把ctx中的span context、request id和消息类型写入消息头，messageType为空时不写
+func InjectKafkaHeaders(ctx context.Context, msg *kafka.Message, messageType string) {
+	if span := opentracing.SpanFromContext(ctx); span != nil {
+		_ = opentracing.GlobalTracer().Inject(span.Context(), opentracing.TextMap, kafkaHeaderCarrier{msg: msg})
+	}
+	if requestID := RequestIDFromContext(ctx); requestID != "" {
+		SetKafkaHeader(msg, HeaderRequestID, []byte(requestID))
+	}
+	if messageType != "" {
+		SetKafkaHeader(msg, HeaderMessageType, []byte(messageType))
+	}
+}
+
+// ProduceKafka 用同步writer在producer span中写消息，每条消息都带上ctx的追踪信息和request id
+func ProduceKafka(ctx context.Context, svrName, name, topic string, messageType string, msgs ...kafka.Message) error {
+	writer, err := GetKafkaWriter(svrName, name, topic, false)
+	if err != nil {
+		return err
+	}
+	span, ctx := opentracing.StartSpanFromContext(ctx, "kafka.produce "+topic)
+	defer span.Finish()
+	ext.SpanKindProducer.Set(span)
+	ext.MessageBusDestination.Set(span, topic)
+
+	for i := range msgs {
+		InjectKafkaHeaders(ctx, &msgs[i], messageType)
+	}
+	err = writeKafkaMessages(ctx, writer, kafkaTopicKey{svrName: svrName, name: name, topic: topic}, msgs...)
+	if err != nil {
+		ext.Error.Set(span, true)
+		span.LogKV("error", err.Error())
+	}
+	return err
+}
+
+// ExtractKafkaHeaders 返回带有consumer span的ctx，span通过FollowsFrom关联到生产者的span，调用方负责Finish。
+// 消息头中的request id会放到ctx的go-micro metadata里，继续调用其他服务时会透传。
+func ExtractKafkaHeaders(ctx context.Context, msg kafka.Message) (context.Context, opentracing.Span) {
+	var opts []opentracing.StartSpanOption
+	producer, err := opentracing.GlobalTracer().Extract(opentracing.TextMap, kafkaHeaderCarrier{msg: &msg})
+	if err == nil {
+		opts = append(opts, opentracing.FollowsFrom(producer))
+	}
+	if parent := opentracing.SpanFromContext(ctx); parent != nil {
+		opts = append(opts, opentracing.ChildOf(parent.Context()))
+	}
+	span := opentracing.StartSpan("kafka.consume "+msg.Topic, opts...)
+	ext.SpanKindConsumer.Set(span)
+	ext.MessageBusDestination.Set(span, msg.Topic)
+	span.SetTag("kafka.partition", msg.Partition)
+	span.SetTag("kafka.offset", msg.Offset)
+	if messageType := KafkaMessageType(msg); messageType != "" {
+		span.SetTag("message.type", messageType)
+	}
+	ctx = opentracing.ContextWithSpan(ctx, span)
+
+	if requestID, ok := GetKafkaHeader(msg, HeaderRequestID); ok {
+		md, _ := metadata.FromContext(ctx)
+		newMd := metadata.Metadata{}
+		for k, v := range md {
+			newMd[k] = v
+		}
+		newMd[RequestIDMetadataKey] = string(requestID)
+		ctx = metadata.NewContext(ctx, newMd)
+	}
+	return ctx, span
+}
+
+// RequestIDFromContext 读取go-micro metadata中的request id，key不区分大小写
+func RequestIDFromContext(ctx context.Context) string {
+	md, ok := metadata.FromContext(ctx)
+	if !ok {
+		return ""
+	}
+	if requestID, ok := md[RequestIDMetadataKey]; ok {
+		return requestID
+	}
+	for k, v := range md {
+		if strings.EqualFold(k, RequestIDMetadataKey) {
+			return v
+		}
+	}
+	return ""
+}
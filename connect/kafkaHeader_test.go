@@ -0,0 +1,120 @@
+package connect
+
+import (
+	"context"
+	"github.com/micro/go-micro/v2/metadata"
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/mocktracer"
+	"github.com/segmentio/kafka-go"
+	"testing"
+)
+
+func useMockTracer(t *testing.T) *mocktracer.MockTracer {
+	tracer := mocktracer.New()
+	origin := opentracing.GlobalTracer()
+	opentracing.SetGlobalTracer(tracer)
+	t.Cleanup(func() {
+		opentracing.SetGlobalTracer(origin)
+	})
+	return tracer
+}
+
+func countKafkaHeader(msg kafka.Message, key string) int {
+	n := 0
+	for _, header := range msg.Headers {
+		if header.Key == key {
+			n++
+		}
+	}
+	return n
+}
+
+func TestKafkaHeadersRoundTrip(t *testing.T) {
+	tracer := useMockTracer(t)
+	producer := tracer.StartSpan("produce")
+	ctx := opentracing.ContextWithSpan(context.Background(), producer)
+	ctx = metadata.NewContext(ctx, metadata.Metadata{RequestIDMetadataKey: "req-1"})
+
+	msg := kafka.Message{Topic: "user"}
+	InjectKafkaHeaders(ctx, &msg, "user.created")
+	if requestID, _ := GetKafkaHeader(msg, HeaderRequestID); string(requestID) != "req-1" {
+		t.Errorf("request id header = %q", requestID)
+	}
+	if messageType := KafkaMessageType(msg); messageType != "user.created" {
+		t.Errorf("message type = %q", messageType)
+	}
+
+	consumerCtx, span := ExtractKafkaHeaders(context.Background(), msg)
+	span.Finish()
+	consumer := span.(*mocktracer.MockSpan)
+	producerCtx := producer.Context().(mocktracer.MockSpanContext)
+	if consumer.ParentID != producerCtx.SpanID || consumer.SpanContext.TraceID != producerCtx.TraceID {
+		t.Errorf("consumer span parent = %d/%d, want %d/%d", consumer.SpanContext.TraceID, consumer.ParentID, producerCtx.TraceID, producerCtx.SpanID)
+	}
+	if consumer.Tag("message.type") != "user.created" {
+		t.Errorf("message type tag = %v", consumer.Tag("message.type"))
+	}
+	if opentracing.SpanFromContext(consumerCtx) != span {
+		t.Error("consumer span is not in ctx")
+	}
+	if requestID := RequestIDFromContext(consumerCtx); requestID != "req-1" {
+		t.Errorf("request id = %q", requestID)
+	}
+}
+
+func TestKafkaHeadersMissing(t *testing.T) {
+	useMockTracer(t)
+	msg := kafka.Message{Topic: "user"}
+	InjectKafkaHeaders(context.Background(), &msg, "")
+	if len(msg.Headers) != 0 {
+		t.Fatalf("headers = %v", msg.Headers)
+	}
+
+	ctx, span := ExtractKafkaHeaders(context.Background(), msg)
+	span.Finish()
+	if parent := span.(*mocktracer.MockSpan).ParentID; parent != 0 {
+		t.Errorf("parent = %d, want a root span", parent)
+	}
+	if _, ok := metadata.FromContext(ctx); ok {
+		t.Error("metadata should not be set without a request id header")
+	}
+	if messageType := KafkaMessageType(msg); messageType != "" {
+		t.Errorf("message type = %q", messageType)
+	}
+}
+
+func TestKafkaHeadersDuplicate(t *testing.T) {
+	tracer := useMockTracer(t)
+	msg := kafka.Message{Headers: []kafka.Header{
+		{Key: HeaderRequestID, Value: []byte("old-1")},
+		{Key: HeaderRequestID, Value: []byte("old-2")},
+		{Key: HeaderMessageType, Value: []byte("old.type")},
+	}}
+
+	producer := tracer.StartSpan("produce")
+	ctx := opentracing.ContextWithSpan(context.Background(), producer)
+	ctx = metadata.NewContext(ctx, metadata.Metadata{"x-request-id": "req-2"})
+	//重复注入时覆盖已有的头，不会追加
+	InjectKafkaHeaders(ctx, &msg, "user.updated")
+	headers := len(msg.Headers)
+	InjectKafkaHeaders(ctx, &msg, "user.updated")
+	if len(msg.Headers) != headers {
+		t.Fatalf("headers are appended on the second inject: %v", msg.Headers)
+	}
+	if n := countKafkaHeader(msg, HeaderMessageType); n != 1 {
+		t.Errorf("message type headers = %d", n)
+	}
+
+	//同名的头以第一个为准
+	if requestID, _ := GetKafkaHeader(msg, HeaderRequestID); string(requestID) != "req-2" {
+		t.Errorf("request id header = %q", requestID)
+	}
+	ctx, span := ExtractKafkaHeaders(context.Background(), msg)
+	span.Finish()
+	if requestID := RequestIDFromContext(ctx); requestID != "req-2" {
+		t.Errorf("request id = %q", requestID)
+	}
+	if KafkaMessageType(msg) != "user.updated" {
+		t.Errorf("message type = %q", KafkaMessageType(msg))
+	}
+}
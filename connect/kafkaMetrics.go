@@ -0,0 +1,305 @@
+package connect
+
+import (
+	"context"
+	"errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/segmentio/kafka-go"
+	"github.com/sirupsen/logrus"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	kafkaLagInterval = 30 * time.Second
+	kafkaLagTimeout  = 10 * time.Second
+)
+
+// kafkaCollector 每次抓取时读取所有writer和reader的Stats()，不访问网络。
+// kafka-go的Stats()返回的是距上次调用的增量，其他地方不能再调用Stats()，否则计数会丢失。
+// 消费组的lag由后台循环定时计算，抓取时只导出缓存的值。
+type kafkaCollector struct {
+	sync.Mutex
+
+	writerMessages *prometheus.CounterVec
+	writerBytes    *prometheus.CounterVec
+	writerErrors   *prometheus.CounterVec
+	writerWrites   *prometheus.CounterVec
+	writerQueue    *prometheus.GaugeVec
+	writeSeconds   *prometheus.HistogramVec
+
+	readerMessages   *prometheus.CounterVec
+	readerBytes      *prometheus.CounterVec
+	readerErrors     *prometheus.CounterVec
+	readerFetches    *prometheus.CounterVec
+	readerTimeouts   *prometheus.CounterVec
+	readerRebalances *prometheus.CounterVec
+	fetchSeconds     *prometheus.HistogramVec
+	readerLag        *prometheus.GaugeVec
+
+	lagOnce sync.Once
+}
+
+var kafkaMetrics *kafkaCollector
+
+func init() {
+	kafkaMetrics = newKafkaCollector()
+	_ = prometheus.Register(kafkaMetrics)
+}
+
+func newKafkaCollector() *kafkaCollector {
+	writerLabels := []string{"service_name", "name", "topic", "async"}
+	readerLabels := []string{"service_name", "name", "topic", "group"}
+	return &kafkaCollector{
+		writerMessages: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "kafka_writer_messages_total",
+			Help: "Number of messages written.",
+		}, writerLabels),
+		writerBytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "kafka_writer_bytes_total",
+			Help: "Number of message bytes written.",
+		}, writerLabels),
+		writerErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "kafka_writer_errors_total",
+			Help: "Number of write errors.",
+		}, writerLabels),
+		writerWrites: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "kafka_writer_writes_total",
+			Help: "Number of batches written.",
+		}, writerLabels),
+		writerQueue: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "kafka_writer_queue_length",
+			Help: "Number of messages waiting in the writer queue.",
+		}, writerLabels),
+		writeSeconds: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "kafka_write_seconds",
+			Help:    "Latency of WriteMessages calls made by this library.",
+			Buckets: []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10},
+		}, []string{"service_name", "name", "topic", "result"}),
+		readerMessages: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "kafka_reader_messages_total",
+			Help: "Number of messages read.",
+		}, readerLabels),
+		readerBytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "kafka_reader_bytes_total",
+			Help: "Number of message bytes read.",
+		}, readerLabels),
+		readerErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "kafka_reader_errors_total",
+			Help: "Number of read errors.",
+		}, readerLabels),
+		readerFetches: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "kafka_reader_fetches_total",
+			Help: "Number of fetch requests.",
+		}, readerLabels),
+		readerTimeouts: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "kafka_reader_timeouts_total",
+			Help: "Number of fetch timeouts.",
+		}, readerLabels),
+		readerRebalances: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "kafka_reader_rebalances_total",
+			Help: "Number of consumer group rebalances.",
+		}, readerLabels),
+		fetchSeconds: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "kafka_fetch_seconds",
+			Help:    "Latency of FetchMessage calls made by RunConsumer, including the wait for new messages.",
+			Buckets: []float64{0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 2.5, 5, 10, 30},
+		}, readerLabels),
+		readerLag: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "kafka_reader_lag",
+			Help: "Number of messages behind the partition high watermark.",
+		}, append(readerLabels, "partition")),
+	}
+}
+
+func (c *kafkaCollector) vecs() []prometheus.Collector {
+	return []prometheus.Collector{
+		c.writerMessages, c.writerBytes, c.writerErrors, c.writerWrites, c.writerQueue, c.writeSeconds,
+		c.readerMessages, c.readerBytes, c.readerErrors, c.readerFetches, c.readerTimeouts, c.readerRebalances,
+		c.fetchSeconds, c.readerLag,
+	}
+}
+
+func (c *kafkaCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, vec := range c.vecs() {
+		vec.Describe(ch)
+	}
+}
+
+func (c *kafkaCollector) Collect(ch chan<- prometheus.Metric) {
+	c.Lock()
+	defer c.Unlock()
+
+	writerMap.Range(func(key, value interface{}) bool {
+		c.observeWriter(key.(kafkaWriterKey), value.(*kafka.Writer).Stats())
+		return true
+	})
+
+	readerMap.Range(func(key, value interface{}) bool {
+		c.observeReader(key.(kafkaReaderKey), value.(*kafka.Reader).Stats())
+		return true
+	})
+
+	for _, vec := range c.vecs() {
+		vec.Collect(ch)
+	}
+}
+
+// observeWriter 把一次Stats()的增量累加到计数器上
+func (c *kafkaCollector) observeWriter(k kafkaWriterKey, stats kafka.WriterStats) {
+	labels := []string{k.svrName, k.name, k.topic, strconv.FormatBool(k.async)}
+	c.writerMessages.WithLabelValues(labels...).Add(float64(stats.Messages))
+	c.writerBytes.WithLabelValues(labels...).Add(float64(stats.Bytes))
+	c.writerErrors.WithLabelValues(labels...).Add(float64(stats.Errors))
+	c.writerWrites.WithLabelValues(labels...).Add(float64(stats.Writes))
+	c.writerQueue.WithLabelValues(labels...).Set(float64(stats.QueueLength))
+}
+
+func (c *kafkaCollector) observeReader(k kafkaReaderKey, stats kafka.ReaderStats) {
+	labels := []string{k.svrName, k.name, k.topic, k.groupID}
+	c.readerMessages.WithLabelValues(labels...).Add(float64(stats.Messages))
+	c.readerBytes.WithLabelValues(labels...).Add(float64(stats.Bytes))
+	c.readerErrors.WithLabelValues(labels...).Add(float64(stats.Errors))
+	c.readerFetches.WithLabelValues(labels...).Add(float64(stats.Fetches))
+	c.readerTimeouts.WithLabelValues(labels...).Add(float64(stats.Timeouts))
+	c.readerRebalances.WithLabelValues(labels...).Add(float64(stats.Rebalances))
+	if k.groupID == "" {
+		//不使用消费组的reader只读一个partition，Stats中的lag就是这个partition的
+		c.readerLag.WithLabelValues(append(labels, stats.Partition)...).Set(float64(stats.Lag))
+	}
+}
+
+// startLagLoop 第一次创建reader时启动，之后一直运行
+func (c *kafkaCollector) startLagLoop() {
+	c.lagOnce.Do(func() {
+		go func() {
+			ticker := time.NewTicker(kafkaLagInterval)
+			defer ticker.Stop()
+			for range ticker.C {
+				c.updateGroupLag()
+			}
+		}()
+	})
+}
+
+// updateGroupLag 消费组的reader在Stats中只有最后一次拉取的partition的lag，
+// 用broker上消费组已提交的offset和partition的最新offset计算，不管reader是不是RunConsumer创建的
+func (c *kafkaCollector) updateGroupLag() {
+	readerMap.Range(func(key, value interface{}) bool {
+		k := key.(kafkaReaderKey)
+		if k.groupID == "" {
+			return true
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), kafkaLagTimeout)
+		lags, err := readKafkaGroupLag(ctx, k)
+		cancel()
+		if err != nil {
+			//读取失败时保留上一次的值
+			logrus.WithFields(logrus.Fields{
+				"name":    k.name,
+				"topic":   k.topic,
+				"groupID": k.groupID,
+				"error":   err,
+			}).Warn("read kafka consumer lag error")
+			return true
+		}
+		for partition, lag := range lags {
+			c.readerLag.WithLabelValues(k.svrName, k.name, k.topic, k.groupID, strconv.Itoa(partition)).Set(float64(lag))
+		}
+		return true
+	})
+}
+
+func readKafkaGroupLag(ctx context.Context, key kafkaReaderKey) (map[int]int64, error) {
+	conf, err := getKafkaConfig(key.kafkaTopicKey)
+	if err != nil {
+		return nil, err
+	}
+	dialer, err := conf.dialer()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(conf.brokers()) == 0 {
+		//NewClientWith没有broker时会panic
+		return nil, errors.New("brokers is empty")
+	}
+	client := kafka.NewClientWith(kafka.ClientConfig{Brokers: conf.brokers(), Dialer: dialer})
+	committed, err := client.ConsumerOffsets(ctx, kafka.TopicAndGroup{Topic: key.topic, GroupId: key.groupID})
+	if err != nil {
+		return nil, err
+	}
+	watermarks, err := readKafkaWatermarks(ctx, conf, dialer, key.topic)
+	if err != nil {
+		return nil, err
+	}
+	return kafkaGroupLag(committed, watermarks), nil
+}
+
+// kafkaGroupLag 按partition计算最新offset和已提交offset的差，没有提交过的partition不计算
+func kafkaGroupLag(committed, watermarks map[int]int64) map[int]int64 {
+	lags := make(map[int]int64, len(watermarks))
+	for partition, highWatermark := range watermarks {
+		offset, ok := committed[partition]
+		if !ok || offset < 0 {
+			//还没有提交过offset
+			continue
+		}
+		lag := highWatermark - offset
+		if lag < 0 {
+			lag = 0
+		}
+		lags[partition] = lag
+	}
+	return lags
+}
+
+func readKafkaWatermarks(ctx context.Context, conf *kafkaConfig, dialer *kafka.Dialer, topic string) (map[int]int64, error) {
+	conn, err := dialKafkaBroker(ctx, conf, dialer)
+	if err != nil {
+		return nil, err
+	}
+	partitions, err := conn.ReadPartitions(topic)
+	conn.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	offsets := make(map[int]int64, len(partitions))
+	for _, partition := range partitions {
+		leader, err := dialer.DialLeader(ctx, "tcp", partition.Leader.Host+":"+strconv.Itoa(partition.Leader.Port), topic, partition.ID)
+		if err != nil {
+			return nil, err
+		}
+		offset, err := leader.ReadLastOffset()
+		leader.Close()
+		if err != nil {
+			return nil, err
+		}
+		offsets[partition.ID] = offset
+	}
+	return offsets, nil
+}
+
+// writeKafkaMessages 写消息并记录耗时
+func writeKafkaMessages(ctx context.Context, writer *kafka.Writer, key kafkaTopicKey, msgs ...kafka.Message) error {
+	start := time.Now()
+	err := writer.WriteMessages(ctx, msgs...)
+	result := "success"
+	if err != nil {
+		result = "error"
+	}
+	kafkaMetrics.writeSeconds.WithLabelValues(key.svrName, key.name, key.topic, result).Observe(time.Since(start).Seconds())
+	return err
+}
+
+// fetchKafkaMessage 拉取消息并记录耗时，ctx取消导致的返回不记录
+func fetchKafkaMessage(ctx context.Context, reader *kafka.Reader, key kafkaReaderKey) (kafka.Message, error) {
+	start := time.Now()
+	msg, err := reader.FetchMessage(ctx)
+	if ctx.Err() == nil {
+		kafkaMetrics.fetchSeconds.WithLabelValues(key.svrName, key.name, key.topic, key.groupID).Observe(time.Since(start).Seconds())
+	}
+	return msg, err
+}
@@ -0,0 +1,98 @@
+package connect
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/segmentio/kafka-go"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestKafkaCollectorObserve(t *testing.T) {
+	c := newKafkaCollector()
+	writerKey := kafkaWriterKey{kafkaTopicKey{testSrvName, "default", "orders"}, true}
+	//Stats()返回的是增量，计数器累加，队列长度取最后一次
+	c.observeWriter(writerKey, kafka.WriterStats{Messages: 3, Bytes: 30, Errors: 1, Writes: 2, QueueLength: 5})
+	c.observeWriter(writerKey, kafka.WriterStats{Messages: 2, Bytes: 20, Writes: 1, QueueLength: 1})
+
+	partitionKey := kafkaReaderKey{kafkaTopicKey{testSrvName, "default", "orders"}, ""}
+	groupKey := kafkaReaderKey{kafkaTopicKey{testSrvName, "default", "orders"}, "billing"}
+	c.observeReader(partitionKey, kafka.ReaderStats{Messages: 4, Bytes: 40, Fetches: 2, Timeouts: 1, Partition: "2", Lag: 7})
+	c.observeReader(groupKey, kafka.ReaderStats{Messages: 1, Errors: 1, Rebalances: 1, Partition: "-1", Lag: 9})
+
+	writerLabels := []string{testSrvName, "default", "orders", "true"}
+	partitionLabels := []string{testSrvName, "default", "orders", ""}
+	groupLabels := []string{testSrvName, "default", "orders", "billing"}
+	testData := []struct {
+		name   string
+		metric prometheus.Collector
+		want   float64
+	}{
+		{"writer messages", c.writerMessages.WithLabelValues(writerLabels...), 5},
+		{"writer bytes", c.writerBytes.WithLabelValues(writerLabels...), 50},
+		{"writer errors", c.writerErrors.WithLabelValues(writerLabels...), 1},
+		{"writer writes", c.writerWrites.WithLabelValues(writerLabels...), 3},
+		{"writer queue", c.writerQueue.WithLabelValues(writerLabels...), 1},
+		{"reader messages", c.readerMessages.WithLabelValues(partitionLabels...), 4},
+		{"reader bytes", c.readerBytes.WithLabelValues(partitionLabels...), 40},
+		{"reader fetches", c.readerFetches.WithLabelValues(partitionLabels...), 2},
+		{"reader timeouts", c.readerTimeouts.WithLabelValues(partitionLabels...), 1},
+		{"reader lag", c.readerLag.WithLabelValues(append(partitionLabels, "2")...), 7},
+		{"group messages", c.readerMessages.WithLabelValues(groupLabels...), 1},
+		{"group errors", c.readerErrors.WithLabelValues(groupLabels...), 1},
+		{"group rebalances", c.readerRebalances.WithLabelValues(groupLabels...), 1},
+	}
+	for _, d := range testData {
+		if got := testutil.ToFloat64(d.metric); got != d.want {
+			t.Errorf("%s = %v, want %v", d.name, got, d.want)
+		}
+	}
+
+	//消费组的lag由updateGroupLag计算，Stats中的lag不导出
+	if n := testutil.CollectAndCount(c.readerLag); n != 1 {
+		t.Errorf("lag series = %d, want 1", n)
+	}
+}
+
+func TestKafkaCollectorCollect(t *testing.T) {
+	c := newKafkaCollector()
+	//不使用消费组的reader在第一次读取之前不会连接broker
+	key := kafkaReaderKey{kafkaTopicKey{testSrvName, "collect", "orders"}, ""}
+	reader := kafka.NewReader(kafka.ReaderConfig{Brokers: []string{"127.0.0.1:9092"}, Topic: "orders", Partition: 3})
+	readerMap.Store(key, reader)
+	t.Cleanup(func() {
+		readerMap.Delete(key)
+		reader.Close()
+	})
+
+	expected := `
+# HELP kafka_reader_lag Number of messages behind the partition high watermark.
+# TYPE kafka_reader_lag gauge
+kafka_reader_lag{group="",name="collect",partition="3",service_name="test_service",topic="orders"} 0
+# HELP kafka_reader_messages_total Number of messages read.
+# TYPE kafka_reader_messages_total counter
+kafka_reader_messages_total{group="",name="collect",service_name="test_service",topic="orders"} 0
+`
+	if err := testutil.CollectAndCompare(c, strings.NewReader(expected), "kafka_reader_lag", "kafka_reader_messages_total"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestKafkaGroupLag(t *testing.T) {
+	testData := []struct {
+		name       string
+		committed  map[int]int64
+		watermarks map[int]int64
+		lags       map[int]int64
+	}{
+		{"behind", map[int]int64{0: 10, 1: 5}, map[int]int64{0: 15, 1: 5}, map[int]int64{0: 5, 1: 0}},
+		{"not committed", map[int]int64{0: -1}, map[int]int64{0: 15, 1: 3}, map[int]int64{}},
+		{"committed after watermark", map[int]int64{0: 20}, map[int]int64{0: 15}, map[int]int64{0: 0}},
+	}
+	for _, d := range testData {
+		if lags := kafkaGroupLag(d.committed, d.watermarks); !reflect.DeepEqual(lags, d.lags) {
+			t.Errorf("%s: lags = %v, want %v", d.name, lags, d.lags)
+		}
+	}
+}
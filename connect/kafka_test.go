@@ -0,0 +1,103 @@
+package connect
+
+import (
+	"github.com/segmentio/kafka-go"
+	"testing"
+	"time"
+)
+
+func TestParseKafkaConfigLegacyString(t *testing.T) {
+	//go-micro对字符串值返回不带引号的原始内容
+	conf, err := parseKafkaConfig([]byte("null"), []byte("10.0.0.1:9092, 10.0.0.2:9092"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	brokers := conf.brokers()
+	if len(brokers) != 2 || brokers[0] != "10.0.0.1:9092" || brokers[1] != "10.0.0.2:9092" {
+		t.Fatalf("unexpected brokers %v", brokers)
+	}
+
+	writerConfig, err := conf.writerConfig("orders", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := writerConfig.Balancer.(*kafka.LeastBytes); !ok || !writerConfig.Async {
+		t.Fatalf("unexpected writer config %+v", writerConfig)
+	}
+}
+
+func TestParseKafkaConfigBrokerForms(t *testing.T) {
+	for _, topic := range []string{`"10.0.0.1:9092,10.0.0.2:9092"`, `["10.0.0.1:9092","10.0.0.2:9092"]`, `{"brokers":"10.0.0.1:9092,10.0.0.2:9092"}`} {
+		conf, err := parseKafkaConfig(nil, []byte(topic))
+		if err != nil {
+			t.Fatalf("%s: %v", topic, err)
+		}
+		if brokers := conf.brokers(); len(brokers) != 2 || brokers[1] != "10.0.0.2:9092" {
+			t.Fatalf("%s: unexpected brokers %v", topic, brokers)
+		}
+	}
+}
+
+func TestParseKafkaConfigOverride(t *testing.T) {
+	defaults := []byte(`{"brokers":"10.0.0.1:9092","balancer":"hash","batch_timeout":"50ms","start_offset":"last","max_wait":"1s"}`)
+	topic := []byte(`{"balancer":"round_robin","compression":"gzip","commit_interval":"2s"}`)
+	conf, err := parseKafkaConfig(defaults, topic)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writerConfig, err := conf.writerConfig("orders", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := writerConfig.Balancer.(*kafka.RoundRobin); !ok {
+		t.Fatalf("topic balancer should override default, got %T", writerConfig.Balancer)
+	}
+	if writerConfig.BatchTimeout != 50*time.Millisecond || writerConfig.CompressionCodec == nil {
+		t.Fatalf("unexpected writer config %+v", writerConfig)
+	}
+
+	readerConfig, err := conf.readerConfig("orders", "group")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if readerConfig.StartOffset != kafka.LastOffset || readerConfig.CommitInterval != 2*time.Second || readerConfig.MaxWait != time.Second {
+		t.Fatalf("unexpected reader config %+v", readerConfig)
+	}
+}
+
+func TestParseKafkaConfigInvalid(t *testing.T) {
+	if _, err := parseKafkaConfig(nil, []byte("null")); err == nil {
+		t.Fatal("missing brokers should fail")
+	}
+	conf, err := parseKafkaConfig(nil, []byte(`{"brokers":"10.0.0.1:9092","balancer":"random"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conf.writerConfig("orders", false); err == nil {
+		t.Fatal("unknown balancer should fail")
+	}
+}
+
+func TestKafkaDialer(t *testing.T) {
+	defaults := []byte(`{"brokers":"10.0.0.1:9093","client_id":"order","dial_timeout":"3s","sasl":{"mechanism":"scram-sha-512","username":"u","password":"p"}}`)
+	conf, err := parseKafkaConfig(defaults, []byte("null"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dialer, err := conf.dialer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dialer.ClientID != "order" || dialer.Timeout != 3*time.Second || dialer.TLS != nil {
+		t.Fatalf("unexpected dialer %+v", dialer)
+	}
+	if dialer.SASLMechanism == nil || dialer.SASLMechanism.Name() != "SCRAM-SHA-512" {
+		t.Fatalf("unexpected sasl mechanism %v", dialer.SASLMechanism)
+	}
+
+	conf.SASL.Mechanism = "gssapi"
+	if _, err := conf.dialer(); err == nil {
+		t.Fatal("unknown sasl mechanism should fail")
+	}
+}
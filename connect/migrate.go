@@ -0,0 +1,407 @@
+package connect
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/jinzhu/gorm"
+	"github.com/lifenglin/micro-library/helper"
+	"github.com/sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	migrationTable    = "schema_migrations"
+	migrationLockWait = 60
+)
+
+var migrationFileName = regexp.MustCompile(`^(\d+)_(.+)\.(up|down)\.sql$`)
+
+// Migration 一个版本的变更，Up/Down为sql，UpFunc/DownFunc为go代码，同时设置时先执行sql
+type Migration struct {
+	Version  int64
+	Name     string
+	Up       string
+	Down     string
+	UpFunc   func(tx *gorm.DB) error
+	DownFunc func(tx *gorm.DB) error
+}
+
+type MigrationStatus struct {
+	Version   int64
+	Name      string
+	Applied   bool
+	AppliedAt time.Time
+}
+
+type Migrator struct {
+	db         *gorm.DB
+	sqlDB      *sql.DB
+	migrations []Migration
+	lockName   string
+	dryRun     io.Writer
+	log        *logrus.Entry
+}
+
+type MigratorOption func(*Migrator)
+
+// MigrateDryRun 只把要执行的sql写到w，不修改数据库
+func MigrateDryRun(w io.Writer) MigratorOption {
+	return func(m *Migrator) {
+		m.dryRun = w
+	}
+}
+
+// MigrateLockName 多个pod之间互斥使用的锁名，默认为schema_migrations
+func MigrateLockName(name string) MigratorOption {
+	return func(m *Migrator) {
+		m.lockName = name
+	}
+}
+
+func MigrateLog(log *logrus.Entry) MigratorOption {
+	return func(m *Migrator) {
+		m.log = log
+	}
+}
+
+// NewMigrator db必须是连接池上的连接，不能是事务或ClusterAuto的连接，加锁时要从连接池取出单独的连接
+func NewMigrator(db *gorm.DB, migrations []Migration, opts ...MigratorOption) (*Migrator, error) {
+	sqlDB, ok := db.CommonDB().(*sql.DB)
+	if !ok {
+		return nil, errors.New("migrator needs a connection on the pool, not a transaction or ClusterAuto connection")
+	}
+	m := &Migrator{
+		db:         db,
+		sqlDB:      sqlDB,
+		migrations: make([]Migration, len(migrations)),
+		lockName:   migrationTable,
+		log:        logrus.NewEntry(logrus.StandardLogger()),
+	}
+	copy(m.migrations, migrations)
+	for _, opt := range opts {
+		opt(m)
+	}
+
+	sort.Slice(m.migrations, func(i, j int) bool {
+		return m.migrations[i].Version < m.migrations[j].Version
+	})
+	for i, migration := range m.migrations {
+		if migration.Version <= 0 {
+			return nil, fmt.Errorf("migration %s: version must be positive", migration.Name)
+		}
+		if i > 0 && m.migrations[i-1].Version == migration.Version {
+			return nil, fmt.Errorf("duplicate migration version %d", migration.Version)
+		}
+	}
+	return m, nil
+}
+
+// RunMigrations 在name的主库上执行所有未执行的变更
+func RunMigrations(ctx context.Context, hlp *helper.Helper, srvName string, name string, migrations []Migration, opts ...MigratorOption) (int, error) {
+	db, err := ConnectDB(ctx, hlp, srvName, name, ClusterMaster)
+	if err != nil {
+		return 0, err
+	}
+	m, err := NewMigrator(db, migrations, append([]MigratorOption{MigrateLog(hlp.MysqlLog)}, opts...)...)
+	if err != nil {
+		return 0, err
+	}
+	return m.Up(ctx)
+}
+
+// LoadMigrations 从fs的dir目录读取形如0001_create_user.up.sql和0001_create_user.down.sql的文件
+func LoadMigrations(fs http.FileSystem, dir string) ([]Migration, error) {
+	d, err := fs.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer d.Close()
+	files, err := d.Readdir(-1)
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[int64]*Migration)
+	for _, file := range files {
+		match := migrationFileName.FindStringSubmatch(file.Name())
+		if file.IsDir() || match == nil {
+			continue
+		}
+		version, _ := strconv.ParseInt(match[1], 10, 64)
+		f, err := fs.Open(path.Join(dir, file.Name()))
+		if err != nil {
+			return nil, err
+		}
+		content, err := ioutil.ReadAll(f)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		migration, ok := byVersion[version]
+		if !ok {
+			migration = &Migration{Version: version, Name: match[2]}
+			byVersion[version] = migration
+		} else if migration.Name != match[2] {
+			return nil, fmt.Errorf("migration %d has different names: %s, %s", version, migration.Name, match[2])
+		}
+		if match[3] == "up" {
+			migration.Up = string(content)
+		} else {
+			migration.Down = string(content)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, migration := range byVersion {
+		migrations = append(migrations, *migration)
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+	return migrations, nil
+}
+
+// Up 按版本顺序执行所有未执行的变更，返回执行的数量
+func (m *Migrator) Up(ctx context.Context) (int, error) {
+	unlock, err := m.lock(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+
+	applied, err := m.applied()
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, migration := range m.migrations {
+		if _, ok := applied[migration.Version]; ok {
+			continue
+		}
+		err := m.run(migration, migration.Up, migration.UpFunc, func(tx *gorm.DB) error {
+			return tx.Exec("INSERT INTO "+migrationTable+" (version, name, applied_at) VALUES (?, ?, ?)",
+				migration.Version, migration.Name, time.Now().Unix()).Error
+		})
+		if err != nil {
+			return count, fmt.Errorf("migrate up %d_%s fail: %w", migration.Version, migration.Name, err)
+		}
+		count++
+	}
+	return count, nil
+}
+
+// Down 按版本倒序回滚最近执行的steps个变更
+func (m *Migrator) Down(ctx context.Context, steps int) (int, error) {
+	unlock, err := m.lock(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+
+	applied, err := m.applied()
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for i := len(m.migrations) - 1; i >= 0 && count < steps; i-- {
+		migration := m.migrations[i]
+		if _, ok := applied[migration.Version]; !ok {
+			continue
+		}
+		err := m.run(migration, migration.Down, migration.DownFunc, func(tx *gorm.DB) error {
+			return tx.Exec("DELETE FROM "+migrationTable+" WHERE version = ?", migration.Version).Error
+		})
+		if err != nil {
+			return count, fmt.Errorf("migrate down %d_%s fail: %w", migration.Version, migration.Name, err)
+		}
+		count++
+	}
+	return count, nil
+}
+
+func (m *Migrator) Status(ctx context.Context) ([]MigrationStatus, error) {
+	applied, err := m.applied()
+	if err != nil {
+		return nil, err
+	}
+
+	list := make([]MigrationStatus, 0, len(m.migrations))
+	for _, migration := range m.migrations {
+		status := MigrationStatus{
+			Version: migration.Version,
+			Name:    migration.Name,
+		}
+		if appliedAt, ok := applied[migration.Version]; ok {
+			status.Applied = true
+			status.AppliedAt = time.Unix(appliedAt, 0)
+		}
+		list = append(list, status)
+	}
+	return list, nil
+}
+
+func (m *Migrator) run(migration Migration, sqlText string, fn func(tx *gorm.DB) error, record func(tx *gorm.DB) error) error {
+	statements := splitSqlStatements(sqlText)
+	if m.dryRun != nil {
+		fmt.Fprintf(m.dryRun, "-- %d_%s\n", migration.Version, migration.Name)
+		for _, statement := range statements {
+			fmt.Fprintf(m.dryRun, "%s;\n", statement)
+		}
+		if fn != nil {
+			fmt.Fprintf(m.dryRun, "-- go migration %d_%s\n", migration.Version, migration.Name)
+		}
+		return nil
+	}
+
+	start := time.Now()
+	tx := m.db.Begin()
+	if tx.Error != nil {
+		return tx.Error
+	}
+	for _, statement := range statements {
+		if err := tx.Exec(statement).Error; err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	if fn != nil {
+		if err := fn(tx); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	if err := record(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit().Error; err != nil {
+		return err
+	}
+
+	m.log.WithFields(logrus.Fields{
+		"version": migration.Version,
+		"name":    migration.Name,
+		"elapsed": time.Since(start).String(),
+	}).Info("migrate")
+	return nil
+}
+
+// applied 返回已执行的版本和执行时间，dry run时不创建版本表
+func (m *Migrator) applied() (map[int64]int64, error) {
+	applied := make(map[int64]int64)
+	if m.dryRun != nil && !m.db.HasTable(migrationTable) {
+		return applied, nil
+	}
+	if m.dryRun == nil {
+		err := m.db.Exec("CREATE TABLE IF NOT EXISTS " + migrationTable +
+			" (version BIGINT NOT NULL PRIMARY KEY, name VARCHAR(255) NOT NULL, applied_at BIGINT NOT NULL)").Error
+		if err != nil {
+			return nil, fmt.Errorf("create %s fail: %w", migrationTable, err)
+		}
+	}
+
+	rows, err := m.db.Raw("SELECT version, applied_at FROM " + migrationTable).Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var version, appliedAt int64
+		if err := rows.Scan(&version, &appliedAt); err != nil {
+			return nil, err
+		}
+		applied[version] = appliedAt
+	}
+	return applied, rows.Err()
+}
+
+// lock mysql使用GET_LOCK保证只有一个pod在执行变更，sqlite为单进程不需要加锁
+func (m *Migrator) lock(ctx context.Context) (func(), error) {
+	if m.dryRun != nil || m.db.Dialect().GetName() != "mysql" {
+		return func() {}, nil
+	}
+
+	conn, err := m.sqlDB.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	//GET_LOCK最多等待migrationLockWait秒，不受statement_timeout限制
+	ctx = WithStatementTimeout(ctx, 0)
+	var got sql.NullInt64
+	err = conn.QueryRowContext(ctx, "SELECT GET_LOCK(?, ?)", m.lockName, migrationLockWait).Scan(&got)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("get migration lock fail: %w", err)
+	}
+	if got.Int64 != 1 {
+		conn.Close()
+		return nil, errors.New("get migration lock timeout")
+	}
+
+	return func() {
+		_, err := conn.ExecContext(context.Background(), "SELECT RELEASE_LOCK(?)", m.lockName)
+		if err != nil {
+			m.log.WithFields(logrus.Fields{
+				"lock":  m.lockName,
+				"error": err.Error(),
+			}).Warn("release migration lock error")
+		}
+		conn.Close()
+	}, nil
+}
+
+// splitSqlStatements 按分号拆分多条sql，忽略引号和注释中的分号
+func splitSqlStatements(text string) []string {
+	var statements []string
+	var current strings.Builder
+	var quote rune
+	lineComment := false
+	runes := []rune(text)
+	for i := 0; i < len(runes); i++ {
+		c := runes[i]
+		switch {
+		case lineComment:
+			if c == '\n' {
+				lineComment = false
+			}
+			continue
+		case quote != 0:
+			if c == '\\' && i+1 < len(runes) {
+				current.WriteRune(c)
+				i++
+				c = runes[i]
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"' || c == '`':
+			quote = c
+		case c == '-' && i+1 < len(runes) && runes[i+1] == '-':
+			lineComment = true
+			continue
+		case c == ';':
+			if statement := strings.TrimSpace(current.String()); statement != "" {
+				statements = append(statements, statement)
+			}
+			current.Reset()
+			continue
+		}
+		current.WriteRune(c)
+	}
+	if statement := strings.TrimSpace(current.String()); statement != "" {
+		statements = append(statements, statement)
+	}
+	return statements
+}
@@ -0,0 +1,155 @@
+package connect
+
+import (
+	"bytes"
+	"context"
+	"github.com/jinzhu/gorm"
+	"strings"
+	"testing"
+)
+
+func newMigrateTestDB(t *testing.T) *gorm.DB {
+	db, err := gorm.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	//内存库每个连接都是独立的库
+	db.DB().SetMaxOpenConns(1)
+	return db
+}
+
+var testMigrations = []Migration{
+	{
+		Version: 2,
+		Name:    "add_user_email",
+		Up:      "ALTER TABLE user ADD COLUMN email VARCHAR(255) NOT NULL DEFAULT ''",
+		Down:    "CREATE TABLE user_tmp (id INTEGER PRIMARY KEY, name VARCHAR(64));\nINSERT INTO user_tmp SELECT id, name FROM user;\nDROP TABLE user;\nALTER TABLE user_tmp RENAME TO user;",
+	},
+	{
+		Version: 1,
+		Name:    "create_user",
+		Up:      "CREATE TABLE user (id INTEGER PRIMARY KEY, name VARCHAR(64)); -- ;comment\nINSERT INTO user (name) VALUES ('a;b')",
+		Down:    "DROP TABLE user",
+	},
+	{
+		Version: 3,
+		Name:    "seed_user",
+		UpFunc: func(tx *gorm.DB) error {
+			return tx.Exec("INSERT INTO user (name, email) VALUES (?, ?)", "c", "c@example.com").Error
+		},
+		DownFunc: func(tx *gorm.DB) error {
+			return tx.Exec("DELETE FROM user WHERE name = ?", "c").Error
+		},
+	},
+}
+
+func TestMigratorUpDownStatus(t *testing.T) {
+	db := newMigrateTestDB(t)
+	defer db.Close()
+	ctx := context.Background()
+
+	m, err := NewMigrator(db, testMigrations)
+	if err != nil {
+		t.Fatal(err)
+	}
+	count, err := m.Up(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 3 {
+		t.Fatalf("expected 3 migrations applied, got %d", count)
+	}
+
+	var users int
+	db.Table("user").Where("name IN (?)", []string{"a;b", "c"}).Count(&users)
+	if users != 2 {
+		t.Fatalf("expected 2 users, got %d", users)
+	}
+
+	count, err = m.Up(ctx)
+	if err != nil || count != 0 {
+		t.Fatalf("expected nothing to apply, got %d %v", count, err)
+	}
+
+	count, err = m.Down(ctx, 2)
+	if err != nil || count != 2 {
+		t.Fatalf("expected 2 migrations reverted, got %d %v", count, err)
+	}
+	if db.Dialect().HasColumn("user", "email") {
+		t.Fatal("email column should be dropped")
+	}
+
+	status, err := m.Status(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	applied := []bool{true, false, false}
+	for i, s := range status {
+		if s.Version != int64(i+1) || s.Applied != applied[i] {
+			t.Fatalf("unexpected status %+v", s)
+		}
+	}
+}
+
+func TestMigratorDryRun(t *testing.T) {
+	db := newMigrateTestDB(t)
+	defer db.Close()
+
+	out := new(bytes.Buffer)
+	m, err := NewMigrator(db, testMigrations, MigrateDryRun(out))
+	if err != nil {
+		t.Fatal(err)
+	}
+	count, err := m.Up(context.Background())
+	if err != nil || count != 3 {
+		t.Fatalf("expected 3 migrations printed, got %d %v", count, err)
+	}
+	if db.HasTable("user") || db.HasTable(migrationTable) {
+		t.Fatal("dry run should not change database")
+	}
+	if !strings.Contains(out.String(), "INSERT INTO user (name) VALUES ('a;b');") {
+		t.Fatalf("unexpected dry run output: %s", out.String())
+	}
+	if !strings.Contains(out.String(), "-- go migration 3_seed_user") {
+		t.Fatalf("unexpected dry run output: %s", out.String())
+	}
+}
+
+func TestNewMigratorDuplicateVersion(t *testing.T) {
+	db := newMigrateTestDB(t)
+	defer db.Close()
+
+	_, err := NewMigrator(db, []Migration{{Version: 1, Name: "a"}, {Version: 1, Name: "b"}})
+	if err == nil {
+		t.Fatal("expected duplicate version error")
+	}
+}
+
+func TestNewMigratorInTransaction(t *testing.T) {
+	db := newMigrateTestDB(t)
+	defer db.Close()
+
+	tx := db.Begin()
+	defer tx.Rollback()
+	if _, err := NewMigrator(tx, testMigrations); err == nil {
+		t.Fatal("expected error for a transaction")
+	}
+}
+
+func TestRunMigrations(t *testing.T) {
+	pool := newTestPool(t, "test_migrate")
+	ctx := context.Background()
+
+	count, err := RunMigrations(ctx, newTestHelper(), testSrvName, "test_migrate", testMigrations)
+	if err != nil || count != 3 {
+		t.Fatalf("expected 3 migrations applied, got %d %v", count, err)
+	}
+	if !pool.Dialect().HasColumn("user", "email") {
+		t.Fatal("email column is not added")
+	}
+
+	count, err = RunMigrations(ctx, newTestHelper(), testSrvName, "test_migrate", testMigrations)
+	if err != nil || count != 0 {
+		t.Fatalf("expected nothing to apply, got %d %v", count, err)
+	}
+}
@@ -2,11 +2,18 @@ package connect
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"github.com/lifenglin/micro-library/helper"
 	"github.com/micro/go-micro/v2/config"
 	"github.com/sirupsen/logrus"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readconcern"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+	"go.mongodb.org/mongo-driver/mongo/writeconcern"
+	"go.mongodb.org/mongo-driver/tag"
+	"strconv"
 	"sync"
 	"time"
 )
@@ -17,15 +24,97 @@ type MongoConfig struct {
 	MaxPoolSize     uint64 `json:"max_pool_size"`
 	MaxConnIdleTime string `json:"max_conn_idle_time"`
 	ConnectTimeout  string `json:"connect_timeout"`
+	//超过该耗时的命令记录到慢日志，默认100ms
+	SlowThreshold          string              `json:"slow_threshold"`
+	ServerSelectionTimeout string              `json:"server_selection_timeout"`
+	ReadPreference         mongoReadPrefConfig `json:"read_preference"`
+	//local、majority、available、linearizable、snapshot
+	ReadConcern  string                  `json:"read_concern"`
+	WriteConcern mongoWriteConcernConfig `json:"write_concern"`
+	//不配置时使用驱动的默认值
+	RetryWrites *bool `json:"retry_writes"`
+	RetryReads  *bool `json:"retry_reads"`
+	//snappy、zlib、zstd，按顺序与服务端协商
+	Compressors []string      `json:"compressors"`
+	ZlibLevel   *int          `json:"zlib_level"`
+	TLS         tlsFileConfig `json:"tls"`
 }
 
-var mongoDB sync.Map
+type mongoReadPrefConfig struct {
+	//primary、primaryPreferred、secondary、secondaryPreferred、nearest
+	Mode         string              `json:"mode"`
+	TagSets      []map[string]string `json:"tag_sets"`
+	MaxStaleness string              `json:"max_staleness"`
+}
+
+type mongoWriteConcernConfig struct {
+	//majority或者节点数量
+	W        string `json:"w"`
+	J        *bool  `json:"j"`
+	WTimeout string `json:"wtimeout"`
+}
+
+// ErrInvalidMongoOption mongo配置的值不合法，newClient不会用这样的配置连接
+var ErrInvalidMongoOption = errors.New("invalid mongo option")
+
+var mongoReadConcernLevels = map[string]bool{
+	"local":        true,
+	"majority":     true,
+	"available":    true,
+	"linearizable": true,
+	"snapshot":     true,
+}
+
+var mongoCompressors = map[string]bool{
+	"snappy": true,
+	"zlib":   true,
+	"zstd":   true,
+}
+
+func invalidMongoOption(field string, err interface{}) error {
+	return fmt.Errorf("%w: %s: %v", ErrInvalidMongoOption, field, err)
+}
+
+type mongoClient struct {
+	client  *mongo.Client
+	srvName string
+}
+
+var (
+	mongoDB       sync.Map
+	mongoLock     sync.Mutex
+	mongoWatchers sync.Map
+)
+
+func init() {
+	helper.RegisterReadyCheck("mongo", mongoReadyCheck)
+}
+
+// mongoReadyCheck ping所有已建立的mongo客户端
+func mongoReadyCheck(ctx context.Context) error {
+	var err error
+	mongoDB.Range(func(key, value interface{}) bool {
+		if pingErr := value.(*mongoClient).client.Ping(ctx, nil); pingErr != nil {
+			err = fmt.Errorf("%s: %w", key, pingErr)
+			return false
+		}
+		return true
+	})
+	return err
+}
 
 func MongoDB(ctx context.Context, hlp *helper.Helper, srvName string, name, database string) (*mongo.Database, error) {
 	logger := hlp.Log
 	c, ok := mongoDB.Load(name)
 	if ok {
-		return c.(*mongo.Client).Database(database), nil
+		return c.(*mongoClient).client.Database(database), nil
+	}
+
+	mongoLock.Lock()
+	defer mongoLock.Unlock()
+	c, ok = mongoDB.Load(name)
+	if ok {
+		return c.(*mongoClient).client.Database(database), nil
 	}
 
 	client, err := newClient(ctx, srvName, name, logger)
@@ -33,7 +122,7 @@ func MongoDB(ctx context.Context, hlp *helper.Helper, srvName string, name, data
 		return nil, err
 	}
 
-	mongoDB.Store(name, client)
+	mongoDB.Store(name, &mongoClient{client: client, srvName: srvName})
 	return client.Database(database), nil
 }
 
@@ -72,12 +161,25 @@ func newClient(ctx context.Context, srvName, name string, logger *logrus.Entry)
 		connectTimeout = 1 * time.Second
 	}
 
+	slowThreshold, _ := time.ParseDuration(conf.SlowThreshold)
+	monitor := newMongoMonitor(srvName, name, slowThreshold)
+
 	o := &options.ClientOptions{
 		AppName:         &srvName,
 		MinPoolSize:     &conf.MinPoolSize,
 		MaxPoolSize:     &conf.MaxPoolSize,
 		MaxConnIdleTime: &maxConnIdleTime,
 		ConnectTimeout:  &connectTimeout,
+		Monitor:         monitor.commandMonitor(),
+		PoolMonitor:     monitor.poolMonitor(),
+	}
+	err = applyMongoOptions(o, conf)
+	if err != nil {
+		logger.WithFields(logrus.Fields{
+			"name":  name,
+			"error": err,
+		}).Error("mongo config invalid")
+		return nil, err
 	}
 	client, err := mongo.NewClient(options.Client().ApplyURI(conf.Addr), o)
 	if err != nil {
@@ -89,45 +191,158 @@ func newClient(ctx context.Context, srvName, name string, logger *logrus.Entry)
 		return nil, err
 	}
 
-	go watch(ctx, watcher, name, logger)
+	//同一个服务的mongo配置共用一个watcher，只启动一次
+	if _, loaded := mongoWatchers.LoadOrStore(srvName, true); !loaded && watcher != nil {
+		go watch(watcher, srvName, logger)
+	}
 	return client, nil
 }
 
-func watch(ctx context.Context, watcher config.Watcher, name string, logger *logrus.Entry) {
-	v, err := watcher.Next()
-	if err != nil {
-		logger.WithFields(logrus.Fields{
-			"name:":  name,
-			"error:": err,
-		}).Error("mongo watch error:", err)
-		return
+func applyMongoOptions(o *options.ClientOptions, conf MongoConfig) error {
+	if conf.ServerSelectionTimeout != "" {
+		timeout, err := time.ParseDuration(conf.ServerSelectionTimeout)
+		if err != nil {
+			return invalidMongoOption("server_selection_timeout", err)
+		}
+		o.SetServerSelectionTimeout(timeout)
 	}
 
-	logger.WithFields(logrus.Fields{
-		"name": name,
-		"file": string(v.Bytes()),
-	}).Info("reconnect mongo db")
+	if conf.ReadPreference.Mode != "" {
+		mode, err := readpref.ModeFromString(conf.ReadPreference.Mode)
+		if err != nil {
+			return invalidMongoOption("read_preference.mode", err)
+		}
+		var prefOptions []readpref.Option
+		for _, tagSet := range conf.ReadPreference.TagSets {
+			set := make(tag.Set, 0, len(tagSet))
+			for k, v := range tagSet {
+				set = append(set, tag.Tag{Name: k, Value: v})
+			}
+			prefOptions = append(prefOptions, readpref.WithTagSets(set))
+		}
+		if conf.ReadPreference.MaxStaleness != "" {
+			maxStaleness, err := time.ParseDuration(conf.ReadPreference.MaxStaleness)
+			if err != nil {
+				return invalidMongoOption("read_preference.max_staleness", err)
+			}
+			prefOptions = append(prefOptions, readpref.WithMaxStaleness(maxStaleness))
+		}
+		pref, err := readpref.New(mode, prefOptions...)
+		if err != nil {
+			return invalidMongoOption("read_preference", err)
+		}
+		o.SetReadPreference(pref)
+	}
 
-	c, ok := mongoDB.LoadAndDelete(name)
-	if !ok {
-		logger.WithFields(logrus.Fields{
-			"name":   name,
-			"error:": "not found",
-		}).Error("mongo load and delete")
+	if conf.ReadConcern != "" {
+		if !mongoReadConcernLevels[conf.ReadConcern] {
+			return invalidMongoOption("read_concern", conf.ReadConcern)
+		}
+		o.SetReadConcern(readconcern.New(readconcern.Level(conf.ReadConcern)))
 	}
 
+	wc := conf.WriteConcern
+	if wc.W != "" || wc.J != nil || wc.WTimeout != "" {
+		var concernOptions []writeconcern.Option
+		if wc.W == "majority" {
+			concernOptions = append(concernOptions, writeconcern.WMajority())
+		} else if wc.W != "" {
+			w, err := strconv.Atoi(wc.W)
+			if err != nil || w < 0 {
+				return invalidMongoOption("write_concern.w", wc.W)
+			}
+			concernOptions = append(concernOptions, writeconcern.W(w))
+		}
+		if wc.J != nil {
+			concernOptions = append(concernOptions, writeconcern.J(*wc.J))
+		}
+		if wc.WTimeout != "" {
+			timeout, err := time.ParseDuration(wc.WTimeout)
+			if err != nil {
+				return invalidMongoOption("write_concern.wtimeout", err)
+			}
+			concernOptions = append(concernOptions, writeconcern.WTimeout(timeout))
+		}
+		o.SetWriteConcern(writeconcern.New(concernOptions...))
+	}
+
+	if conf.RetryWrites != nil {
+		o.SetRetryWrites(*conf.RetryWrites)
+	}
+	if conf.RetryReads != nil {
+		o.SetRetryReads(*conf.RetryReads)
+	}
+	if len(conf.Compressors) > 0 {
+		for _, compressor := range conf.Compressors {
+			if !mongoCompressors[compressor] {
+				return invalidMongoOption("compressors", compressor)
+			}
+		}
+		o.SetCompressors(conf.Compressors)
+	}
+	if conf.ZlibLevel != nil {
+		//-1为zlib的默认压缩级别
+		if *conf.ZlibLevel < -1 || *conf.ZlibLevel > 9 {
+			return invalidMongoOption("zlib_level", *conf.ZlibLevel)
+		}
+		o.SetZlibLevel(*conf.ZlibLevel)
+	}
+
+	if conf.TLS.Enable {
+		tlsConfig, err := conf.TLS.tlsConfig()
+		if err != nil {
+			return invalidMongoOption("tls", err)
+		}
+		o.SetTLSConfig(tlsConfig)
+	}
+	return nil
+}
+
+// watch 配置每次变化都关闭该服务下所有的mongo连接，下次调用时按新配置重新连接
+func watch(watcher config.Watcher, srvName string, logger *logrus.Entry) {
+	for {
+		v, err := watcher.Next()
+		if err != nil {
+			logger.WithFields(logrus.Fields{
+				"srvName": srvName,
+				"error:":  err,
+			}).Error("mongo watch error:", err)
+			mongoWatchers.Delete(srvName)
+			return
+		}
+
+		mongoDB.Range(func(key, value interface{}) bool {
+			name := key.(string)
+			if value.(*mongoClient).srvName != srvName {
+				return true
+			}
+			logger.WithFields(logrus.Fields{
+				"name": name,
+				"file": string(v.Bytes()),
+			}).Info("reconnect mongo db")
+
+			c, ok := mongoDB.LoadAndDelete(name)
+			if !ok {
+				return true
+			}
+			go disconnectMongo(c.(*mongoClient).client, name, logger)
+			return true
+		})
+	}
+}
+
+func disconnectMongo(client *mongo.Client, name string, logger *logrus.Entry) {
+	//10秒后，关闭旧的连接
 	time.Sleep(time.Duration(10) * time.Second)
-	err = c.(*mongo.Client).Disconnect(ctx)
+	err := client.Disconnect(context.Background())
 	if err == nil {
 		logger.WithFields(logrus.Fields{
 			"name": name,
-			"file": string(v.Bytes()),
 		}).Info("close db")
 	} else {
 		logger.WithFields(logrus.Fields{
 			"error": err,
 			"name":  name,
-			"file":  string(v.Bytes()),
 		}).Warn("close db error")
 	}
 }
@@ -0,0 +1,221 @@
+package connect
+
+import (
+	"context"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/event"
+	"sync"
+	"time"
+)
+
+const (
+	defaultMongoSlowThreshold = 100 * time.Millisecond
+	//超过这个时间还没有结束事件的命令认为连接已经断开，不再等待
+	mongoStartedMaxAge = 10 * time.Minute
+	mongoSweepInterval = time.Minute
+	//每个地址最多记录的等待中的checkout
+	maxMongoCheckoutWaiters = 10000
+)
+
+var (
+	mongoCommandSeconds  *prometheus.HistogramVec
+	mongoPoolCheckouts   *prometheus.CounterVec
+	mongoPoolInUse       *prometheus.GaugeVec
+	mongoPoolConnections *prometheus.GaugeVec
+	mongoPoolConnCreated *prometheus.CounterVec
+	mongoPoolConnClosed  *prometheus.CounterVec
+	mongoPoolWaitSeconds *prometheus.HistogramVec
+)
+
+func init() {
+	mongoCommandSeconds = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "mongo_command_duration_seconds",
+		Help:    "Duration of mongo commands.",
+		Buckets: prometheus.ExponentialBuckets(0.0005, 2, 16),
+	}, []string{"service_name", "name", "database", "collection", "command", "status"})
+	mongoPoolCheckouts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mongo_pool_checkouts_total",
+		Help: "Number of connection checkouts, failed checkouts are labeled with the reason such as timeout.",
+	}, []string{"service_name", "name", "result", "reason"})
+	mongoPoolInUse = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "mongo_pool_in_use_connections",
+		Help: "Number of connections checked out of the pool.",
+	}, []string{"service_name", "name", "address"})
+	mongoPoolConnections = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "mongo_pool_open_connections",
+		Help: "Number of open connections in the pool.",
+	}, []string{"service_name", "name", "address"})
+	mongoPoolConnCreated = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mongo_pool_connections_created_total",
+		Help: "Number of connections created by the pool.",
+	}, []string{"service_name", "name"})
+	mongoPoolConnClosed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mongo_pool_connections_closed_total",
+		Help: "Number of connections closed by the pool.",
+	}, []string{"service_name", "name", "reason"})
+	mongoPoolWaitSeconds = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "mongo_pool_checkout_wait_seconds",
+		Help:    "Time waiting to check out a connection from the pool.",
+		Buckets: prometheus.ExponentialBuckets(0.0001, 2, 16),
+	}, []string{"service_name", "name", "result"})
+
+	_ = prometheus.Register(mongoCommandSeconds)
+	_ = prometheus.Register(mongoPoolCheckouts)
+	_ = prometheus.Register(mongoPoolInUse)
+	_ = prometheus.Register(mongoPoolConnections)
+	_ = prometheus.Register(mongoPoolConnCreated)
+	_ = prometheus.Register(mongoPoolConnClosed)
+	_ = prometheus.Register(mongoPoolWaitSeconds)
+}
+
+type mongoStartedCommand struct {
+	database   string
+	collection string
+	command    string
+	startedAt  time.Time
+}
+
+type mongoMonitor struct {
+	srvName       string
+	name          string
+	slowThreshold time.Duration
+	//RequestID -> *mongoStartedCommand，命令结束事件中没有库名和集合名
+	started   sync.Map
+	sweepLock sync.Mutex
+	sweptAt   time.Time
+
+	//地址 -> 等待中的checkout开始时间，事件中没有关联id，按先进先出近似匹配
+	waitLock sync.Mutex
+	waiting  map[string][]time.Time
+}
+
+func newMongoMonitor(srvName string, name string, slowThreshold time.Duration) *mongoMonitor {
+	if slowThreshold <= 0 {
+		slowThreshold = defaultMongoSlowThreshold
+	}
+	return &mongoMonitor{
+		srvName:       srvName,
+		name:          name,
+		slowThreshold: slowThreshold,
+		sweptAt:       time.Now(),
+		waiting:       make(map[string][]time.Time),
+	}
+}
+
+func (m *mongoMonitor) commandMonitor() *event.CommandMonitor {
+	return &event.CommandMonitor{
+		Started: func(_ context.Context, evt *event.CommandStartedEvent) {
+			collection, _ := evt.Command.Lookup(evt.CommandName).StringValueOK()
+			m.started.Store(evt.RequestID, &mongoStartedCommand{
+				database:   evt.DatabaseName,
+				collection: collection,
+				command:    evt.CommandName,
+				startedAt:  time.Now(),
+			})
+			m.sweep()
+		},
+		Succeeded: func(_ context.Context, evt *event.CommandSucceededEvent) {
+			m.finished(evt.CommandFinishedEvent, "success", "")
+		},
+		Failed: func(_ context.Context, evt *event.CommandFailedEvent) {
+			m.finished(evt.CommandFinishedEvent, "failed", evt.Failure)
+		},
+	}
+}
+
+// sweep 每分钟清理一次一直没有结束事件的命令，连接断开时驱动可能不会发出结束事件
+func (m *mongoMonitor) sweep() {
+	m.sweepLock.Lock()
+	if time.Since(m.sweptAt) < mongoSweepInterval {
+		m.sweepLock.Unlock()
+		return
+	}
+	m.sweptAt = time.Now()
+	m.sweepLock.Unlock()
+
+	m.started.Range(func(key, value interface{}) bool {
+		if time.Since(value.(*mongoStartedCommand).startedAt) > mongoStartedMaxAge {
+			m.started.Delete(key)
+		}
+		return true
+	})
+}
+
+func (m *mongoMonitor) checkoutStarted(address string) {
+	m.waitLock.Lock()
+	defer m.waitLock.Unlock()
+	waiting := append(m.waiting[address], time.Now())
+	if len(waiting) > maxMongoCheckoutWaiters {
+		waiting = waiting[len(waiting)-maxMongoCheckoutWaiters:]
+	}
+	m.waiting[address] = waiting
+}
+
+func (m *mongoMonitor) checkoutFinished(address string, result string) {
+	m.waitLock.Lock()
+	waiting := m.waiting[address]
+	if len(waiting) == 0 {
+		m.waitLock.Unlock()
+		return
+	}
+	startedAt := waiting[0]
+	if len(waiting) == 1 {
+		delete(m.waiting, address)
+	} else {
+		m.waiting[address] = waiting[1:]
+	}
+	m.waitLock.Unlock()
+	mongoPoolWaitSeconds.WithLabelValues(m.srvName, m.name, result).Observe(time.Since(startedAt).Seconds())
+}
+
+func (m *mongoMonitor) finished(evt event.CommandFinishedEvent, status string, failure string) {
+	value, ok := m.started.Load(evt.RequestID)
+	if !ok {
+		return
+	}
+	m.started.Delete(evt.RequestID)
+	started := value.(*mongoStartedCommand)
+	elapsed := time.Duration(evt.DurationNanos)
+	mongoCommandSeconds.WithLabelValues(m.srvName, m.name, started.database, started.collection, started.command, status).Observe(elapsed.Seconds())
+
+	if elapsed < m.slowThreshold || SlowLog == nil {
+		return
+	}
+	SlowLog.WithFields(logrus.Fields{
+		"srvName":    m.srvName,
+		"name":       m.name,
+		"database":   started.database,
+		"collection": started.collection,
+		"command":    started.command,
+		"status":     status,
+		"failure":    failure,
+		"elapsed":    elapsed.String(),
+	}).Warn("slow mongo command")
+}
+
+func (m *mongoMonitor) poolMonitor() *event.PoolMonitor {
+	return &event.PoolMonitor{
+		Event: func(evt *event.PoolEvent) {
+			switch evt.Type {
+			case event.GetStarted:
+				m.checkoutStarted(evt.Address)
+			case event.GetSucceeded:
+				m.checkoutFinished(evt.Address, "success")
+				mongoPoolCheckouts.WithLabelValues(m.srvName, m.name, "success", "").Inc()
+				mongoPoolInUse.WithLabelValues(m.srvName, m.name, evt.Address).Inc()
+			case event.GetFailed:
+				m.checkoutFinished(evt.Address, "failed")
+				mongoPoolCheckouts.WithLabelValues(m.srvName, m.name, "failed", evt.Reason).Inc()
+			case event.ConnectionReturned:
+				mongoPoolInUse.WithLabelValues(m.srvName, m.name, evt.Address).Dec()
+			case event.ConnectionCreated:
+				mongoPoolConnCreated.WithLabelValues(m.srvName, m.name).Inc()
+				mongoPoolConnections.WithLabelValues(m.srvName, m.name, evt.Address).Inc()
+			case event.ConnectionClosed:
+				mongoPoolConnClosed.WithLabelValues(m.srvName, m.name, evt.Reason).Inc()
+				mongoPoolConnections.WithLabelValues(m.srvName, m.name, evt.Address).Dec()
+			}
+		},
+	}
+}
@@ -0,0 +1,79 @@
+package connect
+
+import (
+	"errors"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+	"testing"
+	"time"
+)
+
+func TestApplyMongoOptions(t *testing.T) {
+	j := true
+	zlibLevel := 6
+	badZlibLevel := 10
+	testData := []struct {
+		name  string
+		conf  MongoConfig
+		valid bool
+	}{
+		{"empty", MongoConfig{}, true},
+		{"all", MongoConfig{
+			ServerSelectionTimeout: "3s",
+			ReadPreference: mongoReadPrefConfig{
+				Mode:         "secondaryPreferred",
+				TagSets:      []map[string]string{{"dc": "sh"}},
+				MaxStaleness: "90s",
+			},
+			ReadConcern:  "majority",
+			WriteConcern: mongoWriteConcernConfig{W: "majority", J: &j, WTimeout: "1s"},
+			Compressors:  []string{"zstd", "zlib"},
+			ZlibLevel:    &zlibLevel,
+		}, true},
+		{"write concern nodes", MongoConfig{WriteConcern: mongoWriteConcernConfig{W: "2"}}, true},
+		{"bad server selection timeout", MongoConfig{ServerSelectionTimeout: "3"}, false},
+		{"unknown read preference mode", MongoConfig{ReadPreference: mongoReadPrefConfig{Mode: "secondaryOnly"}}, false},
+		{"tags on primary", MongoConfig{ReadPreference: mongoReadPrefConfig{Mode: "primary", TagSets: []map[string]string{{"dc": "sh"}}}}, false},
+		{"bad max staleness", MongoConfig{ReadPreference: mongoReadPrefConfig{Mode: "nearest", MaxStaleness: "x"}}, false},
+		{"unknown read concern", MongoConfig{ReadConcern: "strong"}, false},
+		{"bad write concern", MongoConfig{WriteConcern: mongoWriteConcernConfig{W: "all"}}, false},
+		{"negative write concern", MongoConfig{WriteConcern: mongoWriteConcernConfig{W: "-1"}}, false},
+		{"bad write concern timeout", MongoConfig{WriteConcern: mongoWriteConcernConfig{WTimeout: "1"}}, false},
+		{"unknown compressor", MongoConfig{Compressors: []string{"zstd", "gzip"}}, false},
+		{"bad zlib level", MongoConfig{ZlibLevel: &badZlibLevel}, false},
+		{"missing tls file", MongoConfig{TLS: tlsFileConfig{Enable: true, CAFile: "/nonexistent/ca.pem"}}, false},
+	}
+	for _, d := range testData {
+		err := applyMongoOptions(options.Client(), d.conf)
+		if d.valid && err != nil {
+			t.Errorf("%s: unexpected error %v", d.name, err)
+		}
+		if !d.valid && !errors.Is(err, ErrInvalidMongoOption) {
+			t.Errorf("%s: error = %v, want ErrInvalidMongoOption", d.name, err)
+		}
+	}
+}
+
+func TestApplyMongoOptionsValues(t *testing.T) {
+	o := options.Client()
+	err := applyMongoOptions(o, MongoConfig{
+		ServerSelectionTimeout: "3s",
+		ReadPreference:         mongoReadPrefConfig{Mode: "nearest", MaxStaleness: "90s"},
+		Compressors:            []string{"snappy"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if o.ServerSelectionTimeout == nil || *o.ServerSelectionTimeout != 3*time.Second {
+		t.Errorf("server selection timeout = %v", o.ServerSelectionTimeout)
+	}
+	if o.ReadPreference == nil || o.ReadPreference.Mode() != readpref.NearestMode {
+		t.Errorf("read preference = %v", o.ReadPreference)
+	}
+	if maxStaleness, ok := o.ReadPreference.MaxStaleness(); !ok || maxStaleness != 90*time.Second {
+		t.Errorf("max staleness = %v", maxStaleness)
+	}
+	if len(o.Compressors) != 1 || o.Compressors[0] != "snappy" {
+		t.Errorf("compressors = %v", o.Compressors)
+	}
+}
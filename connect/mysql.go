@@ -7,9 +7,11 @@ import (
 	"github.com/jinzhu/gorm"
 	_ "github.com/jinzhu/gorm/dialects/mysql"
 	"github.com/lifenglin/micro-library/helper"
+	"github.com/micro/go-micro/v2/config"
 	"github.com/sirupsen/logrus"
 	mysql2 "gorm.io/driver/mysql"
 	gorm2 "gorm.io/gorm"
+	"gorm.io/gorm/schema"
 	"gorm.io/plugin/prometheus"
 	"path/filepath"
 	"sync"
@@ -20,19 +22,47 @@ var dbs *Dbs
 
 type Dbs struct {
 	sync.RWMutex
-	Map map[string]*gorm.DB
+	Map   map[string]*gorm.DB
+	MapV2 map[string]*gorm2.DB
+	Meta  map[string]*sqlMeta
 }
 
 func init() {
 	dbs = new(Dbs)
 	dbs.Map = make(map[string]*gorm.DB)
+	dbs.MapV2 = make(map[string]*gorm2.DB)
+	dbs.Meta = make(map[string]*sqlMeta)
+	helper.RegisterReadyCheck("mysql", mysqlReadyCheck)
+}
+
+// mysqlReadyCheck ping所有已建立的mysql连接池
+func mysqlReadyCheck(ctx context.Context) error {
+	dbs.RLock()
+	pools := make(map[string]*sql.DB, len(dbs.Map))
+	for name, db := range dbs.Map {
+		pools[name] = db.DB()
+	}
+	dbs.RUnlock()
+
+	for name, pool := range pools {
+		if err := pool.PingContext(ctx); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	return nil
 }
 
 type mysqlClusterConfig struct {
-	ConnMaxLifetime int    `json:"conn_max_lifetime"`
-	Dsn             string `json:"dsn"`
-	MaxIdleConns    int    `json:"max_idle_conns"`
-	MaxOpenConns    int    `json:"max_open_conns"`
+	//默认为mysql，本地和测试环境可以配置为sqlite3，使用sqlite中的配置
+	Driver          string       `json:"driver"`
+	Sqlite          sqliteConfig `json:"sqlite"`
+	ConnMaxLifetime int          `json:"conn_max_lifetime"`
+	Dsn             string       `json:"dsn"`
+	MaxIdleConns    int          `json:"max_idle_conns"`
+	MaxOpenConns    int          `json:"max_open_conns"`
+	SlowThreshold   string       `json:"slow_threshold"`
+	//单条sql的默认超时时间，可以用WithStatementTimeout按请求覆盖
+	StatementTimeout string `json:"statement_timeout"`
 }
 
 func MysqlInit(srvName string) {
@@ -64,6 +94,9 @@ func MysqlInit(srvName string) {
 	}
 
 	for k, _ := range config {
+		if k == shardingConfigKey {
+			continue
+		}
 		db, err := ConnectDB(context.Background(), hlp, srvName, k, "master")
 		if err != nil {
 			hlp.MysqlLog.WithFields(logrus.Fields{
@@ -98,21 +131,103 @@ func MysqlInit(srvName string) {
 	}
 }
 
+// ConnectDB 返回的连接绑定了ctx，ctx结束后不会再发出新的sql。
+// master和slave返回连接池本身的句柄，可以调用DB()；集群配置的statement_timeout在驱动层生效，超时的sql会被中断。
+// gorm v1的sql不带ctx，请求ctx的超时和WithStatementTimeout只在ClusterAuto和ConnectDBv2中能中断已经发出的sql，
+// ClusterAuto返回的连接不能调用DB()。
 func ConnectDB(ctx context.Context, hlp *helper.Helper, srvName string, name string, cluster string) (*gorm.DB, error) {
 	timer := hlp.Timer
 	timer.Start("connectDB")
 	defer timer.End("connectDB")
 
+	//在WithTx中调用时，加入ctx中已有的事务
+	if tx, ok := TxFromContext(ctx, name); ok {
+		return tx, nil
+	}
+	if cluster == ClusterAuto {
+		sqlite, err := isSqliteCluster(hlp, srvName, name)
+		if err != nil {
+			return nil, err
+		}
+		if !sqlite {
+			return connectResolverDB(ctx, hlp, srvName, name)
+		}
+		//sqlite的master和slave是同一个库，不需要读写分离
+		cluster = ClusterMaster
+	}
+
+	mysqlLog := hlp.MysqlLog
+	db, _, err := connectMysql(hlp, srvName, name, cluster)
+	if err != nil {
+		return nil, err
+	}
+	newDb := db.New().Set(sqlMetaKey, getSqlMeta(name, cluster)).Set(sqlContextKey, ctx)
+	newDb.SetLogger(mysqlLog)
+	if detailed, err := mysqlDetailedLog(srvName, mysqlLog); err == nil {
+		newDb.LogMode(detailed)
+	}
+	return newDb, nil
+}
+
+// ConnectDBv2 返回gorm v2的连接，与ConnectDB共用同一个连接池、配置和热更新
+func ConnectDBv2(ctx context.Context, hlp *helper.Helper, srvName string, name string, cluster string) (*gorm2.DB, error) {
+	timer := hlp.Timer
+	timer.Start("connectDBv2")
+	defer timer.End("connectDBv2")
+
+	if cluster == ClusterAuto {
+		sqlite, err := isSqliteCluster(hlp, srvName, name)
+		if err != nil {
+			return nil, err
+		}
+		if sqlite {
+			return nil, fmt.Errorf("%s.%s: %w", name, cluster, ErrSqliteGormV2)
+		}
+		return connectResolverDBv2(ctx, hlp, srvName, name)
+	}
+
+	mysqlLog := hlp.MysqlLog
+	_, db, err := connectMysql(hlp, srvName, name, cluster)
+	if err != nil {
+		return nil, err
+	}
+	if db == nil {
+		//sqlite只打开了gorm v1的连接
+		return nil, fmt.Errorf("%s.%s: %w", name, cluster, ErrSqliteGormV2)
+	}
+	detailed, _ := mysqlDetailedLog(srvName, mysqlLog)
+	return db.Session(&gorm2.Session{
+		NewDB:   true,
+		Context: ctx,
+		Logger:  newGormLogger(mysqlLog, detailed),
+	}), nil
+}
+
+func mysqlDetailedLog(srvName string, mysqlLog *logrus.Entry) (bool, error) {
+	conf, _, err := ConnectConfig(srvName, "log")
+	if err != nil {
+		//配置获取失败
+		mysqlLog.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Error("read log config fail")
+		return false, err
+	}
+	return conf.Get(srvName, "log", "mysql_detailed_log").Bool(false), nil
+}
+
+func connectMysql(hlp *helper.Helper, srvName string, name string, cluster string) (*gorm.DB, *gorm2.DB, error) {
 	dbsKey := name + "." + cluster
 	mysqlLog := hlp.MysqlLog
 	dbs.RLock()
 	db, ok := dbs.Map[dbsKey]
+	db2 := dbs.MapV2[dbsKey]
 	dbs.RUnlock()
 	if !ok {
 		dbs.Lock()
 		existDb, ok := dbs.Map[dbsKey]
 		if ok {
 			db = existDb
+			db2 = dbs.MapV2[dbsKey]
 		} else {
 			conf, watcher, err := newConfig(filepath.Join(srvName, "database"))
 			if err != nil {
@@ -120,7 +235,7 @@ func ConnectDB(ctx context.Context, hlp *helper.Helper, srvName string, name str
 					"error": err.Error(),
 				}).Error("read database config fail")
 				dbs.Unlock()
-				return nil, fmt.Errorf("read database config fail: %w", err)
+				return nil, nil, fmt.Errorf("read database config fail: %w", err)
 			}
 			var clusterConfig mysqlClusterConfig
 			conf.Get(srvName, "database", name, cluster).Scan(&clusterConfig)
@@ -131,14 +246,39 @@ func ConnectDB(ctx context.Context, hlp *helper.Helper, srvName string, name str
 				"dsn":     clusterConfig.Dsn,
 			}).Info("connect mysql info")
 
-			db, err = gorm.Open("mysql", clusterConfig.Dsn)
+			if clusterConfig.Driver == "sqlite3" {
+				//master和slave使用同一个sqlite库
+				db, err = openSqlite(name, clusterConfig.Sqlite)
+				if err != nil {
+					mysqlLog.WithFields(logrus.Fields{
+						"name":  name,
+						"error": err.Error(),
+					}).Error("connect sqlite fail")
+					dbs.Unlock()
+					return nil, nil, fmt.Errorf("connect sqlite fail: %w", err)
+				}
+				dbs.Map[dbsKey] = db
+				dbs.Meta[dbsKey] = newSqlMeta(srvName, name, cluster, clusterConfig)
+				dbs.Unlock()
+				go closeDBOnUpdate(hlp, watcher, name, cluster)
+				return db, nil, nil
+			}
+
+			meta := newSqlMeta(srvName, name, cluster, clusterConfig)
+			sqlDB, err := openMysql(meta, clusterConfig.Dsn)
+			if err == nil {
+				db, err = gorm.Open("mysql", sqlDB)
+				if err != nil {
+					_ = sqlDB.Close()
+				}
+			}
 			if err != nil {
 				mysqlLog.WithFields(logrus.Fields{
 					"dsn":   clusterConfig.Dsn,
 					"error": err.Error(),
 				}).Error("connect mysql fail")
 				dbs.Unlock()
-				return nil, fmt.Errorf("connect mysql fail: %w", err)
+				return nil, nil, fmt.Errorf("connect mysql fail: %w", err)
 			}
 			//设置连接池
 			db.DB().SetMaxIdleConns(clusterConfig.MaxIdleConns)
@@ -146,79 +286,87 @@ func ConnectDB(ctx context.Context, hlp *helper.Helper, srvName string, name str
 			db.DB().SetConnMaxLifetime(time.Duration(clusterConfig.ConnMaxLifetime) * time.Second)
 			db.SingularTable(true)
 			db.BlockGlobalUpdate(false)
-			dbs.Map[dbsKey] = db
 
-			db2, err := gorm2.Open(mysql2.Open(clusterConfig.Dsn), &gorm2.Config{})
-			if err == nil {
-				db2.ConnPool = db.DB()
-				db2.Use(prometheus.New(prometheus.Config{
-					DBName: srvName,
-					MetricsCollector: []prometheus.MetricsCollector{
-						&prometheus.MySQL{VariableNames: []string{"Threads_running"}},
-					},
-				}))
+			//gorm v2 复用v1的连接池
+			db2, err = gorm2.Open(mysql2.New(mysql2.Config{Conn: db.DB()}), &gorm2.Config{
+				NamingStrategy:    schema.NamingStrategy{SingularTable: true},
+				AllowGlobalUpdate: true,
+				Logger:            newGormLogger(mysqlLog, false),
+			})
+			if err != nil {
+				mysqlLog.WithFields(logrus.Fields{
+					"dsn":   clusterConfig.Dsn,
+					"error": err.Error(),
+				}).Error("connect mysql v2 fail")
+				_ = db.Close()
+				dbs.Unlock()
+				return nil, nil, fmt.Errorf("connect mysql v2 fail: %w", err)
 			}
+			_ = db2.Use(prometheus.New(prometheus.Config{
+				DBName: srvName,
+				MetricsCollector: []prometheus.MetricsCollector{
+					&prometheus.MySQL{VariableNames: []string{"Threads_running"}},
+				},
+			}))
+			dbs.Map[dbsKey] = db
+			dbs.MapV2[dbsKey] = db2
+			dbs.Meta[dbsKey] = meta
+			registerSqlCallbacksV2(db2, name, cluster)
 
-			go func() {
-				v, err := watcher.Next()
-				if err != nil {
-					mysqlLog.WithFields(logrus.Fields{
-						"error":   err,
-						"name":    name,
-						"cluster": cluster,
-						"file":    string(v.Bytes()),
-					}).Warn("reconect db")
-				} else {
-					mysqlLog.WithFields(logrus.Fields{
-						"name":    name,
-						"cluster": cluster,
-						"file":    string(v.Bytes()),
-					}).Info("reconnect db")
-
-					//配置更新了，释放所有已有的dbs对象，关闭连接
-					dbs.RLock()
-					db, ok := dbs.Map[dbsKey]
-					dbs.RUnlock()
-					if !ok {
-						return
-					}
-
-					dbs.Lock()
-					delete(dbs.Map, dbsKey)
-					dbs.Unlock()
-					//10秒后，关闭旧的数据库连接
-					time.Sleep(time.Duration(10) * time.Second)
-					err = db.Close()
-					if err == nil {
-						mysqlLog.WithFields(logrus.Fields{
-							"name":    name,
-							"cluster": cluster,
-							"file":    string(v.Bytes()),
-						}).Info("close db")
-					} else {
-						mysqlLog.WithFields(logrus.Fields{
-							"error":   err,
-							"name":    name,
-							"cluster": cluster,
-							"file":    string(v.Bytes()),
-						}).Warn("close db error")
-					}
-				}
-				return
-			}()
+			go closeDBOnUpdate(hlp, watcher, name, cluster)
 		}
 		dbs.Unlock()
 	}
-	newDb := db.New()
-	newDb.SetLogger(mysqlLog)
-	conf, _, err := ConnectConfig(srvName, "log")
+	return db, db2, nil
+}
+
+func closeDBOnUpdate(hlp *helper.Helper, watcher config.Watcher, name string, cluster string) {
+	dbsKey := name + "." + cluster
+	mysqlLog := hlp.MysqlLog
+	v, err := watcher.Next()
 	if err != nil {
-		//配置获取失败
 		mysqlLog.WithFields(logrus.Fields{
-			"error": err.Error(),
-		}).Error("read log config fail")
+			"error":   err,
+			"name":    name,
+			"cluster": cluster,
+			"file":    string(v.Bytes()),
+		}).Warn("reconect db")
+		return
+	}
+	mysqlLog.WithFields(logrus.Fields{
+		"name":    name,
+		"cluster": cluster,
+		"file":    string(v.Bytes()),
+	}).Info("reconnect db")
+
+	//配置更新了，释放所有已有的dbs对象，关闭连接
+	dbs.RLock()
+	db, ok := dbs.Map[dbsKey]
+	dbs.RUnlock()
+	if !ok {
+		return
+	}
+
+	dbs.Lock()
+	delete(dbs.Map, dbsKey)
+	delete(dbs.MapV2, dbsKey)
+	delete(dbs.Meta, dbsKey)
+	dbs.Unlock()
+	//10秒后，关闭旧的数据库连接
+	time.Sleep(time.Duration(10) * time.Second)
+	err = db.Close()
+	if err == nil {
+		mysqlLog.WithFields(logrus.Fields{
+			"name":    name,
+			"cluster": cluster,
+			"file":    string(v.Bytes()),
+		}).Info("close db")
 	} else {
-		newDb.LogMode(conf.Get(srvName, "log", "mysql_detailed_log").Bool(false))
+		mysqlLog.WithFields(logrus.Fields{
+			"error":   err,
+			"name":    name,
+			"cluster": cluster,
+			"file":    string(v.Bytes()),
+		}).Warn("close db error")
 	}
-	return newDb, nil
 }
@@ -0,0 +1,481 @@
+package connect
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"github.com/jinzhu/gorm"
+	"github.com/lifenglin/micro-library/helper"
+	"github.com/sirupsen/logrus"
+	mysql2 "gorm.io/driver/mysql"
+	gorm2 "gorm.io/gorm"
+	"gorm.io/gorm/schema"
+	"math/rand"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	ClusterMaster = "master"
+	ClusterSlave  = "slave"
+	//读写自动分离，读走健康的从库，写和事务走主库
+	ClusterAuto = "auto"
+)
+
+var resolvers *Resolvers
+
+type Resolvers struct {
+	sync.RWMutex
+	Map map[string]*dbResolver
+}
+
+func init() {
+	resolvers = new(Resolvers)
+	resolvers.Map = make(map[string]*dbResolver)
+}
+
+type mysqlReplicaConfig struct {
+	mysqlClusterConfig
+	Weight int `json:"weight"`
+}
+
+type mysqlResolverConfig struct {
+	Replicas            []mysqlReplicaConfig `json:"replicas"`
+	ReadYourWrites      string               `json:"read_your_writes"`
+	HealthCheckInterval string               `json:"health_check_interval"`
+	MaxPingFailures     int                  `json:"max_ping_failures"`
+}
+
+type dbReplica struct {
+	db       *sql.DB
+	weight   int
+	failures int32
+	healthy  int32
+}
+
+func (r *dbReplica) isHealthy() bool {
+	return atomic.LoadInt32(&r.healthy) == 1
+}
+
+type dbResolver struct {
+	hlp         *helper.Helper
+	srvName     string
+	name        string
+	replicas    []*dbReplica
+	rywWindow   time.Duration
+	maxFailures int32
+	db2         *gorm2.DB
+	lastMaster  atomic.Value
+	stop        chan struct{}
+}
+
+type readYourWritesKey struct{}
+
+type readYourWrites struct {
+	lastWrite int64
+}
+
+// WithReadYourWrites 标记请求，写入之后的read_your_writes时间内，该请求的读也走主库
+func WithReadYourWrites(ctx context.Context) context.Context {
+	if _, ok := ctx.Value(readYourWritesKey{}).(*readYourWrites); ok {
+		return ctx
+	}
+	return context.WithValue(ctx, readYourWritesKey{}, new(readYourWrites))
+}
+
+func connectResolverDB(ctx context.Context, hlp *helper.Helper, srvName string, name string) (*gorm.DB, error) {
+	resolver, err := getResolver(hlp, srvName, name)
+	if err != nil {
+		return nil, err
+	}
+
+	mysqlLog := hlp.MysqlLog
+	//记录每条sql实际发到的集群，用于指标的cluster标签
+	ctx = withSqlTarget(ctx)
+	//每个请求绑定自己的ctx，gorm v1的SQLCommon不传递ctx
+	db, err := gorm.Open("mysql", &resolverConn{resolver: resolver, ctx: ctx})
+	if err != nil {
+		mysqlLog.WithFields(logrus.Fields{
+			"name":  name,
+			"error": err.Error(),
+		}).Error("open resolver db fail")
+		return nil, fmt.Errorf("open resolver db fail: %w", err)
+	}
+	db.SingularTable(true)
+	db.BlockGlobalUpdate(false)
+	db = db.Set(sqlMetaKey, getSqlMeta(name, ClusterMaster)).Set(sqlContextKey, ctx)
+	db.SetLogger(mysqlLog)
+	if detailed, err := mysqlDetailedLog(srvName, mysqlLog); err == nil {
+		db.LogMode(detailed)
+	}
+	return db, nil
+}
+
+func connectResolverDBv2(ctx context.Context, hlp *helper.Helper, srvName string, name string) (*gorm2.DB, error) {
+	resolver, err := getResolver(hlp, srvName, name)
+	if err != nil {
+		return nil, err
+	}
+
+	mysqlLog := hlp.MysqlLog
+	detailed, _ := mysqlDetailedLog(srvName, mysqlLog)
+	return resolver.db2.Session(&gorm2.Session{
+		NewDB:   true,
+		Context: ctx,
+		Logger:  newGormLogger(mysqlLog, detailed),
+	}), nil
+}
+
+func getResolver(hlp *helper.Helper, srvName string, name string) (*dbResolver, error) {
+	mysqlLog := hlp.MysqlLog
+	resolvers.RLock()
+	resolver, ok := resolvers.Map[name]
+	resolvers.RUnlock()
+	if ok {
+		return resolver, nil
+	}
+
+	resolvers.Lock()
+	defer resolvers.Unlock()
+	if resolver, ok := resolvers.Map[name]; ok {
+		return resolver, nil
+	}
+
+	conf, watcher, err := newConfig(filepath.Join(srvName, "database"))
+	if err != nil {
+		mysqlLog.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Error("read database config fail")
+		return nil, fmt.Errorf("read database config fail: %w", err)
+	}
+	var resolverConfig mysqlResolverConfig
+	conf.Get(srvName, "database", name).Scan(&resolverConfig)
+	if len(resolverConfig.Replicas) == 0 {
+		//没有配置replicas时，沿用slave作为唯一的从库
+		var slaveConfig mysqlClusterConfig
+		conf.Get(srvName, "database", name, ClusterSlave).Scan(&slaveConfig)
+		if slaveConfig.Dsn != "" {
+			resolverConfig.Replicas = append(resolverConfig.Replicas, mysqlReplicaConfig{
+				mysqlClusterConfig: slaveConfig,
+				Weight:             1,
+			})
+		}
+	}
+
+	resolver = &dbResolver{
+		//hlp只用于日志，不能持有请求级别的Timer
+		hlp:         &helper.Helper{Timer: new(helper.Timer), MysqlLog: mysqlLog},
+		srvName:     srvName,
+		name:        name,
+		maxFailures: int32(resolverConfig.MaxPingFailures),
+		stop:        make(chan struct{}),
+	}
+	if resolver.maxFailures <= 0 {
+		resolver.maxFailures = 3
+	}
+	resolver.rywWindow, err = time.ParseDuration(resolverConfig.ReadYourWrites)
+	if err != nil {
+		resolver.rywWindow = 2 * time.Second
+	}
+	interval, err := time.ParseDuration(resolverConfig.HealthCheckInterval)
+	if err != nil || interval <= 0 {
+		interval = 5 * time.Second
+	}
+
+	if _, err := resolver.master(); err != nil {
+		return nil, err
+	}
+
+	for _, replicaConfig := range resolverConfig.Replicas {
+		mysqlLog.WithFields(logrus.Fields{
+			"srvName": srvName,
+			"name":    name,
+			"dsn":     replicaConfig.Dsn,
+			"weight":  replicaConfig.Weight,
+		}).Info("connect mysql replica info")
+		db, err := openMysql(newSqlMeta(srvName, name, ClusterSlave, replicaConfig.mysqlClusterConfig), replicaConfig.Dsn)
+		if err != nil {
+			mysqlLog.WithFields(logrus.Fields{
+				"dsn":   replicaConfig.Dsn,
+				"error": err.Error(),
+			}).Error("connect mysql replica fail")
+			resolver.close()
+			return nil, fmt.Errorf("connect mysql replica fail: %w", err)
+		}
+		//设置连接池
+		db.SetMaxIdleConns(replicaConfig.MaxIdleConns)
+		db.SetMaxOpenConns(replicaConfig.MaxOpenConns)
+		db.SetConnMaxLifetime(time.Duration(replicaConfig.ConnMaxLifetime) * time.Second)
+		weight := replicaConfig.Weight
+		if weight <= 0 {
+			weight = 1
+		}
+		resolver.replicas = append(resolver.replicas, &dbReplica{db: db, weight: weight, healthy: 1})
+	}
+
+	resolver.db2, err = gorm2.Open(mysql2.New(mysql2.Config{Conn: resolver, SkipInitializeWithVersion: true}), &gorm2.Config{
+		NamingStrategy:    schema.NamingStrategy{SingularTable: true},
+		AllowGlobalUpdate: true,
+		Logger:            newGormLogger(mysqlLog, false),
+	})
+	if err != nil {
+		mysqlLog.WithFields(logrus.Fields{
+			"name":  name,
+			"error": err.Error(),
+		}).Error("open resolver db v2 fail")
+		resolver.close()
+		return nil, fmt.Errorf("open resolver db v2 fail: %w", err)
+	}
+
+	registerSqlCallbacksV2(resolver.db2, name, ClusterMaster)
+
+	go resolver.healthCheck(interval)
+	resolvers.Map[name] = resolver
+
+	go func() {
+		v, err := watcher.Next()
+		if err != nil {
+			mysqlLog.WithFields(logrus.Fields{
+				"error": err,
+				"name":  name,
+				"file":  string(v.Bytes()),
+			}).Warn("reconnect resolver")
+			return
+		}
+		mysqlLog.WithFields(logrus.Fields{
+			"name": name,
+			"file": string(v.Bytes()),
+		}).Info("reconnect resolver")
+
+		//配置更新了，释放旧的resolver，10秒后关闭从库连接
+		resolvers.Lock()
+		delete(resolvers.Map, name)
+		resolvers.Unlock()
+		close(resolver.stop)
+		time.Sleep(time.Duration(10) * time.Second)
+		resolver.close()
+	}()
+
+	return resolver, nil
+}
+
+func (r *dbResolver) close() {
+	for _, replica := range r.replicas {
+		err := replica.db.Close()
+		if err != nil {
+			r.hlp.MysqlLog.WithFields(logrus.Fields{
+				"error": err,
+				"name":  r.name,
+			}).Warn("close replica error")
+		}
+	}
+}
+
+func (r *dbResolver) healthCheck(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.stop:
+			return
+		case <-ticker.C:
+		}
+		r.checkReplicas()
+	}
+}
+
+// checkReplicas ping所有从库，连续失败maxFailures次的从库被摘除，ping成功后恢复
+func (r *dbResolver) checkReplicas() {
+	for index, replica := range r.replicas {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		err := replica.db.PingContext(ctx)
+		cancel()
+		if err == nil {
+			atomic.StoreInt32(&replica.failures, 0)
+			if atomic.CompareAndSwapInt32(&replica.healthy, 0, 1) {
+				r.hlp.MysqlLog.WithFields(logrus.Fields{
+					"name":  r.name,
+					"index": index,
+				}).Info("replica recovered")
+			}
+			continue
+		}
+
+		failures := atomic.AddInt32(&replica.failures, 1)
+		if failures >= r.maxFailures && atomic.CompareAndSwapInt32(&replica.healthy, 1, 0) {
+			r.hlp.MysqlLog.WithFields(logrus.Fields{
+				"name":     r.name,
+				"index":    index,
+				"failures": failures,
+				"error":    err.Error(),
+			}).Warn("replica ejected")
+		}
+	}
+}
+
+func (r *dbResolver) master() (*sql.DB, error) {
+	db, _, err := connectMysql(r.hlp, r.srvName, r.name, ClusterMaster)
+	if err != nil {
+		return nil, err
+	}
+	r.lastMaster.Store(db.DB())
+	return db.DB(), nil
+}
+
+// replica 按权重选一个健康的从库，没有健康的从库时返回主库，同时返回实际使用的集群
+func (r *dbResolver) replica(ctx context.Context) (*sql.DB, string, error) {
+	if r.pinned(ctx) {
+		db, err := r.master()
+		return db, ClusterMaster, err
+	}
+
+	total := 0
+	for _, replica := range r.replicas {
+		if replica.isHealthy() {
+			total += replica.weight
+		}
+	}
+	if total == 0 {
+		db, err := r.master()
+		return db, ClusterMaster, err
+	}
+
+	n := rand.Intn(total)
+	for _, replica := range r.replicas {
+		if !replica.isHealthy() {
+			continue
+		}
+		if n < replica.weight {
+			return replica.db, ClusterSlave, nil
+		}
+		n -= replica.weight
+	}
+	db, err := r.master()
+	return db, ClusterMaster, err
+}
+
+func (r *dbResolver) pinned(ctx context.Context) bool {
+	ryw, ok := ctx.Value(readYourWritesKey{}).(*readYourWrites)
+	if !ok {
+		return false
+	}
+	lastWrite := atomic.LoadInt64(&ryw.lastWrite)
+	return lastWrite != 0 && time.Since(time.Unix(0, lastWrite)) < r.rywWindow
+}
+
+func (r *dbResolver) markWrite(ctx context.Context) {
+	if ryw, ok := ctx.Value(readYourWritesKey{}).(*readYourWrites); ok {
+		atomic.StoreInt64(&ryw.lastWrite, time.Now().UnixNano())
+	}
+}
+
+var (
+	sqlLeadingComment = regexp.MustCompile(`^(\s+|/\*(?s:.*?)\*/|(--|#)[^\n]*(\n|$))+`)
+	sqlLockingRead    = regexp.MustCompile(`(?i)\bfor\s+(update|share)\b|\block\s+in\s+share\s+mode\b`)
+)
+
+// isReadQuery 跳过开头的注释和空白，只有不加锁的SELECT走从库
+func isReadQuery(query string) bool {
+	query = sqlLeadingComment.ReplaceAllString(query, "")
+	if len(query) < 6 || !strings.EqualFold(query[:6], "select") {
+		return false
+	}
+	return !sqlLockingRead.MatchString(query)
+}
+
+func (r *dbResolver) PrepareContext(ctx context.Context, query string) (*sql.Stmt, error) {
+	db, err := r.master()
+	if err != nil {
+		return nil, err
+	}
+	return db.PrepareContext(ctx, query)
+}
+
+func (r *dbResolver) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	db, err := r.master()
+	if err != nil {
+		return nil, err
+	}
+	r.markWrite(ctx)
+	setSqlTarget(ctx, ClusterMaster)
+	return db.ExecContext(ctx, query, args...)
+}
+
+func (r *dbResolver) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	var db *sql.DB
+	var err error
+	cluster := ClusterMaster
+	if isReadQuery(query) {
+		db, cluster, err = r.replica(ctx)
+	} else {
+		r.markWrite(ctx)
+		db, err = r.master()
+	}
+	if err != nil {
+		return nil, err
+	}
+	setSqlTarget(ctx, cluster)
+	return db.QueryContext(ctx, query, args...)
+}
+
+func (r *dbResolver) QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row {
+	var db *sql.DB
+	var err error
+	cluster := ClusterMaster
+	if isReadQuery(query) {
+		db, cluster, err = r.replica(ctx)
+	} else {
+		r.markWrite(ctx)
+		db, err = r.master()
+	}
+	if err != nil {
+		//sql.Row无法携带自定义错误，退回到上一次可用的主库
+		db = r.lastMaster.Load().(*sql.DB)
+		cluster = ClusterMaster
+	}
+	setSqlTarget(ctx, cluster)
+	return db.QueryRowContext(ctx, query, args...)
+}
+
+func (r *dbResolver) BeginTx(ctx context.Context, opts *sql.TxOptions) (*sql.Tx, error) {
+	db, err := r.master()
+	if err != nil {
+		return nil, err
+	}
+	r.markWrite(ctx)
+	return db.BeginTx(ctx, opts)
+}
+
+// resolverConn 把ctx绑定到gorm v1使用的SQLCommon上，超时由驱动层按ctx设置
+type resolverConn struct {
+	resolver *dbResolver
+	ctx      context.Context
+}
+
+func (c *resolverConn) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return c.resolver.ExecContext(c.ctx, query, args...)
+}
+
+func (c *resolverConn) Prepare(query string) (*sql.Stmt, error) {
+	return c.resolver.PrepareContext(c.ctx, query)
+}
+
+func (c *resolverConn) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	return c.resolver.QueryContext(c.ctx, query, args...)
+}
+
+func (c *resolverConn) QueryRow(query string, args ...interface{}) *sql.Row {
+	return c.resolver.QueryRowContext(c.ctx, query, args...)
+}
+
+func (c *resolverConn) Begin() (*sql.Tx, error) {
+	return c.resolver.BeginTx(c.ctx, nil)
+}
+
+func (c *resolverConn) BeginTx(ctx context.Context, opts *sql.TxOptions) (*sql.Tx, error) {
+	return c.resolver.BeginTx(ctx, opts)
+}
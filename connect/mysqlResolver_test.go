@@ -0,0 +1,200 @@
+package connect
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// pingConnector down为1时ping失败
+type pingConnector struct {
+	down int32
+}
+
+func (c *pingConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	return &pingDriverConn{connector: c}, nil
+}
+
+func (c *pingConnector) Driver() driver.Driver {
+	return nil
+}
+
+type pingDriverConn struct {
+	stubDriverConn
+	connector *pingConnector
+}
+
+func (c *pingDriverConn) Ping(ctx context.Context) error {
+	if atomic.LoadInt32(&c.connector.down) == 1 {
+		return errors.New("replica is down")
+	}
+	return nil
+}
+
+func newTestReplica(t *testing.T, weight int) (*dbReplica, *pingConnector) {
+	connector := new(pingConnector)
+	db := sql.OpenDB(connector)
+	t.Cleanup(func() {
+		db.Close()
+	})
+	return &dbReplica{db: db, weight: weight, healthy: 1}, connector
+}
+
+func newTestResolver(t *testing.T, name string, replicas ...*dbReplica) *dbResolver {
+	newTestPool(t, name)
+	return &dbResolver{
+		hlp:         newTestHelper(),
+		srvName:     testSrvName,
+		name:        name,
+		replicas:    replicas,
+		rywWindow:   time.Minute,
+		maxFailures: 3,
+	}
+}
+
+func TestIsReadQuery(t *testing.T) {
+	testData := []struct {
+		query string
+		read  bool
+	}{
+		{"SELECT * FROM user", true},
+		{"  \n\tselect id from user", true},
+		{"/* trace_id=1 */ SELECT * FROM user", true},
+		{"/* multi\nline */\n-- comment\n# comment\nSELECT 1", true},
+		{"SELECT * FROM user WHERE id = 1 FOR UPDATE", false},
+		{"select * from user where id = 1 for update nowait", false},
+		{"SELECT * FROM user FOR SHARE", false},
+		{"SELECT * FROM user LOCK IN SHARE MODE;", false},
+		{"INSERT INTO user SELECT * FROM user_tmp", false},
+		{"UPDATE user SET name = 'select'", false},
+		{"/* SELECT */ DELETE FROM user", false},
+		{"-- SELECT", false},
+		{"", false},
+	}
+	for _, d := range testData {
+		if read := isReadQuery(d.query); read != d.read {
+			t.Errorf("isReadQuery(%q) = %v, want %v", d.query, read, d.read)
+		}
+	}
+}
+
+func TestResolverWeightedReplica(t *testing.T) {
+	light, _ := newTestReplica(t, 1)
+	heavy, _ := newTestReplica(t, 3)
+	ejected, _ := newTestReplica(t, 100)
+	ejected.healthy = 0
+	r := newTestResolver(t, "test_resolver_weight", light, heavy, ejected)
+
+	counts := make(map[*sql.DB]int)
+	const draws = 4000
+	for i := 0; i < draws; i++ {
+		db, cluster, err := r.replica(context.Background())
+		if err != nil || cluster != ClusterSlave {
+			t.Fatalf("replica = %s, %v", cluster, err)
+		}
+		counts[db]++
+	}
+	if counts[ejected.db] != 0 {
+		t.Fatalf("ejected replica is used %d times", counts[ejected.db])
+	}
+	ratio := float64(counts[heavy.db]) / draws
+	if ratio < 0.7 || ratio > 0.8 {
+		t.Fatalf("heavy replica ratio = %.3f, want about 0.75", ratio)
+	}
+
+	//没有健康的从库时使用主库
+	light.healthy, heavy.healthy = 0, 0
+	master, err := r.master()
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, cluster, err := r.replica(context.Background())
+	if err != nil || db != master || cluster != ClusterMaster {
+		t.Fatalf("replica without healthy replicas = %s, %v", cluster, err)
+	}
+}
+
+func TestResolverEjectReplica(t *testing.T) {
+	replica, connector := newTestReplica(t, 1)
+	r := newTestResolver(t, "test_resolver_eject", replica)
+
+	atomic.StoreInt32(&connector.down, 1)
+	for i := int32(1); i < r.maxFailures; i++ {
+		r.checkReplicas()
+		if !replica.isHealthy() {
+			t.Fatalf("replica is ejected after %d failures", i)
+		}
+	}
+	r.checkReplicas()
+	if replica.isHealthy() {
+		t.Fatalf("replica is not ejected after %d failures", r.maxFailures)
+	}
+
+	atomic.StoreInt32(&connector.down, 0)
+	r.checkReplicas()
+	if !replica.isHealthy() || atomic.LoadInt32(&replica.failures) != 0 {
+		t.Fatal("replica is not recovered after a successful ping")
+	}
+}
+
+func TestResolverReadYourWrites(t *testing.T) {
+	replica, _ := newTestReplica(t, 1)
+	r := newTestResolver(t, "test_resolver_ryw", replica)
+	master, err := r.master()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testData := []struct {
+		name    string
+		ctx     func() context.Context
+		window  time.Duration
+		cluster string
+	}{
+		{"no marker", func() context.Context {
+			ctx := context.Background()
+			r.markWrite(ctx)
+			return ctx
+		}, time.Minute, ClusterSlave},
+		{"marker without write", func() context.Context {
+			return WithReadYourWrites(context.Background())
+		}, time.Minute, ClusterSlave},
+		{"write in window", func() context.Context {
+			ctx := WithReadYourWrites(context.Background())
+			r.markWrite(ctx)
+			return ctx
+		}, time.Minute, ClusterMaster},
+		{"write out of window", func() context.Context {
+			ctx := WithReadYourWrites(context.Background())
+			r.markWrite(ctx)
+			time.Sleep(10 * time.Millisecond)
+			return ctx
+		}, time.Millisecond, ClusterSlave},
+	}
+	for _, d := range testData {
+		r.rywWindow = d.window
+		db, cluster, err := r.replica(d.ctx())
+		if err != nil {
+			t.Fatalf("%s: %v", d.name, err)
+		}
+		want := replica.db
+		if d.cluster == ClusterMaster {
+			want = master
+		}
+		if cluster != d.cluster || db != want {
+			t.Errorf("%s: cluster = %s, want %s", d.name, cluster, d.cluster)
+		}
+	}
+
+	//WithReadYourWrites不会覆盖已有的标记
+	ctx := WithReadYourWrites(context.Background())
+	r.rywWindow = time.Minute
+	r.markWrite(ctx)
+	if !r.pinned(WithReadYourWrites(ctx)) {
+		t.Error("WithReadYourWrites should keep the existing marker")
+	}
+}
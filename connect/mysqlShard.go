@@ -0,0 +1,307 @@
+package connect
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/jinzhu/gorm"
+	"github.com/lifenglin/micro-library/helper"
+	"github.com/sirupsen/logrus"
+	"hash/crc32"
+	"math"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+const (
+	ShardMod   = "mod"
+	ShardRange = "range"
+	ShardHash  = "hash"
+
+	//database配置中的保留key，不是数据库名
+	shardingConfigKey = "sharding"
+)
+
+var shardRouters *ShardRouters
+
+type ShardRouters struct {
+	sync.RWMutex
+	//key为srvName/逻辑表名
+	Map map[string]*shardRouter
+}
+
+func init() {
+	shardRouters = new(ShardRouters)
+	shardRouters.Map = make(map[string]*shardRouter)
+}
+
+type shardRangeConfig struct {
+	Start int64 `json:"start"`
+	End   int64 `json:"end"`
+	Table int   `json:"table"`
+}
+
+type shardConfig struct {
+	Algorithm    string             `json:"algorithm"`
+	Cluster      string             `json:"cluster"`
+	TableFormat  string             `json:"table_format"`
+	Tables       int                `json:"tables"`
+	Databases    []string           `json:"databases"`
+	Ranges       []shardRangeConfig `json:"ranges"`
+	VirtualNodes int                `json:"virtual_nodes"`
+}
+
+type shardRouter struct {
+	config shardConfig
+	ring   []uint32
+	nodes  map[uint32]int
+}
+
+type ShardTarget struct {
+	Database string
+	Cluster  string
+	Table    string
+}
+
+// ShardDB 按分片键返回物理库的连接，并已经设置好物理表名
+func ShardDB(ctx context.Context, hlp *helper.Helper, srvName string, logicalTable string, shardKey interface{}) (*gorm.DB, error) {
+	target, err := GetShardTarget(hlp, srvName, logicalTable, shardKey)
+	if err != nil {
+		return nil, err
+	}
+	db, err := ConnectDB(ctx, hlp, srvName, target.Database, target.Cluster)
+	if err != nil {
+		return nil, err
+	}
+	return db.Table(target.Table), nil
+}
+
+// GetShardTarget 返回分片键对应的物理库和物理表
+func GetShardTarget(hlp *helper.Helper, srvName string, logicalTable string, shardKey interface{}) (ShardTarget, error) {
+	router, err := getShardRouter(hlp, srvName, logicalTable)
+	if err != nil {
+		return ShardTarget{}, err
+	}
+	return router.route(shardKey)
+}
+
+func getShardRouter(hlp *helper.Helper, srvName string, logicalTable string) (*shardRouter, error) {
+	mysqlLog := hlp.MysqlLog
+	routerKey := srvName + "/" + logicalTable
+	shardRouters.RLock()
+	router, ok := shardRouters.Map[routerKey]
+	shardRouters.RUnlock()
+	if ok {
+		return router, nil
+	}
+
+	shardRouters.Lock()
+	defer shardRouters.Unlock()
+	if router, ok := shardRouters.Map[routerKey]; ok {
+		return router, nil
+	}
+
+	conf, watcher, err := newConfig(filepath.Join(srvName, "database"))
+	if err != nil {
+		mysqlLog.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Error("read database config fail")
+		return nil, fmt.Errorf("read database config fail: %w", err)
+	}
+	var config shardConfig
+	err = conf.Get(srvName, "database", shardingConfigKey, logicalTable).Scan(&config)
+	if err != nil {
+		mysqlLog.WithFields(logrus.Fields{
+			"table": logicalTable,
+			"error": err.Error(),
+		}).Error("scan sharding config fail")
+		return nil, fmt.Errorf("scan sharding config fail: %w", err)
+	}
+	router, err = newShardRouter(config)
+	if err != nil {
+		mysqlLog.WithFields(logrus.Fields{
+			"table": logicalTable,
+			"error": err.Error(),
+		}).Error("sharding config invalid")
+		return nil, fmt.Errorf("sharding config invalid: %w", err)
+	}
+	shardRouters.Map[routerKey] = router
+
+	go func() {
+		v, err := watcher.Next()
+		if err != nil {
+			mysqlLog.WithFields(logrus.Fields{
+				"error": err,
+				"table": logicalTable,
+			}).Warn("reload sharding")
+			return
+		}
+		mysqlLog.WithFields(logrus.Fields{
+			"table": logicalTable,
+			"file":  string(v.Bytes()),
+		}).Info("reload sharding")
+
+		//配置更新了，下次调用重新读取
+		shardRouters.Lock()
+		delete(shardRouters.Map, routerKey)
+		shardRouters.Unlock()
+	}()
+
+	return router, nil
+}
+
+func newShardRouter(config shardConfig) (*shardRouter, error) {
+	if config.Tables <= 0 {
+		return nil, errors.New("tables must be positive")
+	}
+	if len(config.Databases) == 0 {
+		return nil, errors.New("databases is empty")
+	}
+	if len(config.Databases) > config.Tables {
+		return nil, errors.New("databases more than tables")
+	}
+	if config.TableFormat == "" {
+		return nil, errors.New("table_format is empty")
+	}
+	if config.Cluster == "" {
+		config.Cluster = ClusterMaster
+	}
+
+	router := &shardRouter{config: config}
+	switch config.Algorithm {
+	case ShardMod:
+	case ShardRange:
+		if len(config.Ranges) == 0 {
+			return nil, errors.New("ranges is empty")
+		}
+		for _, r := range config.Ranges {
+			if r.Start < 0 || r.Start >= r.End || r.Table < 0 || r.Table >= config.Tables {
+				return nil, fmt.Errorf("invalid range [%d, %d) -> %d", r.Start, r.End, r.Table)
+			}
+		}
+		//区间不能重叠，否则同一个key可能路由到不同的表
+		ranges := append([]shardRangeConfig{}, config.Ranges...)
+		sort.Slice(ranges, func(i, j int) bool {
+			return ranges[i].Start < ranges[j].Start
+		})
+		for i := 1; i < len(ranges); i++ {
+			if ranges[i].Start < ranges[i-1].End {
+				return nil, fmt.Errorf("range [%d, %d) overlaps [%d, %d)",
+					ranges[i].Start, ranges[i].End, ranges[i-1].Start, ranges[i-1].End)
+			}
+		}
+		router.config.Ranges = ranges
+	case ShardHash:
+		if router.config.VirtualNodes <= 0 {
+			router.config.VirtualNodes = 160
+		}
+		router.nodes = make(map[uint32]int)
+		for table := 0; table < config.Tables; table++ {
+			for i := 0; i < router.config.VirtualNodes; i++ {
+				point := crc32.ChecksumIEEE([]byte(strconv.Itoa(table) + "#" + strconv.Itoa(i)))
+				if _, ok := router.nodes[point]; ok {
+					continue
+				}
+				router.nodes[point] = table
+				router.ring = append(router.ring, point)
+			}
+		}
+		sort.Slice(router.ring, func(i, j int) bool {
+			return router.ring[i] < router.ring[j]
+		})
+	default:
+		return nil, fmt.Errorf("unknown algorithm: %s", config.Algorithm)
+	}
+	return router, nil
+}
+
+func (r *shardRouter) route(shardKey interface{}) (ShardTarget, error) {
+	table, err := r.table(shardKey)
+	if err != nil {
+		return ShardTarget{}, err
+	}
+	//表按顺序平均分到各个库
+	database := r.config.Databases[table*len(r.config.Databases)/r.config.Tables]
+	return ShardTarget{
+		Database: database,
+		Cluster:  r.config.Cluster,
+		Table:    fmt.Sprintf(r.config.TableFormat, table),
+	}, nil
+}
+
+func (r *shardRouter) table(shardKey interface{}) (int, error) {
+	switch r.config.Algorithm {
+	case ShardMod:
+		key, ok, err := shardKeyInt(shardKey)
+		if err != nil {
+			return 0, err
+		}
+		if ok {
+			return int(key % int64(r.config.Tables)), nil
+		}
+		return int(crc32.ChecksumIEEE([]byte(fmt.Sprint(shardKey))) % uint32(r.config.Tables)), nil
+	case ShardRange:
+		key, ok, err := shardKeyInt(shardKey)
+		if err != nil {
+			return 0, err
+		}
+		if !ok {
+			return 0, fmt.Errorf("range sharding needs integer key, got %T", shardKey)
+		}
+		for _, rg := range r.config.Ranges {
+			if rg.Start <= key && key < rg.End {
+				return rg.Table, nil
+			}
+		}
+		return 0, fmt.Errorf("shard key %d out of range", key)
+	default:
+		point := crc32.ChecksumIEEE([]byte(fmt.Sprint(shardKey)))
+		index := sort.Search(len(r.ring), func(i int) bool {
+			return r.ring[i] >= point
+		})
+		if index == len(r.ring) {
+			index = 0
+		}
+		return r.nodes[r.ring[index]], nil
+	}
+}
+
+// shardKeyInt 整数类型的分片键转换为int64，不是整数时ok为false，负数和超过int64的值返回错误
+func shardKeyInt(shardKey interface{}) (key int64, ok bool, err error) {
+	switch k := shardKey.(type) {
+	case int:
+		key = int64(k)
+	case int8:
+		key = int64(k)
+	case int16:
+		key = int64(k)
+	case int32:
+		key = int64(k)
+	case int64:
+		key = k
+	case uint:
+		if uint64(k) > math.MaxInt64 {
+			return 0, true, fmt.Errorf("shard key %d overflows int64", k)
+		}
+		key = int64(k)
+	case uint8:
+		key = int64(k)
+	case uint16:
+		key = int64(k)
+	case uint32:
+		key = int64(k)
+	case uint64:
+		if k > math.MaxInt64 {
+			return 0, true, fmt.Errorf("shard key %d overflows int64", k)
+		}
+		key = int64(k)
+	default:
+		return 0, false, nil
+	}
+	if key < 0 {
+		return 0, true, fmt.Errorf("shard key %d is negative", key)
+	}
+	return key, true, nil
+}
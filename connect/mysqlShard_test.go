@@ -0,0 +1,126 @@
+package connect
+
+import (
+	"math"
+	"testing"
+)
+
+func TestShardRouterMod(t *testing.T) {
+	router, err := newShardRouter(shardConfig{
+		Algorithm:   ShardMod,
+		TableFormat: "user_%02d",
+		Tables:      64,
+		Databases:   []string{"user_a", "user_b"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testData := []struct {
+		key      interface{}
+		database string
+		table    string
+	}{
+		{1, "user_a", "user_01"},
+		{int64(63), "user_b", "user_63"},
+		{uint32(96), "user_b", "user_32"},
+		{uint64(math.MaxInt64), "user_b", "user_63"},
+	}
+	for _, d := range testData {
+		target, err := router.route(d.key)
+		if err != nil {
+			t.Fatalf("route %v: %v", d.key, err)
+		}
+		if target.Database != d.database || target.Table != d.table || target.Cluster != ClusterMaster {
+			t.Fatalf("route %v: expected %s.%s got %+v", d.key, d.database, d.table, target)
+		}
+	}
+
+	for _, key := range []interface{}{-1, int64(math.MinInt64), uint64(math.MaxUint64)} {
+		if _, err := router.route(key); err == nil {
+			t.Fatalf("route %v: expected error", key)
+		}
+	}
+}
+
+func TestShardRouterRange(t *testing.T) {
+	router, err := newShardRouter(shardConfig{
+		Algorithm:   ShardRange,
+		Cluster:     ClusterSlave,
+		TableFormat: "order_%d",
+		Tables:      2,
+		Databases:   []string{"order"},
+		Ranges: []shardRangeConfig{
+			{Start: 0, End: 1000, Table: 0},
+			{Start: 1000, End: 2000, Table: 1},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	target, err := router.route(1500)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if target.Table != "order_1" || target.Cluster != ClusterSlave {
+		t.Fatalf("unexpected target %+v", target)
+	}
+	if _, err := router.route(2000); err == nil {
+		t.Fatal("expected out of range error")
+	}
+	if _, err := router.route("abc"); err == nil {
+		t.Fatal("expected non integer key error")
+	}
+	if _, err := router.route(-1); err == nil {
+		t.Fatal("expected negative key error")
+	}
+}
+
+func TestShardRouterHash(t *testing.T) {
+	router, err := newShardRouter(shardConfig{
+		Algorithm:   ShardHash,
+		TableFormat: "user_%02d",
+		Tables:      8,
+		Databases:   []string{"user_a", "user_b"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	seen := make(map[string]bool)
+	for i := 0; i < 1000; i++ {
+		first, err := router.route(i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		second, _ := router.route(i)
+		if first != second {
+			t.Fatalf("route %d not stable: %+v %+v", i, first, second)
+		}
+		seen[first.Table] = true
+	}
+	if len(seen) != 8 {
+		t.Fatalf("expected keys spread over 8 tables, got %d", len(seen))
+	}
+}
+
+func TestShardRouterInvalid(t *testing.T) {
+	testData := []shardConfig{
+		{Algorithm: ShardMod, TableFormat: "t_%d", Databases: []string{"a"}},
+		{Algorithm: ShardMod, TableFormat: "t_%d", Tables: 4},
+		{Algorithm: "unknown", TableFormat: "t_%d", Tables: 4, Databases: []string{"a"}},
+		{Algorithm: ShardRange, TableFormat: "t_%d", Tables: 4, Databases: []string{"a"}, Ranges: []shardRangeConfig{{Start: 10, End: 5}}},
+		{Algorithm: ShardRange, TableFormat: "t_%d", Tables: 4, Databases: []string{"a"}},
+		{Algorithm: ShardRange, TableFormat: "t_%d", Tables: 4, Databases: []string{"a"}, Ranges: []shardRangeConfig{{Start: -10, End: 5}}},
+		{Algorithm: ShardRange, TableFormat: "t_%d", Tables: 4, Databases: []string{"a"}, Ranges: []shardRangeConfig{
+			{Start: 0, End: 100, Table: 0},
+			{Start: 50, End: 200, Table: 1},
+		}},
+	}
+	for _, config := range testData {
+		if _, err := newShardRouter(config); err == nil {
+			t.Fatalf("expected error for %+v", config)
+		}
+	}
+}
@@ -0,0 +1,277 @@
+package connect
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/jinzhu/gorm"
+	"github.com/lifenglin/micro-library/helper"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	sqlMetaKey  = "micro:sql_meta"
+	sqlStartKey = "micro:sql_start"
+
+	defaultSlowThreshold = 200 * time.Millisecond
+	//最多保留的慢sql模板数量，超过后淘汰总耗时最小的
+	maxSlowSqlStats = 1000
+	//指标中fingerprint标签的最大取值数量，超过后新的模板都记为other
+	maxSqlFingerprintLabels = 500
+	otherSqlFingerprint     = "other"
+)
+
+type sqlMeta struct {
+	srvName          string
+	name             string
+	cluster          string
+	slowThreshold    time.Duration
+	statementTimeout time.Duration
+}
+
+func newSqlMeta(srvName string, name string, cluster string, config mysqlClusterConfig) *sqlMeta {
+	threshold, err := time.ParseDuration(config.SlowThreshold)
+	if err != nil || threshold <= 0 {
+		threshold = defaultSlowThreshold
+	}
+	//没有配置时不限制
+	timeout, _ := time.ParseDuration(config.StatementTimeout)
+	return &sqlMeta{
+		srvName:          srvName,
+		name:             name,
+		cluster:          cluster,
+		slowThreshold:    threshold,
+		statementTimeout: timeout,
+	}
+}
+
+func getSqlMeta(name string, cluster string) *sqlMeta {
+	dbs.RLock()
+	defer dbs.RUnlock()
+	return dbs.Meta[name+"."+cluster]
+}
+
+type SlowSqlStat struct {
+	Fingerprint string  `json:"fingerprint"`
+	Name        string  `json:"name"`
+	Cluster     string  `json:"cluster"`
+	Count       int64   `json:"count"`
+	TotalMs     float64 `json:"total_ms"`
+	MaxMs       float64 `json:"max_ms"`
+	LastSql     string  `json:"last_sql"`
+	LastTime    int64   `json:"last_time"`
+}
+
+type slowSqlStats struct {
+	sync.Mutex
+	//key为库名加模板，不同库的同一个模板分开统计
+	Map map[string]*SlowSqlStat
+}
+
+// sqlTarget resolver把每条sql实际使用的集群记录在ctx中
+type sqlTarget struct {
+	cluster atomic.Value
+}
+
+type sqlTargetKey struct{}
+
+var (
+	slowSqls           *slowSqlStats
+	sqlDurationSeconds *prometheus.HistogramVec
+	//已经作为标签使用过的fingerprint
+	sqlFingerprintLabels sync.Map
+	sqlFingerprintCount  int32
+)
+
+func init() {
+	slowSqls = new(slowSqlStats)
+	slowSqls.Map = make(map[string]*SlowSqlStat)
+
+	sqlDurationSeconds = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "mysql_statement_duration_seconds",
+		Help:    "Duration of sql statements grouped by fingerprint.",
+		Buckets: prometheus.ExponentialBuckets(0.001, 2, 15),
+	}, []string{"service_name", "name", "cluster", "fingerprint"})
+	_ = prometheus.Register(sqlDurationSeconds)
+
+	//注册到默认callback上，只统计带有sqlMeta的连接
+	callback := gorm.DefaultCallback
+	callback.Create().Before("gorm:create").Register("micro:sql_before_create", sqlBeforeCallback)
+	callback.Create().After("gorm:create").Register("micro:sql_after_create", sqlAfterCallback)
+	callback.Query().Before("gorm:query").Register("micro:sql_before_query", sqlBeforeCallback)
+	callback.Query().After("gorm:query").Register("micro:sql_after_query", sqlAfterCallback)
+	callback.Update().Before("gorm:update").Register("micro:sql_before_update", sqlBeforeCallback)
+	callback.Update().After("gorm:update").Register("micro:sql_after_update", sqlAfterCallback)
+	callback.Delete().Before("gorm:delete").Register("micro:sql_before_delete", sqlBeforeCallback)
+	callback.Delete().After("gorm:delete").Register("micro:sql_after_delete", sqlAfterCallback)
+	callback.RowQuery().Before("gorm:row_query").Register("micro:sql_before_row_query", sqlBeforeCallback)
+	callback.RowQuery().After("gorm:row_query").Register("micro:sql_after_row_query", sqlAfterCallback)
+}
+
+func sqlBeforeCallback(scope *gorm.Scope) {
+	if _, ok := scope.Get(sqlMetaKey); !ok {
+		return
+	}
+	//请求已经取消或超时，不再发出sql
+	if value, ok := scope.Get(sqlContextKey); ok {
+		ctx := value.(context.Context)
+		if err := ctx.Err(); err != nil {
+			scope.Err(err)
+			return
+		}
+		//事务中的sql不经过resolver，清掉上一条sql的集群
+		setSqlTarget(ctx, "")
+	}
+	scope.InstanceSet(sqlStartKey, time.Now())
+}
+
+func sqlAfterCallback(scope *gorm.Scope) {
+	value, ok := scope.Get(sqlMetaKey)
+	if !ok {
+		return
+	}
+	meta, ok := value.(*sqlMeta)
+	if !ok || meta == nil {
+		return
+	}
+	start, ok := scope.InstanceGet(sqlStartKey)
+	if !ok || scope.SQL == "" {
+		return
+	}
+	ctx := context.Background()
+	if value, ok := scope.Get(sqlContextKey); ok {
+		ctx = value.(context.Context)
+	}
+	elapsed := time.Since(start.(time.Time))
+	observeSql(meta, sqlTargetCluster(ctx, meta), scope.SQL, scope.SQLVars, elapsed, isSqlTimeout(ctx, meta, elapsed, scope.DB().Error))
+}
+
+func withSqlTarget(ctx context.Context) context.Context {
+	return context.WithValue(ctx, sqlTargetKey{}, new(sqlTarget))
+}
+
+func setSqlTarget(ctx context.Context, cluster string) {
+	if target, ok := ctx.Value(sqlTargetKey{}).(*sqlTarget); ok {
+		target.cluster.Store(cluster)
+	}
+}
+
+// sqlTargetCluster 没有经过resolver的sql使用连接本身的集群
+func sqlTargetCluster(ctx context.Context, meta *sqlMeta) string {
+	if target, ok := ctx.Value(sqlTargetKey{}).(*sqlTarget); ok {
+		if cluster, ok := target.cluster.Load().(string); ok && cluster != "" {
+			return cluster
+		}
+	}
+	return meta.cluster
+}
+
+// sqlFingerprintLabel 限制fingerprint标签的取值数量，避免没有参数化的sql产生大量时间序列
+func sqlFingerprintLabel(fingerprint string) string {
+	if _, ok := sqlFingerprintLabels.Load(fingerprint); ok {
+		return fingerprint
+	}
+	if atomic.AddInt32(&sqlFingerprintCount, 1) > maxSqlFingerprintLabels {
+		atomic.AddInt32(&sqlFingerprintCount, -1)
+		return otherSqlFingerprint
+	}
+	if _, loaded := sqlFingerprintLabels.LoadOrStore(fingerprint, struct{}{}); loaded {
+		atomic.AddInt32(&sqlFingerprintCount, -1)
+	}
+	return fingerprint
+}
+
+func observeSql(meta *sqlMeta, cluster string, sql string, vars []interface{}, elapsed time.Duration, timeout bool) {
+	fingerprint := helper.SqlFingerprint(sql)
+	label := sqlFingerprintLabel(fingerprint)
+	sqlDurationSeconds.WithLabelValues(meta.srvName, meta.name, cluster, label).Observe(elapsed.Seconds())
+	if timeout {
+		observeSqlTimeout(meta, cluster, label, sql, elapsed)
+	}
+	if elapsed < meta.slowThreshold {
+		return
+	}
+
+	if SlowLog != nil {
+		SlowLog.WithFields(logrus.Fields{
+			"srvName":     meta.srvName,
+			"name":        meta.name,
+			"cluster":     cluster,
+			"fingerprint": fingerprint,
+			"sql":         sql,
+			"vars":        vars,
+			"elapsed":     elapsed.String(),
+		}).Warn("slow sql")
+	}
+
+	ms := float64(elapsed) / float64(time.Millisecond)
+	slowSqls.Lock()
+	defer slowSqls.Unlock()
+	key := meta.name + "." + cluster + " " + fingerprint
+	stat, ok := slowSqls.Map[key]
+	if !ok {
+		if len(slowSqls.Map) >= maxSlowSqlStats {
+			slowSqls.evict()
+		}
+		stat = &SlowSqlStat{
+			Fingerprint: fingerprint,
+			Name:        meta.name,
+			Cluster:     cluster,
+		}
+		slowSqls.Map[key] = stat
+	}
+	stat.Count++
+	stat.TotalMs += ms
+	if ms > stat.MaxMs {
+		stat.MaxMs = ms
+	}
+	stat.LastSql = sql
+	stat.LastTime = time.Now().Unix()
+}
+
+// evict 淘汰总耗时最小的模板，调用方持有锁
+func (s *slowSqlStats) evict() {
+	var minKey string
+	var minTotal float64
+	for key, stat := range s.Map {
+		if minKey == "" || stat.TotalMs < minTotal {
+			minKey = key
+			minTotal = stat.TotalMs
+		}
+	}
+	delete(s.Map, minKey)
+}
+
+// SlowSqlTop 返回总耗时最高的n个慢sql模板
+func SlowSqlTop(n int) []SlowSqlStat {
+	slowSqls.Lock()
+	list := make([]SlowSqlStat, 0, len(slowSqls.Map))
+	for _, stat := range slowSqls.Map {
+		list = append(list, *stat)
+	}
+	slowSqls.Unlock()
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].TotalMs > list[j].TotalMs
+	})
+	if n > 0 && len(list) > n {
+		list = list[:n]
+	}
+	return list
+}
+
+// SlowSqlHandler 以json输出慢sql排行，n参数控制条数，默认20
+func SlowSqlHandler(w http.ResponseWriter, r *http.Request) {
+	n, err := strconv.Atoi(r.URL.Query().Get("n"))
+	if err != nil || n <= 0 {
+		n = 20
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(SlowSqlTop(n))
+}
@@ -0,0 +1,330 @@
+package connect
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"github.com/go-sql-driver/mysql"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+	gorm2 "gorm.io/gorm"
+	"io"
+	"reflect"
+	"time"
+)
+
+const sqlContextKey = "micro:sql_context"
+
+var sqlTimeoutTotal *prometheus.CounterVec
+
+func init() {
+	sqlTimeoutTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mysql_statement_timeouts_total",
+		Help: "Number of sql statements cancelled or over their timeout.",
+	}, []string{"service_name", "name", "cluster", "fingerprint"})
+	_ = prometheus.Register(sqlTimeoutTotal)
+}
+
+type statementTimeoutKey struct{}
+
+// WithStatementTimeout 覆盖集群配置的statement_timeout，只对ctx内的sql生效
+func WithStatementTimeout(ctx context.Context, timeout time.Duration) context.Context {
+	return context.WithValue(ctx, statementTimeoutKey{}, timeout)
+}
+
+func statementTimeout(ctx context.Context, meta *sqlMeta) time.Duration {
+	if timeout, ok := ctx.Value(statementTimeoutKey{}).(time.Duration); ok {
+		return timeout
+	}
+	if meta == nil {
+		return 0
+	}
+	return meta.statementTimeout
+}
+
+// openMysql 打开mysql连接池，statement_timeout在驱动层生效。
+// gorm v1的sql不带ctx，使用集群配置的超时；带ctx的sql可以用WithStatementTimeout覆盖
+func openMysql(meta *sqlMeta, dsn string) (*sql.DB, error) {
+	config, err := mysql.ParseDSN(dsn)
+	if err != nil {
+		return nil, err
+	}
+	connector, err := mysql.NewConnector(config)
+	if err != nil {
+		return nil, err
+	}
+	return sql.OpenDB(&timeoutConnector{Connector: connector, meta: meta}), nil
+}
+
+type timeoutConnector struct {
+	driver.Connector
+	meta *sqlMeta
+}
+
+func (c *timeoutConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.Connector.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &timeoutDriverConn{Conn: conn, meta: c.meta}, nil
+}
+
+// timeoutDriverConn 给每条sql加上超时，exec返回后或rows关闭后释放超时的ctx
+type timeoutDriverConn struct {
+	driver.Conn
+	meta *sqlMeta
+}
+
+func (c *timeoutDriverConn) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if timeout := statementTimeout(ctx, c.meta); timeout > 0 {
+		return context.WithTimeout(ctx, timeout)
+	}
+	return ctx, func() {}
+}
+
+func (c *timeoutDriverConn) Prepare(query string) (driver.Stmt, error) {
+	return c.PrepareContext(context.Background(), query)
+}
+
+func (c *timeoutDriverConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	var stmt driver.Stmt
+	var err error
+	if preparer, ok := c.Conn.(driver.ConnPrepareContext); ok {
+		stmt, err = preparer.PrepareContext(ctx, query)
+	} else {
+		stmt, err = c.Conn.Prepare(query)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &timeoutStmt{Stmt: stmt, conn: c}, nil
+}
+
+func (c *timeoutDriverConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if beginner, ok := c.Conn.(driver.ConnBeginTx); ok {
+		return beginner.BeginTx(ctx, opts)
+	}
+	return c.Conn.Begin()
+}
+
+func (c *timeoutDriverConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	execer, ok := c.Conn.(driver.ExecerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
+	return execer.ExecContext(ctx, query, args)
+}
+
+func (c *timeoutDriverConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	queryer, ok := c.Conn.(driver.QueryerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	ctx, cancel := c.withTimeout(ctx)
+	rows, err := queryer.QueryContext(ctx, query, args)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	return &timeoutRows{Rows: rows, cancel: cancel}, nil
+}
+
+func (c *timeoutDriverConn) Ping(ctx context.Context) error {
+	if pinger, ok := c.Conn.(driver.Pinger); ok {
+		return pinger.Ping(ctx)
+	}
+	return nil
+}
+
+func (c *timeoutDriverConn) ResetSession(ctx context.Context) error {
+	if resetter, ok := c.Conn.(driver.SessionResetter); ok {
+		return resetter.ResetSession(ctx)
+	}
+	return nil
+}
+
+func (c *timeoutDriverConn) CheckNamedValue(value *driver.NamedValue) error {
+	if checker, ok := c.Conn.(driver.NamedValueChecker); ok {
+		return checker.CheckNamedValue(value)
+	}
+	return driver.ErrSkip
+}
+
+type timeoutStmt struct {
+	driver.Stmt
+	conn *timeoutDriverConn
+}
+
+func (s *timeoutStmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	ctx, cancel := s.conn.withTimeout(ctx)
+	defer cancel()
+	if execer, ok := s.Stmt.(driver.StmtExecContext); ok {
+		return execer.ExecContext(ctx, args)
+	}
+	return s.Stmt.Exec(namedValues(args))
+}
+
+func (s *timeoutStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	ctx, cancel := s.conn.withTimeout(ctx)
+	var rows driver.Rows
+	var err error
+	if queryer, ok := s.Stmt.(driver.StmtQueryContext); ok {
+		rows, err = queryer.QueryContext(ctx, args)
+	} else {
+		rows, err = s.Stmt.Query(namedValues(args))
+	}
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	return &timeoutRows{Rows: rows, cancel: cancel}, nil
+}
+
+func namedValues(args []driver.NamedValue) []driver.Value {
+	values := make([]driver.Value, len(args))
+	for i, arg := range args {
+		values[i] = arg.Value
+	}
+	return values
+}
+
+// timeoutRows 关闭时释放超时的ctx，QueryRow在Scan之后关闭rows
+type timeoutRows struct {
+	driver.Rows
+	cancel context.CancelFunc
+}
+
+func (r *timeoutRows) Close() error {
+	err := r.Rows.Close()
+	r.cancel()
+	return err
+}
+
+func (r *timeoutRows) HasNextResultSet() bool {
+	if next, ok := r.Rows.(driver.RowsNextResultSet); ok {
+		return next.HasNextResultSet()
+	}
+	return false
+}
+
+func (r *timeoutRows) NextResultSet() error {
+	if next, ok := r.Rows.(driver.RowsNextResultSet); ok {
+		return next.NextResultSet()
+	}
+	return io.EOF
+}
+
+func (r *timeoutRows) ColumnTypeScanType(index int) reflect.Type {
+	if column, ok := r.Rows.(driver.RowsColumnTypeScanType); ok {
+		return column.ColumnTypeScanType(index)
+	}
+	return reflect.TypeOf(new(interface{})).Elem()
+}
+
+func (r *timeoutRows) ColumnTypeDatabaseTypeName(index int) string {
+	if column, ok := r.Rows.(driver.RowsColumnTypeDatabaseTypeName); ok {
+		return column.ColumnTypeDatabaseTypeName(index)
+	}
+	return ""
+}
+
+func (r *timeoutRows) ColumnTypeLength(index int) (int64, bool) {
+	if column, ok := r.Rows.(driver.RowsColumnTypeLength); ok {
+		return column.ColumnTypeLength(index)
+	}
+	return 0, false
+}
+
+func (r *timeoutRows) ColumnTypeNullable(index int) (bool, bool) {
+	if column, ok := r.Rows.(driver.RowsColumnTypeNullable); ok {
+		return column.ColumnTypeNullable(index)
+	}
+	return false, false
+}
+
+func (r *timeoutRows) ColumnTypePrecisionScale(index int) (int64, int64, bool) {
+	if column, ok := r.Rows.(driver.RowsColumnTypePrecisionScale); ok {
+		return column.ColumnTypePrecisionScale(index)
+	}
+	return 0, 0, false
+}
+
+func isSqlTimeout(ctx context.Context, meta *sqlMeta, elapsed time.Duration, err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+		return true
+	}
+	if deadline, ok := ctx.Deadline(); ok && time.Now().After(deadline) {
+		return true
+	}
+	timeout := statementTimeout(ctx, meta)
+	return timeout > 0 && elapsed >= timeout
+}
+
+func observeSqlTimeout(meta *sqlMeta, cluster string, fingerprint string, sql string, elapsed time.Duration) {
+	sqlTimeoutTotal.WithLabelValues(meta.srvName, meta.name, cluster, fingerprint).Inc()
+	if MysqlLog != nil {
+		MysqlLog.WithFields(logrus.Fields{
+			"srvName":     meta.srvName,
+			"name":        meta.name,
+			"cluster":     cluster,
+			"fingerprint": fingerprint,
+			"sql":         sql,
+			"elapsed":     elapsed.String(),
+		}).Warn("sql timeout")
+	}
+}
+
+// registerSqlCallbacksV2 给gorm v2的连接加上超时和慢sql统计
+func registerSqlCallbacksV2(db *gorm2.DB, name string, cluster string) {
+	before := func(db *gorm2.DB) {
+		meta := getSqlMeta(name, cluster)
+		if meta == nil {
+			return
+		}
+		ctx := db.Statement.Context
+		if err := ctx.Err(); err != nil {
+			_ = db.AddError(err)
+			return
+		}
+		//执行完恢复原来的ctx，超时由驱动层按ctx中的WithStatementTimeout或集群配置设置
+		db.InstanceSet(sqlContextKey, ctx)
+		//resolver在这个ctx中记录实际使用的集群
+		db.Statement.Context = withSqlTarget(ctx)
+		db.InstanceSet(sqlStartKey, time.Now())
+	}
+	after := func(db *gorm2.DB) {
+		ctx := db.Statement.Context
+		meta := getSqlMeta(name, cluster)
+		target := cluster
+		if meta != nil {
+			target = sqlTargetCluster(ctx, meta)
+		}
+		if origin, ok := db.InstanceGet(sqlContextKey); ok {
+			ctx = origin.(context.Context)
+			db.Statement.Context = ctx
+		}
+		start, ok := db.InstanceGet(sqlStartKey)
+		if meta == nil || !ok || db.Statement.SQL.Len() == 0 {
+			return
+		}
+		elapsed := time.Since(start.(time.Time))
+		observeSql(meta, target, db.Statement.SQL.String(), db.Statement.Vars, elapsed, isSqlTimeout(ctx, meta, elapsed, db.Error))
+	}
+
+	callback := db.Callback()
+	_ = callback.Create().Before("gorm:create").Register("micro:sql_before_create", before)
+	_ = callback.Create().After("gorm:create").Register("micro:sql_after_create", after)
+	_ = callback.Query().Before("gorm:query").Register("micro:sql_before_query", before)
+	_ = callback.Query().After("gorm:query").Register("micro:sql_after_query", after)
+	_ = callback.Update().Before("gorm:update").Register("micro:sql_before_update", before)
+	_ = callback.Update().After("gorm:update").Register("micro:sql_after_update", after)
+	_ = callback.Delete().Before("gorm:delete").Register("micro:sql_before_delete", before)
+	_ = callback.Delete().After("gorm:delete").Register("micro:sql_after_delete", after)
+	_ = callback.Raw().Before("gorm:raw").Register("micro:sql_before_raw", before)
+	_ = callback.Raw().After("gorm:raw").Register("micro:sql_after_raw", after)
+	_ = callback.Row().Before("gorm:row").Register("micro:sql_before_row", before)
+	_ = callback.Row().After("gorm:row").Register("micro:sql_after_row", after)
+}
@@ -0,0 +1,138 @@
+package connect
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+// stubDriverConn 记录驱动收到的ctx
+type stubDriverConn struct {
+	ctx context.Context
+}
+
+func (c *stubDriverConn) Prepare(query string) (driver.Stmt, error) {
+	return nil, errors.New("prepare is not supported")
+}
+
+func (c *stubDriverConn) Close() error {
+	return nil
+}
+
+func (c *stubDriverConn) Begin() (driver.Tx, error) {
+	return nil, errors.New("begin is not supported")
+}
+
+func (c *stubDriverConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	c.ctx = ctx
+	return driver.RowsAffected(1), nil
+}
+
+func (c *stubDriverConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	c.ctx = ctx
+	return &stubDriverRows{}, nil
+}
+
+type stubDriverRows struct {
+	read bool
+}
+
+func (r *stubDriverRows) Columns() []string {
+	return []string{"v"}
+}
+
+func (r *stubDriverRows) Close() error {
+	return nil
+}
+
+func (r *stubDriverRows) Next(dest []driver.Value) error {
+	if r.read {
+		return io.EOF
+	}
+	r.read = true
+	dest[0] = int64(1)
+	return nil
+}
+
+type stubConnector struct {
+	conn *stubDriverConn
+}
+
+func (c *stubConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	return c.conn, nil
+}
+
+func (c *stubConnector) Driver() driver.Driver {
+	return nil
+}
+
+func newTimeoutTestDB(timeout time.Duration) (*sql.DB, *stubDriverConn) {
+	conn := new(stubDriverConn)
+	db := sql.OpenDB(&timeoutConnector{
+		Connector: &stubConnector{conn: conn},
+		meta:      &sqlMeta{statementTimeout: timeout},
+	})
+	db.SetMaxOpenConns(1)
+	return db, conn
+}
+
+func TestTimeoutConnCancelsAfterStatement(t *testing.T) {
+	db, conn := newTimeoutTestDB(time.Minute)
+	defer db.Close()
+
+	if _, err := db.Exec("UPDATE t SET v = 1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := conn.ctx.Deadline(); !ok {
+		t.Fatal("exec ctx has no deadline")
+	}
+	if conn.ctx.Err() != context.Canceled {
+		t.Errorf("exec ctx is not cancelled after exec: %v", conn.ctx.Err())
+	}
+
+	rows, err := db.Query("SELECT v FROM t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conn.ctx.Err() != nil {
+		t.Fatalf("query ctx is cancelled before rows are closed: %v", conn.ctx.Err())
+	}
+	for rows.Next() {
+	}
+	rows.Close()
+	if conn.ctx.Err() != context.Canceled {
+		t.Errorf("query ctx is not cancelled after rows.Close: %v", conn.ctx.Err())
+	}
+
+	var v int64
+	if err := db.QueryRow("SELECT v FROM t").Scan(&v); err != nil || v != 1 {
+		t.Fatalf("query row = %d, %v", v, err)
+	}
+	if conn.ctx.Err() != context.Canceled {
+		t.Errorf("query row ctx is not cancelled after scan: %v", conn.ctx.Err())
+	}
+}
+
+func TestTimeoutConnStatementTimeoutOverride(t *testing.T) {
+	db, conn := newTimeoutTestDB(time.Minute)
+	defer db.Close()
+
+	if _, err := db.ExecContext(WithStatementTimeout(context.Background(), 0), "UPDATE t SET v = 1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := conn.ctx.Deadline(); ok {
+		t.Error("zero statement timeout should not set a deadline")
+	}
+
+	if _, err := db.ExecContext(WithStatementTimeout(context.Background(), time.Second), "UPDATE t SET v = 1"); err != nil {
+		t.Fatal(err)
+	}
+	deadline, ok := conn.ctx.Deadline()
+	if !ok || time.Until(deadline) > time.Second {
+		t.Errorf("deadline = %v, %v", deadline, ok)
+	}
+}
@@ -0,0 +1,169 @@
+package connect
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/go-sql-driver/mysql"
+	"github.com/jinzhu/gorm"
+	"github.com/lifenglin/micro-library/helper"
+	"github.com/sirupsen/logrus"
+	"math/rand"
+	"time"
+)
+
+const (
+	mysqlErrLockWaitTimeout = 1205
+	mysqlErrDeadlock        = 1213
+)
+
+type txKey struct {
+	name string
+}
+
+type txState struct {
+	tx         *gorm.DB
+	savepoints int
+}
+
+type txOptions struct {
+	maxRetries int
+	backoff    time.Duration
+	txOpts     *sql.TxOptions
+}
+
+type TxOption func(*txOptions)
+
+// TxMaxRetries 死锁和锁等待超时的最大重试次数，默认3次
+func TxMaxRetries(n int) TxOption {
+	return func(o *txOptions) {
+		o.maxRetries = n
+	}
+}
+
+// TxBackoff 第一次重试前的等待时间，之后每次翻倍，默认20ms
+func TxBackoff(d time.Duration) TxOption {
+	return func(o *txOptions) {
+		o.backoff = d
+	}
+}
+
+func TxIsolation(level sql.IsolationLevel) TxOption {
+	return func(o *txOptions) {
+		o.txOpts = &sql.TxOptions{Isolation: level}
+	}
+}
+
+// WithTx 在主库事务中执行fn，事务保存在ctx里，fn内部用同一个ctx调用ConnectDB会拿到这个事务。
+// 嵌套调用WithTx时使用savepoint，只有最外层会在死锁(1213)和锁等待超时(1205)时重试整个事务。
+func WithTx(ctx context.Context, hlp *helper.Helper, srvName string, name string, fn func(ctx context.Context, tx *gorm.DB) error, opts ...TxOption) error {
+	if state, ok := ctx.Value(txKey{name: name}).(*txState); ok {
+		return withSavepoint(ctx, state, fn)
+	}
+
+	o := &txOptions{
+		maxRetries: 3,
+		backoff:    20 * time.Millisecond,
+	}
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	for attempt := 0; ; attempt++ {
+		err := runTx(ctx, hlp, srvName, name, fn, o)
+		if err == nil || attempt >= o.maxRetries || !isRetryableTxError(err) {
+			return err
+		}
+
+		wait := o.backoff << uint(attempt)
+		wait += time.Duration(rand.Int63n(int64(wait)/2 + 1))
+		hlp.MysqlLog.WithFields(logrus.Fields{
+			"name":    name,
+			"attempt": attempt + 1,
+			"wait":    wait.String(),
+			"error":   err.Error(),
+		}).Warn("retry transaction")
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+// TxFromContext 返回ctx中name对应的事务
+func TxFromContext(ctx context.Context, name string) (*gorm.DB, bool) {
+	state, ok := ctx.Value(txKey{name: name}).(*txState)
+	if !ok {
+		return nil, false
+	}
+	return state.tx, true
+}
+
+func runTx(ctx context.Context, hlp *helper.Helper, srvName string, name string, fn func(ctx context.Context, tx *gorm.DB) error, o *txOptions) (err error) {
+	db, err := ConnectDB(ctx, hlp, srvName, name, ClusterMaster)
+	if err != nil {
+		return err
+	}
+	tx := db.BeginTx(ctx, o.txOpts)
+	if tx.Error != nil {
+		return fmt.Errorf("begin transaction fail: %w", tx.Error)
+	}
+
+	txCtx := context.WithValue(ctx, txKey{name: name}, &txState{tx: tx})
+	defer func() {
+		if r := recover(); r != nil {
+			tx.Rollback()
+			panic(r)
+		}
+	}()
+
+	if err = fn(txCtx, tx); err != nil {
+		if rbErr := tx.Rollback().Error; rbErr != nil && !errors.Is(rbErr, sql.ErrTxDone) {
+			hlp.MysqlLog.WithFields(logrus.Fields{
+				"name":  name,
+				"error": rbErr.Error(),
+			}).Warn("rollback transaction error")
+		}
+		return err
+	}
+	return tx.Commit().Error
+}
+
+func withSavepoint(ctx context.Context, state *txState, fn func(ctx context.Context, tx *gorm.DB) error) (err error) {
+	state.savepoints++
+	savepoint := fmt.Sprintf("sp_%d", state.savepoints)
+	tx := state.tx
+	if err := tx.Exec("SAVEPOINT " + savepoint).Error; err != nil {
+		return fmt.Errorf("create savepoint fail: %w", err)
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			tx.Exec("ROLLBACK TO SAVEPOINT " + savepoint)
+			panic(r)
+		}
+	}()
+
+	if err = fn(ctx, tx); err != nil {
+		tx.Exec("ROLLBACK TO SAVEPOINT " + savepoint)
+		return err
+	}
+	return tx.Exec("RELEASE SAVEPOINT " + savepoint).Error
+}
+
+func isRetryableTxError(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	if errors.As(err, &mysqlErr) {
+		return mysqlErr.Number == mysqlErrDeadlock || mysqlErr.Number == mysqlErrLockWaitTimeout
+	}
+	if errs, ok := err.(gorm.Errors); ok {
+		for _, e := range errs {
+			if isRetryableTxError(e) {
+				return true
+			}
+		}
+	}
+	return false
+}
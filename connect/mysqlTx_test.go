@@ -0,0 +1,158 @@
+package connect
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/go-sql-driver/mysql"
+	"github.com/jinzhu/gorm"
+	"testing"
+	"time"
+)
+
+func newTxTestPool(t *testing.T, name string) *gorm.DB {
+	pool := newTestPool(t, name)
+	if err := pool.Exec("CREATE TABLE test_item (id INTEGER PRIMARY KEY)").Error; err != nil {
+		t.Fatal(err)
+	}
+	return pool
+}
+
+func testItemIds(t *testing.T, pool *gorm.DB) []int64 {
+	var ids []int64
+	if err := pool.Table("test_item").Order("id").Pluck("id", &ids).Error; err != nil {
+		t.Fatal(err)
+	}
+	return ids
+}
+
+func TestWithTxCommit(t *testing.T) {
+	pool := newTxTestPool(t, "test_tx_commit")
+	err := WithTx(context.Background(), newTestHelper(), testSrvName, "test_tx_commit", func(ctx context.Context, tx *gorm.DB) error {
+		return tx.Create(&testItem{Id: 1}).Error
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ids := testItemIds(t, pool); len(ids) != 1 {
+		t.Fatalf("ids = %v", ids)
+	}
+}
+
+func TestWithTxRollbackOnError(t *testing.T) {
+	pool := newTxTestPool(t, "test_tx_error")
+	fnErr := errors.New("fn error")
+	err := WithTx(context.Background(), newTestHelper(), testSrvName, "test_tx_error", func(ctx context.Context, tx *gorm.DB) error {
+		if err := tx.Create(&testItem{Id: 1}).Error; err != nil {
+			return err
+		}
+		return fnErr
+	})
+	if err != fnErr {
+		t.Fatalf("error = %v", err)
+	}
+	if ids := testItemIds(t, pool); len(ids) != 0 {
+		t.Fatalf("ids = %v", ids)
+	}
+}
+
+func TestWithTxRollbackOnPanic(t *testing.T) {
+	pool := newTxTestPool(t, "test_tx_panic")
+	func() {
+		defer func() {
+			if r := recover(); r != "fn panic" {
+				t.Fatalf("recovered = %v", r)
+			}
+		}()
+		_ = WithTx(context.Background(), newTestHelper(), testSrvName, "test_tx_panic", func(ctx context.Context, tx *gorm.DB) error {
+			tx.Create(&testItem{Id: 1})
+			panic("fn panic")
+		})
+	}()
+	if ids := testItemIds(t, pool); len(ids) != 0 {
+		t.Fatalf("ids = %v", ids)
+	}
+}
+
+func TestWithTxNestedSavepoint(t *testing.T) {
+	pool := newTxTestPool(t, "test_tx_nested")
+	hlp := newTestHelper()
+	err := WithTx(context.Background(), hlp, testSrvName, "test_tx_nested", func(ctx context.Context, tx *gorm.DB) error {
+		if err := tx.Create(&testItem{Id: 1}).Error; err != nil {
+			return err
+		}
+		//内层失败只回滚到savepoint
+		innerErr := WithTx(ctx, hlp, testSrvName, "test_tx_nested", func(ctx context.Context, inner *gorm.DB) error {
+			if inner != tx {
+				t.Error("nested WithTx should reuse the outer transaction")
+			}
+			if err := inner.Create(&testItem{Id: 2}).Error; err != nil {
+				return err
+			}
+			return errors.New("inner error")
+		})
+		if innerErr == nil {
+			t.Error("inner error is lost")
+		}
+		//ConnectDB在事务中返回同一个事务
+		db, err := ConnectDB(ctx, hlp, testSrvName, "test_tx_nested", ClusterMaster)
+		if err != nil {
+			return err
+		}
+		return WithTx(ctx, hlp, testSrvName, "test_tx_nested", func(ctx context.Context, inner *gorm.DB) error {
+			return db.Create(&testItem{Id: 3}).Error
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := testItemIds(t, pool)
+	if fmt.Sprint(ids) != "[1 3]" {
+		t.Fatalf("ids = %v", ids)
+	}
+}
+
+func TestWithTxRetry(t *testing.T) {
+	newTxTestPool(t, "test_tx_retry")
+	attempts := 0
+	err := WithTx(context.Background(), newTestHelper(), testSrvName, "test_tx_retry", func(ctx context.Context, tx *gorm.DB) error {
+		attempts++
+		if attempts < 3 {
+			return &mysql.MySQLError{Number: mysqlErrDeadlock, Message: "Deadlock found"}
+		}
+		return nil
+	}, TxBackoff(time.Millisecond))
+	if err != nil || attempts != 3 {
+		t.Fatalf("attempts = %d, error = %v", attempts, err)
+	}
+
+	attempts = 0
+	err = WithTx(context.Background(), newTestHelper(), testSrvName, "test_tx_retry", func(ctx context.Context, tx *gorm.DB) error {
+		attempts++
+		return &mysql.MySQLError{Number: mysqlErrLockWaitTimeout, Message: "Lock wait timeout exceeded"}
+	}, TxBackoff(time.Millisecond), TxMaxRetries(1))
+	if err == nil || attempts != 2 {
+		t.Fatalf("attempts = %d, error = %v", attempts, err)
+	}
+}
+
+func TestIsRetryableTxError(t *testing.T) {
+	testData := []struct {
+		err       error
+		retryable bool
+	}{
+		{&mysql.MySQLError{Number: mysqlErrDeadlock}, true},
+		{&mysql.MySQLError{Number: mysqlErrLockWaitTimeout}, true},
+		{&mysql.MySQLError{Number: 1062}, false},
+		{fmt.Errorf("insert fail: %w", &mysql.MySQLError{Number: mysqlErrDeadlock}), true},
+		{gorm.Errors{errors.New("a"), &mysql.MySQLError{Number: mysqlErrLockWaitTimeout}}, true},
+		{gorm.Errors{errors.New("a")}, false},
+		{errors.New("deadlock"), false},
+		{nil, false},
+	}
+	for _, d := range testData {
+		if retryable := isRetryableTxError(d.err); retryable != d.retryable {
+			t.Errorf("isRetryableTxError(%v) = %v, want %v", d.err, retryable, d.retryable)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package connect
+
+import (
+	"context"
+	"errors"
+	"github.com/jinzhu/gorm"
+	"github.com/lifenglin/micro-library/helper"
+	"github.com/sirupsen/logrus"
+	"testing"
+)
+
+const testSrvName = "test_service"
+
+type testItem struct {
+	Id int64
+}
+
+func newTestHelper() *helper.Helper {
+	log := logrus.NewEntry(logrus.New())
+	return &helper.Helper{Timer: new(helper.Timer), Log: log, MysqlLog: log}
+}
+
+// newTestPool 把sqlite内存库放进连接池缓存，ConnectDB不再读取配置
+func newTestPool(t *testing.T, name string) *gorm.DB {
+	db, err := openSqlite(name, sqliteConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dbsKey := name + "." + ClusterMaster
+	dbs.Lock()
+	dbs.Map[dbsKey] = db
+	dbs.Meta[dbsKey] = newSqlMeta(testSrvName, name, ClusterMaster, mysqlClusterConfig{Driver: "sqlite3"})
+	dbs.Unlock()
+	t.Cleanup(func() {
+		dbs.Lock()
+		delete(dbs.Map, dbsKey)
+		delete(dbs.Meta, dbsKey)
+		dbs.Unlock()
+		db.Close()
+	})
+	return db
+}
+
+func TestConnectDBSharesPool(t *testing.T) {
+	pool := newTestPool(t, "test_connect")
+
+	db, err := ConnectDB(context.Background(), newTestHelper(), testSrvName, "test_connect", ClusterMaster)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if db.DB() != pool.DB() {
+		t.Fatal("ConnectDB should return a handle on the pooled *sql.DB")
+	}
+	if _, ok := db.Get(sqlMetaKey); !ok {
+		t.Error("sql meta is not set")
+	}
+
+	//sqlite没有从库，ClusterAuto使用master
+	db, err = ConnectDB(context.Background(), newTestHelper(), testSrvName, "test_connect", ClusterAuto)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if db.DB() != pool.DB() {
+		t.Fatal("ClusterAuto on sqlite should return the master pool")
+	}
+}
+
+func TestConnectDBCancelledContext(t *testing.T) {
+	pool := newTestPool(t, "test_cancel")
+	ctx, cancel := context.WithCancel(context.Background())
+	db, err := ConnectDB(ctx, newTestHelper(), testSrvName, "test_cancel", ClusterMaster)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Exec("CREATE TABLE test_item (id INTEGER PRIMARY KEY)").Error; err != nil {
+		t.Fatal(err)
+	}
+
+	cancel()
+	if err := db.Create(&testItem{Id: 1}).Error; !errors.Is(err, context.Canceled) {
+		t.Fatalf("create after cancel error = %v", err)
+	}
+	var count int
+	pool.Table("test_item").Count(&count)
+	if count != 0 {
+		t.Fatalf("sql is sent after cancel, count = %d", count)
+	}
+}
@@ -0,0 +1,572 @@
+package connect
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/jinzhu/gorm"
+	"github.com/lifenglin/micro-library/helper"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/segmentio/kafka-go"
+	"github.com/sirupsen/logrus"
+	"os"
+	"time"
+)
+
+const (
+	outboxTable = "outbox"
+
+	OutboxPending = 0
+	OutboxSent    = 1
+	//发送失败次数达到上限的消息，不再发送也不会被清理，处理后把status和attempts改回0会重新发送
+	OutboxFailed = 2
+
+	outboxLastErrorSize = 1024
+
+	//锁的值是持有者的token，只有持有者才能续期和释放
+	outboxRenewScript   = `if redis.call("get", KEYS[1]) == ARGV[1] then return redis.call("pexpire", KEYS[1], ARGV[2]) else return 0 end`
+	outboxReleaseScript = `if redis.call("get", KEYS[1]) == ARGV[1] then return redis.call("del", KEYS[1]) else return 0 end`
+)
+
+// OutboxSchema outbox表的建表语句，可以放到服务自己的Migration中
+const OutboxSchema = `CREATE TABLE IF NOT EXISTS outbox (
+	id BIGINT UNSIGNED NOT NULL AUTO_INCREMENT PRIMARY KEY,
+	topic VARCHAR(255) NOT NULL,
+	msg_key VARCHAR(255) NOT NULL DEFAULT '',
+	value MEDIUMBLOB NOT NULL,
+	headers TEXT NOT NULL,
+	status TINYINT NOT NULL DEFAULT 0,
+	created_at BIGINT NOT NULL,
+	sent_at BIGINT NOT NULL DEFAULT 0,
+	attempts INT NOT NULL DEFAULT 0,
+	last_error VARCHAR(1024) NOT NULL DEFAULT '',
+	KEY idx_status_id (status, id)
+)`
+
+var (
+	outboxBacklog         *prometheus.GaugeVec
+	outboxLagSeconds      *prometheus.GaugeVec
+	outboxPublishedTotal  *prometheus.CounterVec
+	outboxPublishErrTotal *prometheus.CounterVec
+	outboxFailedTotal     *prometheus.CounterVec
+	outboxFailed          *prometheus.GaugeVec
+)
+
+func init() {
+	outboxBacklog = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "outbox_backlog",
+		Help: "Number of outbox messages waiting to be published.",
+	}, []string{"service_name", "name"})
+	outboxLagSeconds = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "outbox_lag_seconds",
+		Help: "Age of the oldest outbox message waiting to be published.",
+	}, []string{"service_name", "name"})
+	outboxPublishedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "outbox_published_total",
+		Help: "Number of outbox messages published to kafka.",
+	}, []string{"service_name", "name", "topic"})
+	outboxPublishErrTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "outbox_publish_errors_total",
+		Help: "Number of failed outbox publish batches.",
+	}, []string{"service_name", "name", "topic"})
+	outboxFailedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "outbox_failed_total",
+		Help: "Number of outbox messages marked failed after reaching the max attempts.",
+	}, []string{"service_name", "name", "topic"})
+	outboxFailed = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "outbox_failed",
+		Help: "Number of failed outbox messages waiting for manual handling.",
+	}, []string{"service_name", "name"})
+	_ = prometheus.Register(outboxBacklog)
+	_ = prometheus.Register(outboxLagSeconds)
+	_ = prometheus.Register(outboxPublishedTotal)
+	_ = prometheus.Register(outboxPublishErrTotal)
+	_ = prometheus.Register(outboxFailedTotal)
+	_ = prometheus.Register(outboxFailed)
+}
+
+type OutboxMessage struct {
+	Id     uint64 `gorm:"primary_key"`
+	Topic  string
+	MsgKey string
+	Value  []byte
+	//kafka.Header的json
+	Headers   string
+	Status    int8
+	CreatedAt int64
+	SentAt    int64
+	//消息本身导致的发送失败次数
+	Attempts  int
+	LastError string
+}
+
+func (OutboxMessage) TableName() string {
+	return outboxTable
+}
+
+// OutboxMigration 返回创建outbox表的变更，version为服务自己的版本号
+func OutboxMigration(version int64) Migration {
+	return Migration{
+		Version: version,
+		Name:    "create_outbox",
+		Up:      OutboxSchema,
+		Down:    "DROP TABLE IF EXISTS " + outboxTable,
+	}
+}
+
+// PublishOutbox 把消息写入outbox表，必须在WithTx的fn中调用，和业务数据在同一个事务里提交
+func PublishOutbox(ctx context.Context, name string, topic string, key []byte, value []byte, headers ...kafka.Header) error {
+	tx, ok := TxFromContext(ctx, name)
+	if !ok {
+		return errors.New("PublishOutbox must be called inside WithTx")
+	}
+	//发送时已经不在当前请求中，先把追踪信息和request id写到消息头
+	msg := kafka.Message{Headers: append([]kafka.Header{}, headers...)}
+	InjectKafkaHeaders(ctx, &msg, "")
+	headerBytes, err := json.Marshal(msg.Headers)
+	if err != nil {
+		return err
+	}
+	return tx.Create(&OutboxMessage{
+		Topic:     topic,
+		MsgKey:    string(key),
+		Value:     value,
+		Headers:   string(headerBytes),
+		Status:    OutboxPending,
+		CreatedAt: time.Now().UnixNano() / int64(time.Millisecond),
+	}).Error
+}
+
+type outboxOptions struct {
+	batchSize    int
+	pollInterval time.Duration
+	lockTTL      time.Duration
+	lockKey      string
+	retention    time.Duration
+	maxAttempts  int
+}
+
+type OutboxOption func(*outboxOptions)
+
+// OutboxBatchSize 每次最多读取并发送的消息数，默认100
+func OutboxBatchSize(n int) OutboxOption {
+	return func(o *outboxOptions) {
+		o.batchSize = n
+	}
+}
+
+// OutboxPollInterval 没有待发送消息时的轮询间隔，默认1秒
+func OutboxPollInterval(d time.Duration) OutboxOption {
+	return func(o *outboxOptions) {
+		o.pollInterval = d
+	}
+}
+
+// OutboxLock 互斥锁的key和过期时间，默认outbox:relay:<srvName>:<name>，30秒
+func OutboxLock(key string, ttl time.Duration) OutboxOption {
+	return func(o *outboxOptions) {
+		o.lockKey = key
+		o.lockTTL = ttl
+	}
+}
+
+// OutboxRetention 已发送的消息保留多久，默认7天
+func OutboxRetention(d time.Duration) OutboxOption {
+	return func(o *outboxOptions) {
+		o.retention = d
+	}
+}
+
+// OutboxMaxAttempts 每条消息最多发送失败的次数，达到后标记为OutboxFailed，不再阻塞同一个topic后面的消息，默认10次。
+// 只有kafka返回的非临时错误计入次数，消息头无法解析的消息直接标记为OutboxFailed，网络错误和ctx取消不计入
+func OutboxMaxAttempts(n int) OutboxOption {
+	return func(o *outboxOptions) {
+		o.maxAttempts = n
+	}
+}
+
+// outboxWriter 按顺序写入一个topic的消息
+type outboxWriter func(ctx context.Context, topic string, messages []kafka.Message) error
+
+// outboxHeaderError 消息头无法解析，重试不会成功
+type outboxHeaderError struct {
+	id  uint64
+	err error
+}
+
+func (e *outboxHeaderError) Error() string {
+	return fmt.Sprintf("outbox %d headers: %v", e.id, e.err)
+}
+
+func (e *outboxHeaderError) Unwrap() error {
+	return e.err
+}
+
+type outboxRelay struct {
+	hlp       *helper.Helper
+	srvName   string
+	name      string
+	redisName string
+	kafkaName string
+	token     string
+	options   outboxOptions
+	log       *logrus.Entry
+	holding   bool
+	cleanedAt time.Time
+	write     outboxWriter
+}
+
+// RunOutboxRelay 阻塞运行直到ctx取消，多个pod同时运行时通过redis锁只有一个在发送。
+// 同一个topic的消息按id顺序写入kafka，topic需要配置hash balancer才能保证同一个key的顺序。
+// 发送失败会重发，消费方需要按消息幂等处理；一条消息失败OutboxMaxAttempts次后标记为OutboxFailed，跳过它继续发送。
+func RunOutboxRelay(ctx context.Context, hlp *helper.Helper, srvName string, name string, redisName string, kafkaName string, opts ...OutboxOption) error {
+	options := outboxOptions{
+		batchSize:    100,
+		pollInterval: time.Second,
+		lockTTL:      30 * time.Second,
+		lockKey:      fmt.Sprintf("outbox:relay:%s:%s", srvName, name),
+		retention:    7 * 24 * time.Hour,
+		maxAttempts:  10,
+	}
+	for _, opt := range opts {
+		opt(&options)
+	}
+	if options.maxAttempts <= 0 {
+		return errors.New("outbox max attempts must be positive")
+	}
+	if options.pollInterval*3 > options.lockTTL {
+		return errors.New("outbox lock ttl must be at least 3 times of poll interval")
+	}
+
+	hostname, _ := os.Hostname()
+	r := &outboxRelay{
+		hlp:       hlp,
+		srvName:   srvName,
+		name:      name,
+		redisName: redisName,
+		kafkaName: kafkaName,
+		token:     fmt.Sprintf("%s-%d-%d", hostname, os.Getpid(), time.Now().UnixNano()),
+		options:   options,
+		log: hlp.Log.WithFields(logrus.Fields{
+			"name":    name,
+			"lockKey": options.lockKey,
+		}),
+	}
+	r.write = r.writeKafka
+	defer r.release()
+
+	for {
+		sent := 0
+		if r.lock(ctx) {
+			//发送期间在后台续期，续期失败时马上停止发送，避免锁过期后和新的持有者重复发送
+			workCtx, stop := r.keepLock(ctx)
+			var err error
+			sent, err = r.relayOnce(workCtx)
+			if err != nil {
+				r.log.WithFields(logrus.Fields{
+					"error": err,
+				}).Warn("outbox relay error")
+			}
+			r.observe(workCtx)
+			r.clean(workCtx)
+			stop()
+		}
+
+		//一批发满时马上发下一批
+		wait := r.options.pollInterval
+		if sent >= r.options.batchSize {
+			wait = 0
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(wait):
+		}
+	}
+}
+
+// lock 没有持有锁时尝试获取，已持有时续期，返回当前是否持有锁
+func (r *outboxRelay) lock(ctx context.Context) bool {
+	redis, err := ConnectRedis(ctx, r.hlp, r.srvName, r.redisName)
+	if err != nil {
+		r.holding = false
+		return false
+	}
+	if r.holding {
+		return r.renew(ctx)
+	}
+
+	acquired, err := redis.SetNX(r.options.lockKey, r.token, r.options.lockTTL).Result()
+	if err != nil {
+		r.log.WithFields(logrus.Fields{
+			"error": err,
+		}).Warn("outbox lock error")
+		return false
+	}
+	if acquired {
+		r.log.Info("outbox lock acquired")
+	}
+	r.holding = acquired
+	return acquired
+}
+
+// renew 只有锁的值还是自己的token时才续期，失败时认为已经失去锁
+func (r *outboxRelay) renew(ctx context.Context) bool {
+	redis, err := ConnectRedis(ctx, r.hlp, r.srvName, r.redisName)
+	if err == nil {
+		var renewed int64
+		renewed, err = redis.Eval(outboxRenewScript, []string{r.options.lockKey}, r.token, r.options.lockTTL.Milliseconds()).Int64()
+		if err == nil && renewed == 0 {
+			err = errors.New("lock held by others")
+		}
+	}
+	if err != nil {
+		r.log.WithFields(logrus.Fields{
+			"error": err,
+		}).Warn("outbox lock lost")
+		r.holding = false
+	}
+	return r.holding
+}
+
+// keepLock 每lockTTL/3续期一次锁，续期失败时取消返回的ctx；stop停止续期并等待续期的goroutine退出
+func (r *outboxRelay) keepLock(ctx context.Context) (context.Context, func()) {
+	workCtx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	exited := make(chan struct{})
+	go func() {
+		defer close(exited)
+		ticker := time.NewTicker(r.options.lockTTL / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-workCtx.Done():
+				return
+			case <-ticker.C:
+				if !r.renew(workCtx) {
+					cancel()
+					return
+				}
+			}
+		}
+	}()
+	return workCtx, func() {
+		close(done)
+		<-exited
+		cancel()
+	}
+}
+
+func (r *outboxRelay) release() {
+	if !r.holding {
+		return
+	}
+	redis, err := ConnectRedis(context.Background(), r.hlp, r.srvName, r.redisName)
+	if err != nil {
+		return
+	}
+	if err := redis.Eval(outboxReleaseScript, []string{r.options.lockKey}, r.token).Err(); err != nil {
+		r.log.WithFields(logrus.Fields{
+			"error": err,
+		}).Warn("outbox lock release error")
+	}
+	r.holding = false
+}
+
+func (r *outboxRelay) db(ctx context.Context) (*gorm.DB, error) {
+	return ConnectDB(ctx, r.hlp, r.srvName, r.name, ClusterMaster)
+}
+
+// relayOnce 发送一批待发送的消息，返回成功发送的数量
+func (r *outboxRelay) relayOnce(ctx context.Context) (int, error) {
+	db, err := r.db(ctx)
+	if err != nil {
+		return 0, err
+	}
+	var messages []OutboxMessage
+	err = db.Where("status = ?", OutboxPending).Order("id").Limit(r.options.batchSize).Find(&messages).Error
+	if err != nil {
+		return 0, err
+	}
+
+	//按topic分组，组内保持id顺序
+	var topics []string
+	byTopic := make(map[string][]OutboxMessage)
+	for _, message := range messages {
+		if _, ok := byTopic[message.Topic]; !ok {
+			topics = append(topics, message.Topic)
+		}
+		byTopic[message.Topic] = append(byTopic[message.Topic], message)
+	}
+
+	sent := 0
+	var firstErr error
+	for _, topic := range topics {
+		n, err := r.relayTopic(ctx, db, topic, byTopic[topic])
+		sent += n
+		if err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("publish %s: %w", topic, err)
+		}
+	}
+	return sent, firstErr
+}
+
+// relayTopic 先整批发送，失败时逐条发送找出失败的消息。
+// 失败的消息之后的消息留到下一批，保证同一个topic的顺序；失败次数达到上限后跳过这条消息
+func (r *outboxRelay) relayTopic(ctx context.Context, db *gorm.DB, topic string, messages []OutboxMessage) (int, error) {
+	err := r.publish(ctx, topic, messages)
+	if err == nil {
+		return r.markSent(db, topic, messages)
+	}
+	outboxPublishErrTotal.WithLabelValues(r.srvName, r.name, topic).Inc()
+	if len(messages) == 1 {
+		return 0, r.markAttempt(ctx, db, topic, messages[0], err)
+	}
+
+	sent := 0
+	for i := range messages {
+		if err := r.publish(ctx, topic, messages[i:i+1]); err != nil {
+			return sent, r.markAttempt(ctx, db, topic, messages[i], err)
+		}
+		n, err := r.markSent(db, topic, messages[i:i+1])
+		sent += n
+		if err != nil {
+			return sent, err
+		}
+	}
+	return sent, nil
+}
+
+func (r *outboxRelay) markSent(db *gorm.DB, topic string, messages []OutboxMessage) (int, error) {
+	ids := make([]uint64, 0, len(messages))
+	for _, message := range messages {
+		ids = append(ids, message.Id)
+	}
+	err := db.Model(&OutboxMessage{}).Where("id IN (?)", ids).
+		Updates(map[string]interface{}{"status": OutboxSent, "sent_at": time.Now().UnixNano() / int64(time.Millisecond)}).Error
+	if err != nil {
+		//已经发出去了，下次会重复发送
+		return 0, fmt.Errorf("mark sent: %w", err)
+	}
+	outboxPublishedTotal.WithLabelValues(r.srvName, r.name, topic).Add(float64(len(ids)))
+	return len(ids), nil
+}
+
+// markAttempt 消息本身导致的失败计入attempts，达到上限时标记为OutboxFailed，返回发送的错误
+func (r *outboxRelay) markAttempt(ctx context.Context, db *gorm.DB, topic string, message OutboxMessage, err error) error {
+	if ctx.Err() != nil || !isOutboxMessageError(err) {
+		//失去锁、退出或者kafka暂时不可用，所有消息都会失败，不计入次数
+		return err
+	}
+	lastError := err.Error()
+	if len(lastError) > outboxLastErrorSize {
+		lastError = lastError[:outboxLastErrorSize]
+	}
+	status := OutboxPending
+	var headerErr *outboxHeaderError
+	if message.Attempts+1 >= r.options.maxAttempts || errors.As(err, &headerErr) {
+		status = OutboxFailed
+	}
+	updateErr := db.Model(&OutboxMessage{}).Where("id = ? AND status = ?", message.Id, OutboxPending).
+		Updates(map[string]interface{}{"attempts": gorm.Expr("attempts + 1"), "last_error": lastError, "status": status}).Error
+	if updateErr != nil {
+		return fmt.Errorf("%v, mark attempt: %w", err, updateErr)
+	}
+	if status == OutboxFailed {
+		outboxFailedTotal.WithLabelValues(r.srvName, r.name, topic).Inc()
+		r.log.WithFields(logrus.Fields{
+			"id":       message.Id,
+			"topic":    topic,
+			"attempts": message.Attempts + 1,
+			"error":    lastError,
+		}).Error("outbox message failed")
+	}
+	return err
+}
+
+// isOutboxMessageError kafka返回的非临时错误和消息头无法解析是消息本身的问题，重试也会失败
+func isOutboxMessageError(err error) bool {
+	var headerErr *outboxHeaderError
+	if errors.As(err, &headerErr) {
+		return true
+	}
+	var kafkaErr kafka.Error
+	return errors.As(err, &kafkaErr) && !kafkaErr.Temporary()
+}
+
+func (r *outboxRelay) publish(ctx context.Context, topic string, messages []OutboxMessage) error {
+	kafkaMessages := make([]kafka.Message, 0, len(messages))
+	for _, message := range messages {
+		var headers []kafka.Header
+		if message.Headers != "" {
+			if err := json.Unmarshal([]byte(message.Headers), &headers); err != nil {
+				return &outboxHeaderError{id: message.Id, err: err}
+			}
+		}
+		kafkaMessages = append(kafkaMessages, kafka.Message{
+			Key:     []byte(message.MsgKey),
+			Value:   message.Value,
+			Headers: headers,
+			Time:    time.Unix(0, message.CreatedAt*int64(time.Millisecond)),
+		})
+	}
+	return r.write(ctx, topic, kafkaMessages)
+}
+
+func (r *outboxRelay) writeKafka(ctx context.Context, topic string, messages []kafka.Message) error {
+	writer, err := GetKafkaWriter(r.srvName, r.kafkaName, topic, false)
+	if err != nil {
+		return err
+	}
+	return writeKafkaMessages(ctx, writer, kafkaTopicKey{svrName: r.srvName, name: r.kafkaName, topic: topic}, messages...)
+}
+
+func (r *outboxRelay) observe(ctx context.Context) {
+	db, err := r.db(ctx)
+	if err != nil {
+		return
+	}
+	var stat struct {
+		Backlog int64
+		Oldest  *int64
+	}
+	err = db.Raw("SELECT COUNT(*) AS backlog, MIN(created_at) AS oldest FROM "+outboxTable+" WHERE status = ?", OutboxPending).Scan(&stat).Error
+	if err != nil {
+		return
+	}
+	outboxBacklog.WithLabelValues(r.srvName, r.name).Set(float64(stat.Backlog))
+	lag := 0.0
+	if stat.Oldest != nil {
+		lag = time.Since(time.Unix(0, *stat.Oldest*int64(time.Millisecond))).Seconds()
+	}
+	outboxLagSeconds.WithLabelValues(r.srvName, r.name).Set(lag)
+
+	var failed int64
+	err = db.Model(&OutboxMessage{}).Where("status = ?", OutboxFailed).Count(&failed).Error
+	if err != nil {
+		return
+	}
+	outboxFailed.WithLabelValues(r.srvName, r.name).Set(float64(failed))
+}
+
+// clean 每分钟删除一次超过保留时间的已发送消息
+func (r *outboxRelay) clean(ctx context.Context) {
+	if time.Since(r.cleanedAt) < time.Minute {
+		return
+	}
+	r.cleanedAt = time.Now()
+	db, err := r.db(ctx)
+	if err != nil {
+		return
+	}
+	before := time.Now().Add(-r.options.retention).UnixNano() / int64(time.Millisecond)
+	err = db.Where("status = ? AND sent_at < ?", OutboxSent, before).Delete(&OutboxMessage{}).Error
+	if err != nil {
+		r.log.WithFields(logrus.Fields{
+			"error": err,
+		}).Warn("outbox clean error")
+	}
+}
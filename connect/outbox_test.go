@@ -0,0 +1,238 @@
+package connect
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/jinzhu/gorm"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/segmentio/kafka-go"
+	"reflect"
+	"testing"
+)
+
+// fakeOutboxWriter 记录每个topic写入的消息，fail返回错误时整批都不写入
+type fakeOutboxWriter struct {
+	written map[string][]string
+	calls   int
+	fail    func(ctx context.Context, msg kafka.Message) error
+}
+
+func (w *fakeOutboxWriter) write(ctx context.Context, topic string, messages []kafka.Message) error {
+	w.calls++
+	if w.fail != nil {
+		for _, msg := range messages {
+			if err := w.fail(ctx, msg); err != nil {
+				return err
+			}
+		}
+	}
+	for _, msg := range messages {
+		w.written[topic] = append(w.written[topic], string(msg.Value))
+	}
+	return nil
+}
+
+func newOutboxTestRelay(t *testing.T, name string, batchSize int, maxAttempts int) (*outboxRelay, *fakeOutboxWriter, *gorm.DB) {
+	pool := newTestPool(t, name)
+	if err := pool.AutoMigrate(&OutboxMessage{}).Error; err != nil {
+		t.Fatal(err)
+	}
+	writer := &fakeOutboxWriter{written: make(map[string][]string)}
+	hlp := newTestHelper()
+	r := &outboxRelay{
+		hlp:     hlp,
+		srvName: testSrvName,
+		name:    name,
+		options: outboxOptions{batchSize: batchSize, maxAttempts: maxAttempts},
+		log:     hlp.Log,
+		write:   writer.write,
+	}
+	return r, writer, pool
+}
+
+func addOutboxMessages(t *testing.T, pool *gorm.DB, status int8, topic string, values ...string) {
+	for _, value := range values {
+		message := &OutboxMessage{Topic: topic, Value: []byte(value), Headers: "[]", Status: status, CreatedAt: 1}
+		if err := pool.Create(message).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func outboxStatus(t *testing.T, pool *gorm.DB) map[string]OutboxMessage {
+	var messages []OutboxMessage
+	if err := pool.Order("id").Find(&messages).Error; err != nil {
+		t.Fatal(err)
+	}
+	byValue := make(map[string]OutboxMessage, len(messages))
+	for _, message := range messages {
+		byValue[string(message.Value)] = message
+	}
+	return byValue
+}
+
+func TestOutboxRelayClaimsPendingInBatches(t *testing.T) {
+	r, writer, pool := newOutboxTestRelay(t, "test_outbox_claim", 3, 3)
+	addOutboxMessages(t, pool, OutboxSent, "a", "sent")
+	addOutboxMessages(t, pool, OutboxPending, "a", "1", "2")
+	addOutboxMessages(t, pool, OutboxFailed, "a", "failed")
+	addOutboxMessages(t, pool, OutboxPending, "a", "3", "4")
+
+	for i, want := range []int{3, 1, 0} {
+		sent, err := r.relayOnce(context.Background())
+		if err != nil || sent != want {
+			t.Fatalf("relay %d: sent = %d, %v, want %d", i, sent, err, want)
+		}
+	}
+	if got := writer.written["a"]; !reflect.DeepEqual(got, []string{"1", "2", "3", "4"}) {
+		t.Fatalf("written = %v", got)
+	}
+	status := outboxStatus(t, pool)
+	for value, want := range map[string]int8{"1": OutboxSent, "4": OutboxSent, "sent": OutboxSent, "failed": OutboxFailed} {
+		if status[value].Status != want {
+			t.Errorf("%s status = %d, want %d", value, status[value].Status, want)
+		}
+	}
+	if status["1"].SentAt == 0 {
+		t.Error("sent_at is not set")
+	}
+}
+
+func TestOutboxRelayKeepsTopicOrder(t *testing.T) {
+	r, writer, pool := newOutboxTestRelay(t, "test_outbox_order", 10, 3)
+	addOutboxMessages(t, pool, OutboxPending, "a", "a1")
+	addOutboxMessages(t, pool, OutboxPending, "b", "b1")
+	addOutboxMessages(t, pool, OutboxPending, "a", "a2", "a3")
+	addOutboxMessages(t, pool, OutboxPending, "b", "b2")
+
+	if sent, err := r.relayOnce(context.Background()); err != nil || sent != 5 {
+		t.Fatalf("sent = %d, %v", sent, err)
+	}
+	want := map[string][]string{"a": {"a1", "a2", "a3"}, "b": {"b1", "b2"}}
+	if !reflect.DeepEqual(writer.written, want) {
+		t.Fatalf("written = %v", writer.written)
+	}
+}
+
+func TestOutboxRelayFailsMessageAfterMaxAttempts(t *testing.T) {
+	name := "test_outbox_attempts"
+	r, writer, pool := newOutboxTestRelay(t, name, 10, 2)
+	writer.fail = func(ctx context.Context, msg kafka.Message) error {
+		if string(msg.Value) == "bad" {
+			return kafka.MessageSizeTooLarge
+		}
+		return nil
+	}
+	addOutboxMessages(t, pool, OutboxPending, "a", "1", "bad", "2")
+	addOutboxMessages(t, pool, OutboxPending, "b", "3")
+
+	//失败的消息之前的消息逐条发送，之后的消息等到下一批
+	if sent, err := r.relayOnce(context.Background()); !errors.Is(err, kafka.MessageSizeTooLarge) || sent != 2 {
+		t.Fatalf("first relay: sent = %d, %v", sent, err)
+	}
+	status := outboxStatus(t, pool)
+	if bad := status["bad"]; bad.Status != OutboxPending || bad.Attempts != 1 || bad.LastError == "" {
+		t.Fatalf("bad after first relay = %+v", bad)
+	}
+	if status["2"].Status != OutboxPending {
+		t.Fatal("message after the failed one should wait")
+	}
+
+	if sent, err := r.relayOnce(context.Background()); !errors.Is(err, kafka.MessageSizeTooLarge) || sent != 0 {
+		t.Fatalf("second relay: sent = %d, %v", sent, err)
+	}
+	if bad := outboxStatus(t, pool)["bad"]; bad.Status != OutboxFailed || bad.Attempts != 2 {
+		t.Fatalf("bad after second relay = %+v", bad)
+	}
+	if v := testutil.ToFloat64(outboxFailedTotal.WithLabelValues(testSrvName, name, "a")); v != 1 {
+		t.Errorf("failed total = %v", v)
+	}
+
+	//失败的消息不再阻塞后面的消息
+	if sent, err := r.relayOnce(context.Background()); err != nil || sent != 1 {
+		t.Fatalf("third relay: sent = %d, %v", sent, err)
+	}
+	want := map[string][]string{"a": {"1", "2"}, "b": {"3"}}
+	if !reflect.DeepEqual(writer.written, want) {
+		t.Fatalf("written = %v", writer.written)
+	}
+
+	r.observe(context.Background())
+	if v := testutil.ToFloat64(outboxFailed.WithLabelValues(testSrvName, name)); v != 1 {
+		t.Errorf("failed gauge = %v", v)
+	}
+	if v := testutil.ToFloat64(outboxBacklog.WithLabelValues(testSrvName, name)); v != 0 {
+		t.Errorf("backlog = %v", v)
+	}
+}
+
+func TestOutboxRelayBadHeadersFailImmediately(t *testing.T) {
+	r, writer, pool := newOutboxTestRelay(t, "test_outbox_headers", 10, 5)
+	addOutboxMessages(t, pool, OutboxPending, "a", "1")
+	if err := pool.Create(&OutboxMessage{Topic: "a", Value: []byte("bad"), Headers: "{", CreatedAt: 1}).Error; err != nil {
+		t.Fatal(err)
+	}
+	addOutboxMessages(t, pool, OutboxPending, "a", "2")
+
+	if _, err := r.relayOnce(context.Background()); err == nil {
+		t.Fatal("expected header error")
+	}
+	if bad := outboxStatus(t, pool)["bad"]; bad.Status != OutboxFailed || bad.Attempts != 1 {
+		t.Fatalf("bad = %+v", bad)
+	}
+	if sent, err := r.relayOnce(context.Background()); err != nil || sent != 1 {
+		t.Fatalf("sent = %d, %v", sent, err)
+	}
+	if got := writer.written["a"]; !reflect.DeepEqual(got, []string{"1", "2"}) {
+		t.Fatalf("written = %v", got)
+	}
+}
+
+func TestOutboxRelayTransientErrorNotCounted(t *testing.T) {
+	r, writer, pool := newOutboxTestRelay(t, "test_outbox_transient", 10, 1)
+	writer.fail = func(ctx context.Context, msg kafka.Message) error {
+		return fmt.Errorf("dial: %w", kafka.LeaderNotAvailable)
+	}
+	addOutboxMessages(t, pool, OutboxPending, "a", "1", "2")
+
+	for i := 0; i < 3; i++ {
+		if _, err := r.relayOnce(context.Background()); err == nil {
+			t.Fatal("expected publish error")
+		}
+	}
+	for value, message := range outboxStatus(t, pool) {
+		if message.Status != OutboxPending || message.Attempts != 0 {
+			t.Errorf("%s = %+v", value, message)
+		}
+	}
+}
+
+func TestOutboxRelayLockLost(t *testing.T) {
+	r, writer, pool := newOutboxTestRelay(t, "test_outbox_lock", 10, 1)
+	addOutboxMessages(t, pool, OutboxPending, "a", "1", "2")
+
+	//keepLock续期失败时取消ctx，发送中途失去锁的消息不计入失败，也不标记为已发送
+	ctx, cancel := context.WithCancel(context.Background())
+	writer.fail = func(writeCtx context.Context, msg kafka.Message) error {
+		cancel()
+		return kafka.MessageSizeTooLarge
+	}
+	if _, err := r.relayOnce(ctx); err == nil {
+		t.Fatal("expected error after lock lost")
+	}
+	for value, message := range outboxStatus(t, pool) {
+		if message.Status != OutboxPending || message.Attempts != 0 {
+			t.Errorf("%s = %+v", value, message)
+		}
+	}
+
+	//已经失去锁时不再读取和发送
+	calls := writer.calls
+	if _, err := r.relayOnce(ctx); err == nil {
+		t.Fatal("expected error with a cancelled ctx")
+	}
+	if writer.calls != calls {
+		t.Fatal("writer is called after lock lost")
+	}
+}
@@ -1,11 +1,84 @@
 package connect
 
 import (
+	"github.com/go-redis/redis"
 	"github.com/prometheus/client_golang/prometheus"
 	"reflect"
+	"sync/atomic"
 	"time"
 )
 
+// deprecatedRedisGauges 为1时每15秒更新旧的cluster_redis_*、client_redis_*指标
+var deprecatedRedisGauges int32 = 1
+
+// SetDeprecatedRedisGauges 是否继续更新旧的cluster_redis_*、client_redis_*指标，默认更新。
+// 旧指标的service_name标签实际是redis name，迁移到redis_pool_*指标后设置为false
+func SetDeprecatedRedisGauges(enabled bool) {
+	var value int32
+	if enabled {
+		value = 1
+	}
+	atomic.StoreInt32(&deprecatedRedisGauges, value)
+}
+
+// redisCollector 抓取时在读锁中读取所有redis连接池的状态
+type redisCollector struct {
+	hits       *prometheus.Desc
+	misses     *prometheus.Desc
+	timeouts   *prometheus.Desc
+	staleConns *prometheus.Desc
+	totalConns *prometheus.Desc
+	idleConns  *prometheus.Desc
+}
+
+func newRedisCollector() *redisCollector {
+	labels := []string{"service_name", "name", "mode"}
+	return &redisCollector{
+		hits:       prometheus.NewDesc("redis_pool_hits_total", "Number of times a free connection was found in the pool.", labels, nil),
+		misses:     prometheus.NewDesc("redis_pool_misses_total", "Number of times a free connection was not found in the pool.", labels, nil),
+		timeouts:   prometheus.NewDesc("redis_pool_timeouts_total", "Number of times a wait timeout occurred.", labels, nil),
+		staleConns: prometheus.NewDesc("redis_pool_stale_connections_total", "Number of stale connections removed from the pool.", labels, nil),
+		totalConns: prometheus.NewDesc("redis_pool_connections", "Number of total connections in the pool.", labels, nil),
+		idleConns:  prometheus.NewDesc("redis_pool_idle_connections", "Number of idle connections in the pool.", labels, nil),
+	}
+}
+
+func (c *redisCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.hits
+	ch <- c.misses
+	ch <- c.timeouts
+	ch <- c.staleConns
+	ch <- c.totalConns
+	ch <- c.idleConns
+}
+
+func (c *redisCollector) Collect(ch chan<- prometheus.Metric) {
+	if rds == nil {
+		return
+	}
+	rds.RLock()
+	defer rds.RUnlock()
+
+	for name, cluster := range rds.Map {
+		c.collect(ch, cluster.PoolStats(), rds.SrvName[name], name, "cluster")
+	}
+	for name, client := range rds.MapRedis {
+		c.collect(ch, client.PoolStats(), rds.SrvNameRedis[name], name, "client")
+	}
+}
+
+func (c *redisCollector) collect(ch chan<- prometheus.Metric, stats *redis.PoolStats, labels ...string) {
+	ch <- prometheus.MustNewConstMetric(c.hits, prometheus.CounterValue, float64(stats.Hits), labels...)
+	ch <- prometheus.MustNewConstMetric(c.misses, prometheus.CounterValue, float64(stats.Misses), labels...)
+	ch <- prometheus.MustNewConstMetric(c.timeouts, prometheus.CounterValue, float64(stats.Timeouts), labels...)
+	ch <- prometheus.MustNewConstMetric(c.staleConns, prometheus.CounterValue, float64(stats.StaleConns), labels...)
+	ch <- prometheus.MustNewConstMetric(c.totalConns, prometheus.GaugeValue, float64(stats.TotalConns), labels...)
+	ch <- prometheus.MustNewConstMetric(c.idleConns, prometheus.GaugeValue, float64(stats.IdleConns), labels...)
+}
+
+// RedisStats 旧的redis连接池指标，SetDeprecatedRedisGauges(false)后不再更新
+//
+// Deprecated: 使用redisCollector导出的redis_pool_*指标
 type RedisStats struct {
 	Hits     prometheus.Gauge // number of times free connection was found in the pool
 	Misses   prometheus.Gauge // number of times free connection was NOT found in the pool
@@ -76,22 +149,33 @@ func init() {
 	rsc = new(RdsCollector)
 	rsc.Cluster = make(map[string]*RedisStats)
 	rsc.Client = make(map[string]*RedisStats)
+	_ = prometheus.Register(newRedisCollector())
 	go func() {
 		for range time.Tick(15 * time.Second) {
-			redisMetrics()
+			if atomic.LoadInt32(&deprecatedRedisGauges) == 1 {
+				redisMetrics()
+			}
 		}
 	}()
 }
 
+// redisMetrics 旧指标保持原来的名字和标签，service_name标签值是redis name
 func redisMetrics() {
 	if rds == nil {
 		return
 	}
 	rds.RLock()
+	clusterStats := make(map[string]*redis.PoolStats, len(rds.Map))
+	for name, cluster := range rds.Map {
+		clusterStats[name] = cluster.PoolStats()
+	}
+	clientStats := make(map[string]*redis.PoolStats, len(rds.MapRedis))
+	for name, client := range rds.MapRedis {
+		clientStats[name] = client.PoolStats()
+	}
 	rds.RUnlock()
 
-	for srvName, cluster := range rds.Map {
-		stats := cluster.PoolStats()
+	for srvName, stats := range clusterStats {
 		if _, ok := rsc.Cluster[srvName]; !ok {
 			rsc.Cluster[srvName] = newRedisStats(srvName, true)
 		}
@@ -104,8 +188,7 @@ func redisMetrics() {
 		rsc.Cluster[srvName].TotalConns.Set(float64(stats.TotalConns))
 	}
 
-	for srvName, client := range rds.MapRedis {
-		stats := client.PoolStats()
+	for srvName, stats := range clientStats {
 		if _, ok := rsc.Client[srvName]; !ok {
 			rsc.Client[srvName] = newRedisStats(srvName, false)
 		}
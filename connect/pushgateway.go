@@ -0,0 +1,205 @@
+package connect
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/push"
+	"github.com/sirupsen/logrus"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	defaultPushInterval = time.Minute
+	pushTimeout         = 10 * time.Second
+)
+
+// pushgatewayConfig job为空时使用srvName，interval为0时只在结束时推送
+type pushgatewayConfig struct {
+	URL      string            `json:"url"`
+	Job      string            `json:"job"`
+	Interval string            `json:"interval"`
+	Grouping map[string]string `json:"grouping"`
+}
+
+type pusherOptions struct {
+	gatherer prometheus.Gatherer
+	job      string
+	grouping map[string]string
+	log      *logrus.Entry
+}
+
+type PushOption func(*pusherOptions)
+
+// PushGatherer 推送指定的registry，默认推送prometheus.DefaultGatherer
+func PushGatherer(g prometheus.Gatherer) PushOption {
+	return func(o *pusherOptions) {
+		o.gatherer = g
+	}
+}
+
+// PushJobName 覆盖配置中的job
+func PushJobName(job string) PushOption {
+	return func(o *pusherOptions) {
+		o.job = job
+	}
+}
+
+// PushGrouping 追加分组标签，覆盖配置中的同名标签
+func PushGrouping(name, value string) PushOption {
+	return func(o *pusherOptions) {
+		o.grouping[name] = value
+	}
+}
+
+func PushLog(log *logrus.Entry) PushOption {
+	return func(o *pusherOptions) {
+		o.log = log
+	}
+}
+
+// Pusher 把指标推送到pushgateway，推送失败只记录日志
+type Pusher struct {
+	pusher   *push.Pusher
+	interval time.Duration
+	log      *logrus.Entry
+
+	startOnce sync.Once
+	stopOnce  sync.Once
+	started   bool
+	stop      chan struct{}
+	done      chan struct{}
+}
+
+// NewPusher 读取srvName下的pushgateway配置
+func NewPusher(srvName string, opts ...PushOption) (*Pusher, error) {
+	conf, _, err := ConnectConfig(srvName, "pushgateway")
+	if err != nil {
+		return nil, err
+	}
+	var pushConfig pushgatewayConfig
+	if err := conf.Get(srvName, "pushgateway").Scan(&pushConfig); err != nil {
+		return nil, fmt.Errorf("pushgateway config scan error: %w", err)
+	}
+	if pushConfig.Job == "" {
+		pushConfig.Job = srvName
+	}
+	return newPusher(pushConfig, opts...)
+}
+
+func newPusher(conf pushgatewayConfig, opts ...PushOption) (*Pusher, error) {
+	options := pusherOptions{
+		gatherer: prometheus.DefaultGatherer,
+		job:      conf.Job,
+		grouping: make(map[string]string),
+		log:      logrus.NewEntry(logrus.StandardLogger()),
+	}
+	for name, value := range conf.Grouping {
+		options.grouping[name] = value
+	}
+	for _, opt := range opts {
+		opt(&options)
+	}
+	if conf.URL == "" {
+		return nil, errors.New("pushgateway url is empty")
+	}
+	if options.job == "" {
+		return nil, errors.New("pushgateway job is empty")
+	}
+
+	interval := defaultPushInterval
+	if conf.Interval != "" {
+		var err error
+		interval, err = time.ParseDuration(conf.Interval)
+		if err != nil {
+			return nil, fmt.Errorf("pushgateway interval: %w", err)
+		}
+	}
+
+	pusher := push.New(conf.URL, options.job).
+		Gatherer(options.gatherer).
+		Client(&http.Client{Timeout: pushTimeout})
+	for name, value := range options.grouping {
+		pusher = pusher.Grouping(name, value)
+	}
+	return &Pusher{
+		pusher:   pusher,
+		interval: interval,
+		log: options.log.WithFields(logrus.Fields{
+			"url": conf.URL,
+			"job": options.job,
+		}),
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}, nil
+}
+
+// Push 替换pushgateway上这个分组的所有指标，失败时记录日志并返回错误
+func (p *Pusher) Push() error {
+	err := p.pusher.Push()
+	if err != nil {
+		p.log.WithFields(logrus.Fields{
+			"error": err,
+		}).Warn("push metrics error")
+	}
+	return err
+}
+
+// Start 按配置的间隔在后台推送，需要和Stop在同一个goroutine中调用
+func (p *Pusher) Start() {
+	p.startOnce.Do(func() {
+		if p.interval <= 0 {
+			return
+		}
+		p.started = true
+		go func() {
+			defer close(p.done)
+			ticker := time.NewTicker(p.interval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-p.stop:
+					return
+				case <-ticker.C:
+					_ = p.Push()
+				}
+			}
+		}()
+	})
+}
+
+// Stop 停止后台推送并推送最后一次，多次调用只推送一次
+func (p *Pusher) Stop() error {
+	var err error
+	p.stopOnce.Do(func() {
+		close(p.stop)
+		if p.started {
+			<-p.done
+		}
+		err = p.Push()
+	})
+	return err
+}
+
+// PushJob 运行job，运行中定时推送，结束后推送最后一次。
+// 没有pushgateway配置或者推送失败时只记录日志，返回值只有job的错误。
+func PushJob(ctx context.Context, srvName string, job func(ctx context.Context) error, opts ...PushOption) error {
+	pusher, err := NewPusher(srvName, opts...)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"srvName": srvName,
+			"error":   err,
+		}).Warn("create pusher fail, metrics will not be pushed")
+		return job(ctx)
+	}
+	return runWithPusher(ctx, pusher, job)
+}
+
+func runWithPusher(ctx context.Context, pusher *Pusher, job func(ctx context.Context) error) error {
+	pusher.Start()
+	defer pusher.Stop()
+	return job(ctx)
+}
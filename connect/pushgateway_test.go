@@ -0,0 +1,116 @@
+package connect
+
+import (
+	"context"
+	"errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+type pushRecorder struct {
+	sync.Mutex
+	status   int
+	requests []string
+	bodies   []string
+}
+
+func (r *pushRecorder) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	body, _ := ioutil.ReadAll(req.Body)
+	r.Lock()
+	r.requests = append(r.requests, req.Method+" "+req.URL.Path)
+	r.bodies = append(r.bodies, string(body))
+	status := r.status
+	r.Unlock()
+	if status == 0 {
+		status = http.StatusOK
+	}
+	w.WriteHeader(status)
+}
+
+func newTestRegistry(t *testing.T) *prometheus.Registry {
+	reg := prometheus.NewRegistry()
+	counter := prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "job_processed_total",
+		Help: "Number of processed items.",
+	})
+	counter.Add(3)
+	if err := reg.Register(counter); err != nil {
+		t.Fatal(err)
+	}
+	return reg
+}
+
+func TestPusherPushOnStop(t *testing.T) {
+	recorder := &pushRecorder{}
+	server := httptest.NewServer(recorder)
+	defer server.Close()
+
+	pusher, err := newPusher(pushgatewayConfig{
+		URL:      server.URL,
+		Job:      "daily_report",
+		Interval: "0",
+		Grouping: map[string]string{"env": "test"},
+	}, PushGatherer(newTestRegistry(t)), PushGrouping("shard", "1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jobErr := errors.New("job failed")
+	err = runWithPusher(context.Background(), pusher, func(ctx context.Context) error {
+		return jobErr
+	})
+	if err != jobErr {
+		t.Fatalf("job error should be returned, got %v", err)
+	}
+
+	recorder.Lock()
+	defer recorder.Unlock()
+	if len(recorder.requests) != 1 {
+		t.Fatalf("expected 1 push, got %v", recorder.requests)
+	}
+	request := recorder.requests[0]
+	if !strings.HasPrefix(request, http.MethodPut+" /metrics/job/daily_report/") ||
+		!strings.Contains(request, "/env/test") || !strings.Contains(request, "/shard/1") {
+		t.Fatalf("unexpected push request %s", request)
+	}
+	if len(recorder.bodies[0]) == 0 {
+		t.Fatal("push body is empty")
+	}
+}
+
+func TestPusherFailureDoesNotFailJob(t *testing.T) {
+	recorder := &pushRecorder{status: http.StatusInternalServerError}
+	server := httptest.NewServer(recorder)
+	defer server.Close()
+
+	pusher, err := newPusher(pushgatewayConfig{URL: server.URL, Job: "cron", Interval: "0"}, PushGatherer(newTestRegistry(t)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = runWithPusher(context.Background(), pusher, func(ctx context.Context) error {
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("push failure should not fail the job, got %v", err)
+	}
+	if err := pusher.Stop(); err != nil {
+		t.Fatalf("second stop should not push again, got %v", err)
+	}
+}
+
+func TestNewPusherInvalidConfig(t *testing.T) {
+	if _, err := newPusher(pushgatewayConfig{Job: "cron"}); err == nil {
+		t.Fatal("missing url should fail")
+	}
+	if _, err := newPusher(pushgatewayConfig{URL: "http://127.0.0.1:9091"}); err == nil {
+		t.Fatal("missing job should fail")
+	}
+	if _, err := newPusher(pushgatewayConfig{URL: "http://127.0.0.1:9091", Job: "cron", Interval: "soon"}); err == nil {
+		t.Fatal("invalid interval should fail")
+	}
+}
@@ -17,6 +17,9 @@ type Rds struct {
 	sync.RWMutex
 	Map      map[string]*redis.ClusterClient
 	MapRedis map[string]*redis.Client
+	//redis name对应的srvName，用于指标的service_name标签
+	SrvName      map[string]string
+	SrvNameRedis map[string]string
 }
 
 type RedisConf struct {
@@ -64,6 +67,35 @@ func init() {
 	rds = new(Rds)
 	rds.Map = make(map[string]*redis.ClusterClient)
 	rds.MapRedis = make(map[string]*redis.Client)
+	rds.SrvName = make(map[string]string)
+	rds.SrvNameRedis = make(map[string]string)
+	helper.RegisterReadyCheck("redis", redisReadyCheck)
+}
+
+// redisReadyCheck ping所有已建立的redis连接
+func redisReadyCheck(ctx context.Context) error {
+	rds.RLock()
+	clusters := make(map[string]*redis.ClusterClient, len(rds.Map))
+	for name, client := range rds.Map {
+		clusters[name] = client
+	}
+	clients := make(map[string]*redis.Client, len(rds.MapRedis))
+	for name, client := range rds.MapRedis {
+		clients[name] = client
+	}
+	rds.RUnlock()
+
+	for name, client := range clusters {
+		if err := client.WithContext(ctx).Ping().Err(); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	for name, client := range clients {
+		if err := client.WithContext(ctx).Ping().Err(); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	return nil
 }
 
 func ConnectRedis(ctx context.Context, hlp *helper.Helper, srvName string, name string) (*redis.ClusterClient, error) {
@@ -125,6 +157,7 @@ func ConnectRedis(ctx context.Context, hlp *helper.Helper, srvName string, name
 				return nil, fmt.Errorf("connect redis fail: %w", err)
 			}
 			rds.Map[name] = rd
+			rds.SrvName[name] = srvName
 
 			go func() {
 				v, err := watcher.Next()
@@ -150,6 +183,7 @@ func ConnectRedis(ctx context.Context, hlp *helper.Helper, srvName string, name
 
 					rds.Lock()
 					delete(rds.Map, name)
+					delete(rds.SrvName, name)
 					rds.Unlock()
 					//10秒后，关闭旧的redis连接
 					time.Sleep(time.Duration(10) * time.Second)
@@ -216,6 +250,7 @@ func ConnectIdGenerator(ctx context.Context, hlp *helper.Helper) (*redis.Client,
 				return nil, fmt.Errorf("connect redis fail: %w", err)
 			}
 			rds.MapRedis[name] = rd
+			rds.SrvNameRedis[name] = srvName
 
 			go func() {
 				v, err := watcher.Next()
@@ -241,6 +276,7 @@ func ConnectIdGenerator(ctx context.Context, hlp *helper.Helper) (*redis.Client,
 
 					rds.Lock()
 					delete(rds.MapRedis, name)
+					delete(rds.SrvNameRedis, name)
 					rds.Unlock()
 					//10秒后，关闭旧的redis连接
 					time.Sleep(time.Duration(10) * time.Second)
@@ -305,6 +341,7 @@ func ConnectSingleRedis(ctx context.Context, hlp *helper.Helper, srvName string,
 				return nil, fmt.Errorf("connect redis fail: %w", err)
 			}
 			rds.MapRedis[name] = rd
+			rds.SrvNameRedis[name] = srvName
 
 			go func() {
 				v, err := watcher.Next()
@@ -330,6 +367,7 @@ func ConnectSingleRedis(ctx context.Context, hlp *helper.Helper, srvName string,
 
 					rds.Lock()
 					delete(rds.MapRedis, name)
+					delete(rds.SrvNameRedis, name)
 					rds.Unlock()
 					//10秒后，关闭旧的redis连接
 					time.Sleep(time.Duration(10) * time.Second)
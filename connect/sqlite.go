@@ -2,14 +2,28 @@ package connect
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"github.com/jinzhu/gorm"
 	_ "github.com/jinzhu/gorm/dialects/sqlite"
 	"github.com/lifenglin/micro-library/helper"
+	"github.com/micro/go-micro/v2/config"
 	"github.com/sirupsen/logrus"
+	"net/url"
+	"path/filepath"
+	"strconv"
 	"sync"
+	"time"
 )
 
+const (
+	SqliteMemory = "memory"
+	SqliteFile   = "file"
+)
+
+// ErrSqliteGormV2 sqlite只支持gorm v1，ConnectDBv2不能用于sqlite
+var ErrSqliteGormV2 = errors.New("sqlite does not support gorm v2")
+
 var sqlites *Sqlites
 
 type Sqlites struct {
@@ -22,35 +36,83 @@ func init() {
 	sqlites.Map = make(map[string]*gorm.DB)
 }
 
-func ConnectSqlite(ctx context.Context, hlp *helper.Helper, srvName string, name string) (*gorm.DB, error) {
-	timer := hlp.Timer
-	timer.Start("connectSqlite")
-	defer timer.End("connectSqlite")
+type sqliteConfig struct {
+	//memory为进程内共享的内存库，file为文件库
+	Mode string `json:"mode"`
+	//文件库的路径，相对路径基于helper.GetBasePath()
+	Path string `json:"path"`
+	Wal  bool   `json:"wal"`
+	//毫秒
+	BusyTimeout     int `json:"busy_timeout"`
+	ConnMaxLifetime int `json:"conn_max_lifetime"`
+	MaxIdleConns    int `json:"max_idle_conns"`
+	MaxOpenConns    int `json:"max_open_conns"`
+}
 
-	mysqlLog := hlp.MysqlLog
-	db, err := gorm.Open("sqlite3", ":memory:")
+// dsn 路径和名字中的?、&、#等字符会被转义，不会影响后面的参数
+func (c sqliteConfig) dsn(name string) string {
+	query := url.Values{}
+	if c.Mode != SqliteFile {
+		//同名的内存库在进程内共享
+		query.Set("mode", "memory")
+		query.Set("cache", "shared")
+		dsn := url.URL{Scheme: "file", Opaque: url.PathEscape(name), RawQuery: query.Encode()}
+		return dsn.String()
+	}
+
+	path := c.Path
+	if path == "" {
+		path = name + ".db"
+	}
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(helper.GetBasePath(), path)
+	}
+	//相对路径会被当成uri的host
+	if absPath, err := filepath.Abs(path); err == nil {
+		path = absPath
+	}
+	busyTimeout := c.BusyTimeout
+	if busyTimeout <= 0 {
+		busyTimeout = 5000
+	}
+	query.Set("_busy_timeout", strconv.Itoa(busyTimeout))
+	if c.Wal {
+		query.Set("_journal_mode", "WAL")
+	}
+	dsn := url.URL{Scheme: "file", Path: filepath.ToSlash(path), RawQuery: query.Encode()}
+	return dsn.String()
+}
+
+// isSqliteCluster name的master配置为sqlite时返回true，sqlite没有从库，也没有gorm v2的连接
+func isSqliteCluster(hlp *helper.Helper, srvName string, name string) (bool, error) {
+	db, _, err := connectMysql(hlp, srvName, name, ClusterMaster)
 	if err != nil {
-		mysqlLog.WithFields(logrus.Fields{
-			"error": err.Error(),
-		}).Error("connect sqlite fail")
-		return nil, fmt.Errorf("connect sqlite fail: %w", err)
+		return false, err
 	}
-	db.SingularTable(true)
-	db.BlockGlobalUpdate(false)
-	db.SetLogger(mysqlLog)
-	conf, _, err := ConnectConfig(srvName, "log")
+	return db.Dialect().GetName() == "sqlite3", nil
+}
+
+func openSqlite(name string, config sqliteConfig) (*gorm.DB, error) {
+	db, err := gorm.Open("sqlite3", config.dsn(name))
 	if err != nil {
-		//配置获取失败
-		mysqlLog.WithFields(logrus.Fields{
-			"error": err.Error(),
-		}).Error("read log config fail")
-	} else {
-		db.LogMode(conf.Get(srvName, "log", "mysql_detailed_log").Bool(false))
+		return nil, err
+	}
+	//设置连接池
+	db.DB().SetMaxIdleConns(config.MaxIdleConns)
+	db.DB().SetMaxOpenConns(config.MaxOpenConns)
+	db.DB().SetConnMaxLifetime(time.Duration(config.ConnMaxLifetime) * time.Second)
+	if config.Mode != SqliteFile {
+		//内存库在最后一个连接关闭时销毁，至少保留一个连接
+		if config.MaxIdleConns <= 0 {
+			db.DB().SetMaxIdleConns(1)
+		}
+		db.DB().SetConnMaxLifetime(0)
 	}
+	db.SingularTable(true)
+	db.BlockGlobalUpdate(false)
 	return db, nil
 }
 
-/*
 func ConnectSqlite(ctx context.Context, hlp *helper.Helper, srvName string, name string) (*gorm.DB, error) {
 	timer := hlp.Timer
 	timer.Start("connectSqlite")
@@ -58,7 +120,6 @@ func ConnectSqlite(ctx context.Context, hlp *helper.Helper, srvName string, name
 
 	sqlitesKey := name
 	mysqlLog := hlp.MysqlLog
-	var err error
 	sqlites.RLock()
 	db, ok := sqlites.Map[sqlitesKey]
 	sqlites.RUnlock()
@@ -68,7 +129,28 @@ func ConnectSqlite(ctx context.Context, hlp *helper.Helper, srvName string, name
 		if ok {
 			db = existDb
 		} else {
-			db, err = gorm.Open("sqlite3", ":memory:")
+			//没有配置时使用默认的内存库，配置存在但格式错误时返回错误
+			var config sqliteConfig
+			conf, watcher, err := newConfig(filepath.Join(srvName, "sqlite"))
+			if err != nil {
+				mysqlLog.WithFields(logrus.Fields{
+					"error": err.Error(),
+				}).Warn("read sqlite config fail, use memory")
+			} else if err := conf.Get(srvName, "sqlite", name).Scan(&config); err != nil {
+				mysqlLog.WithFields(logrus.Fields{
+					"name":  name,
+					"error": err.Error(),
+				}).Error("scan sqlite config fail")
+				sqlites.Unlock()
+				return nil, fmt.Errorf("scan sqlite config fail: %w", err)
+			}
+			mysqlLog.WithFields(logrus.Fields{
+				"srvName": srvName,
+				"name":    name,
+				"dsn":     config.dsn(name),
+			}).Info("connect sqlite info")
+
+			db, err = openSqlite(name, config)
 			if err != nil {
 				mysqlLog.WithFields(logrus.Fields{
 					"error": err.Error(),
@@ -76,23 +158,58 @@ func ConnectSqlite(ctx context.Context, hlp *helper.Helper, srvName string, name
 				sqlites.Unlock()
 				return nil, fmt.Errorf("connect sqlite fail: %w", err)
 			}
-			db.SingularTable(true)
-			db.BlockGlobalUpdate(false)
 			sqlites.Map[sqlitesKey] = db
+
+			if watcher != nil {
+				go reconnectSqlite(hlp, watcher, sqlitesKey, name)
+			}
 		}
 		sqlites.Unlock()
 	}
-	newDb := db.New()
+	newDb := db.New().Set(sqlMetaKey, newSqlMeta(srvName, name, "sqlite", mysqlClusterConfig{})).Set(sqlContextKey, ctx)
 	newDb.SetLogger(mysqlLog)
-	conf, _, err := ConnectConfig(srvName, "log")
+	if detailed, err := mysqlDetailedLog(srvName, mysqlLog); err == nil {
+		newDb.LogMode(detailed)
+	}
+	return newDb, nil
+}
+
+// reconnectSqlite 配置更新后释放已有的db对象，10秒后关闭连接
+func reconnectSqlite(hlp *helper.Helper, watcher config.Watcher, sqlitesKey string, name string) {
+	mysqlLog := hlp.MysqlLog
+	v, err := watcher.Next()
 	if err != nil {
-		//配置获取失败
 		mysqlLog.WithFields(logrus.Fields{
-			"error": err.Error(),
-		}).Error("read log config fail")
+			"error": err,
+			"name":  name,
+			"file":  string(v.Bytes()),
+		}).Warn("reconnect sqlite")
+		return
+	}
+	mysqlLog.WithFields(logrus.Fields{
+		"name": name,
+		"file": string(v.Bytes()),
+	}).Info("reconnect sqlite")
+
+	//配置更新了，释放已有的db对象，关闭连接
+	sqlites.Lock()
+	db, ok := sqlites.Map[sqlitesKey]
+	delete(sqlites.Map, sqlitesKey)
+	sqlites.Unlock()
+	if !ok {
+		return
+	}
+	//10秒后，关闭旧的数据库连接
+	time.Sleep(time.Duration(10) * time.Second)
+	err = db.Close()
+	if err == nil {
+		mysqlLog.WithFields(logrus.Fields{
+			"name": name,
+		}).Info("close sqlite")
 	} else {
-		newDb.LogMode(conf.Get(srvName, "log", "mysql_detailed_log").Bool(false))
+		mysqlLog.WithFields(logrus.Fields{
+			"error": err,
+			"name":  name,
+		}).Warn("close sqlite error")
 	}
-	return newDb, nil
 }
-*/
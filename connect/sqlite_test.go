@@ -0,0 +1,67 @@
+package connect
+
+import (
+	"context"
+	"net/url"
+	"testing"
+)
+
+func TestSqliteDsnEscapesPath(t *testing.T) {
+	config := sqliteConfig{Mode: SqliteFile, Path: "/data/a?mode=memory&b#c.db", Wal: true}
+	dsn, err := url.Parse(config.dsn("test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dsn.Path != config.Path {
+		t.Errorf("path = %q, want %q", dsn.Path, config.Path)
+	}
+	query := dsn.Query()
+	if query.Get("mode") != "" || query.Get("_busy_timeout") != "5000" || query.Get("_journal_mode") != "WAL" {
+		t.Errorf("unexpected query %v", query)
+	}
+}
+
+func TestSqliteDsnMemory(t *testing.T) {
+	dsn, err := url.Parse(sqliteConfig{}.dsn("a&b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := dsn.Query()
+	if query.Get("mode") != "memory" || query.Get("cache") != "shared" || len(query) != 2 {
+		t.Errorf("unexpected query %v", query)
+	}
+}
+
+func TestConnectSqliteWithoutConfig(t *testing.T) {
+	name := "test_sqlite_default"
+	t.Cleanup(func() {
+		sqlites.Lock()
+		db := sqlites.Map[name]
+		delete(sqlites.Map, name)
+		sqlites.Unlock()
+		if db != nil {
+			db.Close()
+		}
+	})
+
+	db, err := ConnectSqlite(context.Background(), newTestHelper(), testSrvName, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Exec("CREATE TABLE test_item (id INTEGER PRIMARY KEY)").Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Create(&testItem{Id: 1}).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	//同名的内存库在进程内共享
+	other, err := ConnectSqlite(context.Background(), newTestHelper(), testSrvName, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var count int
+	if err := other.Table("test_item").Count(&count).Error; err != nil || count != 1 {
+		t.Fatalf("count = %d, %v", count, err)
+	}
+}
@@ -0,0 +1,248 @@
+package helper
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/sirupsen/logrus"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"regexp"
+	"sync"
+	"time"
+)
+
+const (
+	//默认只监听本机，对外提供服务时需要配置addr和pprof_username、pprof_password
+	DefaultAdminAddr  = "127.0.0.1:6060"
+	readyCheckTimeout = 3 * time.Second
+)
+
+// AdminConfig pprof和/debug/config在设置了用户名密码时需要basic auth，
+// 没有设置时/debug/config只允许本机访问
+type AdminConfig struct {
+	Addr          string `json:"addr"`
+	PprofUsername string `json:"pprof_username"`
+	PprofPassword string `json:"pprof_password"`
+}
+
+// ReadyCheck 返回错误时/readyz返回503
+type ReadyCheck func(ctx context.Context) error
+
+var (
+	readyChecks sync.Map
+	configDumps sync.Map
+
+	//配置项名称包含这些词时整个值被替换
+	secretKeyPattern = regexp.MustCompile(`(?i)(password|passwd|secret|token|credential|private_key|access_key|dsn)`)
+	//mysql dsn中的user:password@tcp(，密码中可以有@和/
+	secretDSNPattern = regexp.MustCompile(`([^:/@\s]+):(.*)@((?:tcp|tcp6|udp|unix)?\()`)
+	//uri中的user:password@，密码可以为空
+	secretURIPattern = regexp.MustCompile(`(://[^:/@\s]*):([^/\s]*)@`)
+	//其他形式的user:password@
+	secretUserinfoPattern = regexp.MustCompile(`([^:/@\s]+):([^@/\s]*)@`)
+)
+
+const maskedValue = "******"
+
+// RegisterReadyCheck 注册就绪检查，相同名字会覆盖
+func RegisterReadyCheck(name string, check ReadyCheck) {
+	readyChecks.Store(name, check)
+}
+
+// RegisterConfigDump 注册/debug/config中name下输出的配置，输出前会屏蔽密码等敏感字段
+func RegisterConfigDump(name string, dump func() interface{}) {
+	configDumps.Store(name, dump)
+}
+
+// NewAdminHandler 返回包含/metrics、/healthz、/readyz、/debug/pprof/和/debug/config的handler
+func NewAdminHandler(conf AdminConfig) http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte("ok"))
+	})
+	mux.HandleFunc("/readyz", serveReady)
+
+	debug := http.NewServeMux()
+	debug.HandleFunc("/debug/pprof/", pprof.Index)
+	debug.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	debug.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	debug.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	debug.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	if conf.PprofUsername == "" && conf.PprofPassword == "" {
+		debug.Handle("/debug/config", localOnly(http.HandlerFunc(serveConfig)))
+	} else {
+		debug.HandleFunc("/debug/config", serveConfig)
+	}
+	mux.Handle("/debug/", basicAuth(conf.PprofUsername, conf.PprofPassword, debug))
+	return mux
+}
+
+// StartAdminServer 监听失败时直接返回错误，监听成功后在后台提供服务，调用方负责Shutdown
+func StartAdminServer(conf AdminConfig) (*http.Server, error) {
+	if conf.Addr == "" {
+		conf.Addr = DefaultAdminAddr
+	}
+	listener, err := net.Listen("tcp", conf.Addr)
+	if err != nil {
+		return nil, err
+	}
+	server := &http.Server{
+		Addr:    conf.Addr,
+		Handler: NewAdminHandler(conf),
+	}
+	go func() {
+		err := server.Serve(listener)
+		if err != nil && err != http.ErrServerClosed {
+			logrus.WithFields(logrus.Fields{
+				"addr":  conf.Addr,
+				"error": err,
+			}).Error("admin server stopped")
+		}
+	}()
+	return server, nil
+}
+
+func basicAuth(username, password string, next http.Handler) http.Handler {
+	if username == "" && password == "" {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, pass, ok := r.BasicAuth()
+		if !ok ||
+			subtle.ConstantTimeCompare([]byte(user), []byte(username)) != 1 ||
+			subtle.ConstantTimeCompare([]byte(pass), []byte(password)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="admin"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// localOnly 只允许来自本机的请求
+func localOnly(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			host = r.RemoteAddr
+		}
+		if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// serveReady 并发执行所有检查，返回每个检查的结果
+func serveReady(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), readyCheckTimeout)
+	defer cancel()
+
+	var (
+		lock    sync.Mutex
+		wg      sync.WaitGroup
+		results = make(map[string]string)
+		ready   = true
+	)
+	readyChecks.Range(func(key, value interface{}) bool {
+		wg.Add(1)
+		go func(name string, check ReadyCheck) {
+			defer wg.Done()
+			err := runReadyCheck(ctx, check)
+			lock.Lock()
+			defer lock.Unlock()
+			if err != nil {
+				ready = false
+				results[name] = err.Error()
+			} else {
+				results[name] = "ok"
+			}
+		}(key.(string), value.(ReadyCheck))
+		return true
+	})
+	wg.Wait()
+
+	status := http.StatusOK
+	if !ready {
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(w, status, results)
+}
+
+// runReadyCheck 检查不响应ctx时也在超时后返回
+func runReadyCheck(ctx context.Context, check ReadyCheck) (err error) {
+	done := make(chan error, 1)
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				done <- errors.New("ready check panic")
+			}
+		}()
+		done <- check(ctx)
+	}()
+	select {
+	case err = <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func serveConfig(w http.ResponseWriter, r *http.Request) {
+	dumps := make(map[string]interface{})
+	configDumps.Range(func(key, value interface{}) bool {
+		dumps[key.(string)] = MaskSecrets(value.(func() interface{})())
+		return true
+	})
+	writeJSON(w, http.StatusOK, dumps)
+}
+
+// MaskSecrets 返回屏蔽了敏感字段的副本，v需要是json解码得到的map、slice或基本类型
+func MaskSecrets(v interface{}) interface{} {
+	switch value := v.(type) {
+	case map[string]interface{}:
+		masked := make(map[string]interface{}, len(value))
+		for k, item := range value {
+			if secretKeyPattern.MatchString(k) {
+				if s, ok := item.(string); ok && s == "" {
+					masked[k] = s
+				} else {
+					masked[k] = maskedValue
+				}
+				continue
+			}
+			masked[k] = MaskSecrets(item)
+		}
+		return masked
+	case []interface{}:
+		masked := make([]interface{}, len(value))
+		for i, item := range value {
+			masked[i] = MaskSecrets(item)
+		}
+		return masked
+	case string:
+		value = secretDSNPattern.ReplaceAllString(value, "${1}:"+maskedValue+"@${3}")
+		value = secretURIPattern.ReplaceAllString(value, "${1}:"+maskedValue+"@")
+		return secretUserinfoPattern.ReplaceAllString(value, "${1}:"+maskedValue+"@")
+	default:
+		return v
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, _ = w.Write(data)
+}
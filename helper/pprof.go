@@ -1,13 +1,22 @@
 package helper
 
 import (
+	"github.com/sirupsen/logrus"
 	"net/http"
 	_ "net/http/pprof"
 )
 
+// PprofHttpListen 在0.0.0.0:6060上用http.DefaultServeMux提供/debug/pprof和其他注册在DefaultServeMux上的handler。
+// 需要/metrics、/readyz和/debug/config时使用StartAdminServer或connect.StartAdmin
 func PprofHttpListen() {
 	go func() {
 		ip := "0.0.0.0:6060"
-		http.ListenAndServe(ip, nil)
+		err := http.ListenAndServe(ip, nil)
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"addr":  ip,
+				"error": err,
+			}).Error("pprof listen fail")
+		}
 	}()
 }
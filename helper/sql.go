@@ -0,0 +1,25 @@
+package helper
+
+import (
+	"github.com/percona/go-mysql/query"
+	"regexp"
+)
+
+var (
+	sqlNumberSuffix = regexp.MustCompile("([a-zA-Z_]+)(?:\\d+)")
+	//in (?, ?, ?)这样的参数列表，长度不同的列表归为同一个模板
+	sqlPlaceholderList = regexp.MustCompile(`\(\s*\?(?:\s*,\s*\?)*\s*\)|\(\?\+\)`)
+	//批量插入的多组values
+	sqlRepeatedList = regexp.MustCompile(`\(\?\+\)(?:\s*,\s*\(\?\+\))+`)
+)
+
+// SqlTemplate 把sql转换成模板，分表的表名后缀数字也会被替换掉
+func SqlTemplate(sql string) string {
+	return sqlNumberSuffix.ReplaceAllString(query.Fingerprint(sql), "${1}xxx")
+}
+
+// SqlFingerprint 在SqlTemplate的基础上把参数列表和多组values合并为(?+)，用于慢sql统计
+func SqlFingerprint(sql string) string {
+	fingerprint := sqlPlaceholderList.ReplaceAllString(SqlTemplate(sql), "(?+)")
+	return sqlRepeatedList.ReplaceAllString(fingerprint, "(?+)")
+}
@@ -0,0 +1,26 @@
+package helper
+
+import "testing"
+
+func TestSqlFingerprintCollapsesLists(t *testing.T) {
+	cases := [][2]string{
+		{"select * from user where id in (1, 2, 3)", "select * from user where id in (4)"},
+		{"select * from user where id in (?,?,?)", "select * from user where id in (?)"},
+		{"insert into user (id, name) values (1, 'a'), (2, 'b')", "insert into user (id, name) values (3, 'c')"},
+		{"select * from user_01 where id = 1", "select * from user_02 where id = 2"},
+	}
+	for _, c := range cases {
+		if a, b := SqlFingerprint(c[0]), SqlFingerprint(c[1]); a != b {
+			t.Errorf("fingerprint mismatch: %q != %q", a, b)
+		}
+	}
+}
+
+func TestSqlTemplateKeepsLists(t *testing.T) {
+	if a, b := SqlTemplate("select * from user where id in (?,?,?)"), SqlTemplate("select * from user where id in (?)"); a == b {
+		t.Errorf("template should keep the placeholder list: %q", a)
+	}
+	if tpl := SqlTemplate("select * from user_01 where id = 1"); tpl != "select * from user_xxx where id = ?" {
+		t.Errorf("template = %q", tpl)
+	}
+}
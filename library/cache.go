@@ -24,12 +24,14 @@ func GetCache(ctx context.Context, hlp *helper.Helper, srvName string, name stri
 	log := hlp.RedisLog
 	var bytes []byte
 	if localCache {
+		start := time.Now()
 		bigCache, err := connect.ConnectBigcache()
 		if err == nil {
 			bytes, err = bigCache.Get(filepath.Join(srvName, name, redisKey))
 			if err == nil {
 				err := json.Unmarshal(bytes, value)
 				if err == nil {
+					recordCache(ctx, srvName, name, CacheTierLocal, CacheHit, start)
 					log.WithFields(logrus.Fields{
 						"redisKey": redisKey,
 						"value":    value,
@@ -37,15 +39,23 @@ func GetCache(ctx context.Context, hlp *helper.Helper, srvName string, name stri
 					}).Trace("all hit local cache")
 					return nil
 				}
+				recordCache(ctx, srvName, name, CacheTierLocal, CacheDecodeError, start)
+			} else {
+				recordCache(ctx, srvName, name, CacheTierLocal, localCacheOutcome(err), start)
 			}
+		} else {
+			recordCache(ctx, srvName, name, CacheTierLocal, CacheError, start)
 		}
 	}
+	start := time.Now()
 	redis, err := connect.ConnectRedis(ctx, hlp, srvName, name)
 	if err != nil {
+		recordCache(ctx, srvName, name, CacheTierRedis, CacheError, start)
 		return err
 	}
 	bytes, err = redis.Get(redisKey).Bytes()
 	if err != nil {
+		recordCache(ctx, srvName, name, CacheTierRedis, redisCacheOutcome(err), start)
 		if err.Error() == "redis: nil" {
 			//缓存未命中，从数据库中获取数据
 			log.WithFields(logrus.Fields{
@@ -66,6 +76,7 @@ func GetCache(ctx context.Context, hlp *helper.Helper, srvName string, name stri
 	if len(bytes) > 0 {
 		err := json.Unmarshal(bytes, value)
 		if err != nil {
+			recordCache(ctx, srvName, name, CacheTierRedis, CacheDecodeError, start)
 			log.WithFields(logrus.Fields{
 				"error":    err,
 				"redisKey": redisKey,
@@ -73,6 +84,7 @@ func GetCache(ctx context.Context, hlp *helper.Helper, srvName string, name stri
 			}).Warn("json unmarshal error")
 			return err
 		}
+		recordCache(ctx, srvName, name, CacheTierRedis, CacheHit, start)
 		log.WithFields(logrus.Fields{
 			"redisKey": redisKey,
 			"value":    value,
@@ -94,14 +106,17 @@ func GetCache(ctx context.Context, hlp *helper.Helper, srvName string, name stri
 		}
 		return nil
 	}
+	recordCache(ctx, srvName, name, CacheTierRedis, CacheMiss, start)
 	return errors.New("redis: nil")
 }
 
 func GetLocalCache(ctx context.Context, hlp *helper.Helper, srvName string, name string, redisKey string, value interface{}) (err error) {
 	log := hlp.RedisLog
+	start := time.Now()
 
 	bigCache, err := connect.ConnectBigcache()
 	if nil != err {
+		recordCache(ctx, srvName, name, CacheTierLocal, CacheError, start)
 		log.WithFields(logrus.Fields{
 			"err": 		err,
 		}).Warn("ConnectBigcache fail")
@@ -110,6 +125,7 @@ func GetLocalCache(ctx context.Context, hlp *helper.Helper, srvName string, name
 
 	bytes, err := bigCache.Get(filepath.Join(srvName, name, redisKey))
 	if nil != err {
+		recordCache(ctx, srvName, name, CacheTierLocal, localCacheOutcome(err), start)
 		if "Entry not found" == err.Error() {
 			log.WithFields(logrus.Fields{
 				"redisKey": redisKey,
@@ -126,6 +142,7 @@ func GetLocalCache(ctx context.Context, hlp *helper.Helper, srvName string, name
 
 	err = json.Unmarshal(bytes, value)
 	if nil != err {
+		recordCache(ctx, srvName, name, CacheTierLocal, CacheDecodeError, start)
 		log.WithFields(logrus.Fields{
 			"redisKey": redisKey,
 			"bytes":    string(bytes),
@@ -134,6 +151,7 @@ func GetLocalCache(ctx context.Context, hlp *helper.Helper, srvName string, name
 		return err
 	}
 
+	recordCache(ctx, srvName, name, CacheTierLocal, CacheHit, start)
 	log.WithFields(logrus.Fields{
 		"redisKey": redisKey,
 		"value":    value,
@@ -177,9 +195,16 @@ func MgetCache(ctx context.Context, hlp *helper.Helper, srvName string, name str
 func mgetRedisCache(ctx context.Context, hlp *helper.Helper, srvName string, name string, redisKey []string, getIndex []int, slice *reflect.Value, localCache bool) (noCacheIndex []int, err error) {
 	log := hlp.RedisLog
 	noCacheIndex = make([]int, 0)
+	start := time.Now()
+	getCount := len(getIndex)
+	if 0 == getCount {
+		getCount = len(redisKey)
+	}
 
 	redis, err := connect.ConnectRedis(ctx, hlp, srvName, name)
 	if err != nil {
+		countCache(ctx, srvName, name, CacheTierRedis, CacheError, getCount)
+		observeCacheLatency(ctx, srvName, name, CacheTierRedis, start)
 		return getIndex, err
 	}
 
@@ -197,11 +222,19 @@ func mgetRedisCache(ctx context.Context, hlp *helper.Helper, srvName string, nam
 
 	// 从pipeline中取出结果
 	cmders, err := pipeline.Exec()
+	observeCacheLatency(ctx, srvName, name, CacheTierRedis, start)
 	if nil != err {
 		if err.Error() != "redis: nil" {
+			countCache(ctx, srvName, name, CacheTierRedis, CacheError, getCount)
 			return nil, err
 		}
 	}
+	outcomes := make(map[string]int)
+	defer func() {
+		for outcome, n := range outcomes {
+			countCache(ctx, srvName, name, CacheTierRedis, outcome, n)
+		}
+	}()
 
 	//  取返回值
 	for index, cmder := range cmders {
@@ -215,6 +248,7 @@ func mgetRedisCache(ctx context.Context, hlp *helper.Helper, srvName string, nam
 		// 取出数据
 		bytes, err := cmd.Bytes()
 		if nil != err {
+			outcomes[redisCacheOutcome(err)]++
 			if err.Error() == "redis: nil" {
 				//缓存未命中，从数据库中获取数据
 				log.WithFields(logrus.Fields{
@@ -235,6 +269,7 @@ func mgetRedisCache(ctx context.Context, hlp *helper.Helper, srvName string, nam
 
 		err = json.Unmarshal(bytes, slice.Index(originIndex).Interface())
 		if nil != err {
+			outcomes[CacheDecodeError]++
 			log.WithFields(logrus.Fields{
 				"error":    err,
 				"redisKey": redisKey[originIndex],
@@ -244,6 +279,7 @@ func mgetRedisCache(ctx context.Context, hlp *helper.Helper, srvName string, nam
 			continue
 		}
 
+		outcomes[CacheHit]++
 		log.WithFields(logrus.Fields{
 			"redisKey": redisKey[originIndex],
 			"value":    slice.Index(originIndex).Interface(),
@@ -282,12 +318,14 @@ func GetCacheNum(ctx context.Context, hlp *helper.Helper, srvName string, name s
 	log := hlp.RedisLog
 	var bytes []byte
 	if localCache {
+		start := time.Now()
 		bigCache, err := connect.ConnectBigcache()
 		if err == nil {
 			bytes, err = bigCache.Get(filepath.Join(srvName, name, redisKey))
 			if err == nil {
 				int64, err := strconv.ParseInt(string(bytes), 10, 64)
 				if err == nil {
+					recordCache(ctx, srvName, name, CacheTierLocal, CacheHit, start)
 					log.WithFields(logrus.Fields{
 						"redisKey": redisKey,
 						"value":    int64,
@@ -295,15 +333,27 @@ func GetCacheNum(ctx context.Context, hlp *helper.Helper, srvName string, name s
 					}).Trace("all hit local cache")
 					return int64, nil
 				}
+				recordCache(ctx, srvName, name, CacheTierLocal, CacheDecodeError, start)
+			} else {
+				recordCache(ctx, srvName, name, CacheTierLocal, localCacheOutcome(err), start)
 			}
+		} else {
+			recordCache(ctx, srvName, name, CacheTierLocal, CacheError, start)
 		}
 	}
 
+	start := time.Now()
 	redis, err := connect.ConnectRedis(ctx, hlp, srvName, name)
 	if err != nil {
+		recordCache(ctx, srvName, name, CacheTierRedis, CacheError, start)
 		return num, err
 	}
 	num, err = redis.Get(redisKey).Int64()
+	if err != nil {
+		recordCache(ctx, srvName, name, CacheTierRedis, redisCacheOutcome(err), start)
+	} else {
+		recordCache(ctx, srvName, name, CacheTierRedis, CacheHit, start)
+	}
 	if err != nil && err.Error() != "redis: nil" {
 		log.WithFields(logrus.Fields{
 			"error":    err,
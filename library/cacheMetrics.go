@@ -0,0 +1,91 @@
+package library
+
+import (
+	"context"
+	"github.com/prometheus/client_golang/prometheus"
+	"strconv"
+	"time"
+)
+
+const (
+	CacheTierLocal = "local"
+	CacheTierRedis = "redis"
+
+	CacheHit         = "hit"
+	CacheMiss        = "miss"
+	CacheError       = "error"
+	CacheDecodeError = "decode_error"
+
+	//没有用WithCacheNamespace设置时的namespace
+	DefaultCacheNamespace = "default"
+)
+
+type cacheNamespaceKey struct{}
+
+var (
+	cacheRequests *prometheus.CounterVec
+	cacheDuration *prometheus.HistogramVec
+)
+
+func init() {
+	cacheRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "cache_requests_total",
+		Help: "Number of cache lookups by tier and outcome.",
+	}, []string{"service_name", "name", "namespace", "tier", "outcome"})
+	cacheDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "cache_duration_seconds",
+		Help:    "Latency of cache lookups, a batch lookup is observed once.",
+		Buckets: []float64{0.0001, 0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5},
+	}, []string{"service_name", "name", "namespace", "tier"})
+	_ = prometheus.Register(cacheRequests)
+	_ = prometheus.Register(cacheDuration)
+}
+
+// WithCacheNamespace 设置缓存指标的namespace标签，同一类数据使用同一个namespace，不要使用完整的key
+func WithCacheNamespace(ctx context.Context, namespace string) context.Context {
+	return context.WithValue(ctx, cacheNamespaceKey{}, namespace)
+}
+
+func CacheNamespace(ctx context.Context) string {
+	if namespace, ok := ctx.Value(cacheNamespaceKey{}).(string); ok && namespace != "" {
+		return namespace
+	}
+	return DefaultCacheNamespace
+}
+
+// countCache n为这次查询中结果为outcome的key的数量
+func countCache(ctx context.Context, srvName string, name string, tier string, outcome string, n int) {
+	if n <= 0 {
+		return
+	}
+	cacheRequests.WithLabelValues(srvName, name, CacheNamespace(ctx), tier, outcome).Add(float64(n))
+}
+
+func observeCacheLatency(ctx context.Context, srvName string, name string, tier string, start time.Time) {
+	cacheDuration.WithLabelValues(srvName, name, CacheNamespace(ctx), tier).Observe(time.Since(start).Seconds())
+}
+
+// recordCache 记录单个key的查询结果和耗时
+func recordCache(ctx context.Context, srvName string, name string, tier string, outcome string, start time.Time) {
+	countCache(ctx, srvName, name, tier, outcome, 1)
+	observeCacheLatency(ctx, srvName, name, tier, start)
+}
+
+// localCacheOutcome bigcache未命中时返回Entry not found
+func localCacheOutcome(err error) string {
+	if err.Error() == "Entry not found" {
+		return CacheMiss
+	}
+	return CacheError
+}
+
+// redisCacheOutcome 数字的解析错误算作decode_error
+func redisCacheOutcome(err error) string {
+	if err.Error() == "redis: nil" {
+		return CacheMiss
+	}
+	if _, ok := err.(*strconv.NumError); ok {
+		return CacheDecodeError
+	}
+	return CacheError
+}
@@ -0,0 +1,78 @@
+package library
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/go-redis/redis"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCacheNamespace(t *testing.T) {
+	if namespace := CacheNamespace(context.Background()); namespace != DefaultCacheNamespace {
+		t.Errorf("namespace = %q", namespace)
+	}
+	if namespace := CacheNamespace(WithCacheNamespace(context.Background(), "")); namespace != DefaultCacheNamespace {
+		t.Errorf("empty namespace = %q", namespace)
+	}
+	if namespace := CacheNamespace(WithCacheNamespace(context.Background(), "user")); namespace != "user" {
+		t.Errorf("namespace = %q", namespace)
+	}
+}
+
+func TestCacheMetricsCounters(t *testing.T) {
+	user := WithCacheNamespace(context.Background(), "user")
+	start := time.Now()
+	recordCache(user, "cache_test", "default", CacheTierLocal, CacheHit, start)
+	recordCache(user, "cache_test", "default", CacheTierLocal, CacheMiss, start)
+	recordCache(user, "cache_test", "default", CacheTierRedis, CacheHit, start)
+	recordCache(context.Background(), "cache_test", "default", CacheTierRedis, CacheError, start)
+	//批量查询按key的数量计数，数量为0时不计数
+	countCache(user, "cache_test", "default", CacheTierRedis, CacheMiss, 3)
+	countCache(user, "cache_test", "default", CacheTierRedis, CacheDecodeError, 0)
+
+	if v := testutil.ToFloat64(cacheRequests.WithLabelValues("cache_test", "default", "user", CacheTierRedis, CacheMiss)); v != 3 {
+		t.Errorf("redis miss = %v", v)
+	}
+	expected := `
+# HELP cache_requests_total Number of cache lookups by tier and outcome.
+# TYPE cache_requests_total counter
+cache_requests_total{name="default",namespace="default",outcome="error",service_name="cache_test",tier="redis"} 1
+cache_requests_total{name="default",namespace="user",outcome="hit",service_name="cache_test",tier="local"} 1
+cache_requests_total{name="default",namespace="user",outcome="hit",service_name="cache_test",tier="redis"} 1
+cache_requests_total{name="default",namespace="user",outcome="miss",service_name="cache_test",tier="local"} 1
+cache_requests_total{name="default",namespace="user",outcome="miss",service_name="cache_test",tier="redis"} 3
+`
+	if err := testutil.CollectAndCompare(cacheRequests, strings.NewReader(expected), "cache_requests_total"); err != nil {
+		t.Fatal(err)
+	}
+
+	//耗时按namespace和tier记录，countCache不记录耗时
+	if n := testutil.CollectAndCount(cacheDuration); n != 3 {
+		t.Errorf("duration series = %d, want 3", n)
+	}
+}
+
+func TestCacheOutcome(t *testing.T) {
+	_, numErr := strconv.ParseInt("x", 10, 64)
+	testData := []struct {
+		name    string
+		outcome string
+		want    string
+	}{
+		{"local miss", localCacheOutcome(errors.New("Entry not found")), CacheMiss},
+		{"local error", localCacheOutcome(errors.New("bigcache closed")), CacheError},
+		{"redis miss", redisCacheOutcome(redis.Nil), CacheMiss},
+		{"redis decode error", redisCacheOutcome(numErr), CacheDecodeError},
+		{"redis error", redisCacheOutcome(fmt.Errorf("dial tcp: %w", errors.New("connection refused"))), CacheError},
+	}
+	for _, d := range testData {
+		if d.outcome != d.want {
+			t.Errorf("%s: outcome = %s, want %s", d.name, d.outcome, d.want)
+		}
+	}
+}
@@ -0,0 +1,215 @@
+package library
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/golang/protobuf/proto"
+	"github.com/lifenglin/micro-library/connect"
+	jsonCodec "github.com/lifenglin/micro-library/plugins/codec/json"
+	"github.com/segmentio/kafka-go"
+	"google.golang.org/grpc/encoding"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	HeaderEventVersion = "x-event-version"
+	HeaderEventTime    = "x-event-time"
+	HeaderProducer     = "x-producer"
+	HeaderContentType  = "content-type"
+
+	ContentTypeJSON     = "application/json"
+	ContentTypeProtobuf = "application/protobuf"
+)
+
+var (
+	ErrUnknownEventType    = errors.New("unknown event type")
+	ErrUnknownEventVersion = errors.New("unknown event version")
+	ErrUnknownContentType  = errors.New("unknown content type")
+)
+
+var messageCodecs sync.Map
+
+func init() {
+	RegisterMessageCodec(ContentTypeJSON, jsonCodec.NewCodec())
+	RegisterMessageCodec(ContentTypeProtobuf, protobufCodec{})
+}
+
+// RegisterMessageCodec 注册消息体的编解码器，按content-type消息头选择
+func RegisterMessageCodec(contentType string, codec encoding.Codec) {
+	messageCodecs.Store(contentType, codec)
+}
+
+func getMessageCodec(contentType string) (encoding.Codec, error) {
+	if contentType == "" {
+		contentType = ContentTypeJSON
+	}
+	codec, ok := messageCodecs.Load(contentType)
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownContentType, contentType)
+	}
+	return codec.(encoding.Codec), nil
+}
+
+type protobufCodec struct{}
+
+func (protobufCodec) Marshal(v interface{}) ([]byte, error) {
+	pb, ok := v.(proto.Message)
+	if !ok {
+		return nil, fmt.Errorf("%T is not proto.Message", v)
+	}
+	return proto.Marshal(pb)
+}
+
+func (protobufCodec) Unmarshal(data []byte, v interface{}) error {
+	pb, ok := v.(proto.Message)
+	if !ok {
+		return fmt.Errorf("%T is not proto.Message", v)
+	}
+	return proto.Unmarshal(data, pb)
+}
+
+func (protobufCodec) Name() string {
+	return "protobuf"
+}
+
+// Envelope 消息的元信息放在kafka消息头里，消息体只有Payload编码后的内容
+type Envelope struct {
+	EventType string
+	Version   int
+	Timestamp time.Time
+	Producer  string
+	Payload   interface{}
+}
+
+// EncodeEnvelope 把env编码为kafka消息，contentType为空时使用json
+func EncodeEnvelope(env Envelope, key []byte, contentType string) (kafka.Message, error) {
+	if env.EventType == "" {
+		return kafka.Message{}, errors.New("event type is empty")
+	}
+	if contentType == "" {
+		contentType = ContentTypeJSON
+	}
+	codec, err := getMessageCodec(contentType)
+	if err != nil {
+		return kafka.Message{}, err
+	}
+	value, err := codec.Marshal(env.Payload)
+	if err != nil {
+		return kafka.Message{}, fmt.Errorf("encode %s payload: %w", env.EventType, err)
+	}
+	if env.Timestamp.IsZero() {
+		env.Timestamp = time.Now()
+	}
+
+	msg := kafka.Message{Key: key, Value: value, Time: env.Timestamp}
+	connect.SetKafkaHeader(&msg, connect.HeaderMessageType, []byte(env.EventType))
+	connect.SetKafkaHeader(&msg, HeaderEventVersion, []byte(strconv.Itoa(env.Version)))
+	connect.SetKafkaHeader(&msg, HeaderEventTime, []byte(strconv.FormatInt(env.Timestamp.UnixNano()/int64(time.Millisecond), 10)))
+	connect.SetKafkaHeader(&msg, HeaderProducer, []byte(env.Producer))
+	connect.SetKafkaHeader(&msg, HeaderContentType, []byte(contentType))
+	return msg, nil
+}
+
+// PublishEvent 编码env并写入topic，Producer为空时使用srvName
+func PublishEvent(ctx context.Context, srvName string, kafkaName string, topic string, key []byte, env Envelope, contentType string) error {
+	if env.Producer == "" {
+		env.Producer = srvName
+	}
+	msg, err := EncodeEnvelope(env, key, contentType)
+	if err != nil {
+		return err
+	}
+	return connect.ProduceKafka(ctx, srvName, kafkaName, topic, env.EventType, msg)
+}
+
+// EventHandler env.Payload为注册时newPayload返回的对象
+type EventHandler func(ctx context.Context, env Envelope) error
+
+type eventRoute struct {
+	newPayload func() interface{}
+	handler    EventHandler
+}
+
+// EventDispatcher 按事件类型和版本把消息分发到注册的handler，Dispatch可以直接作为connect.RunConsumer的handler
+type EventDispatcher struct {
+	sync.RWMutex
+	routes map[string]map[int]eventRoute
+}
+
+func NewEventDispatcher() *EventDispatcher {
+	return &EventDispatcher{
+		routes: make(map[string]map[int]eventRoute),
+	}
+}
+
+// Handle 注册eventType的version版本，newPayload返回用于解码消息体的指针
+func (d *EventDispatcher) Handle(eventType string, version int, newPayload func() interface{}, handler EventHandler) {
+	d.Lock()
+	defer d.Unlock()
+	versions, ok := d.routes[eventType]
+	if !ok {
+		versions = make(map[int]eventRoute)
+		d.routes[eventType] = versions
+	}
+	versions[version] = eventRoute{newPayload: newPayload, handler: handler}
+}
+
+// Dispatch 未注册的事件类型、版本和无法解码的消息返回connect.PermanentError，不会重试
+func (d *EventDispatcher) Dispatch(ctx context.Context, msg kafka.Message) error {
+	eventType := connect.KafkaMessageType(msg)
+	versionBytes, _ := connect.GetKafkaHeader(msg, HeaderEventVersion)
+	version, err := strconv.Atoi(string(versionBytes))
+	if err != nil {
+		return connect.PermanentError(fmt.Errorf("%w: %q", ErrUnknownEventVersion, versionBytes))
+	}
+
+	d.RLock()
+	versions, ok := d.routes[eventType]
+	var route eventRoute
+	if ok {
+		route, ok = versions[version]
+	}
+	d.RUnlock()
+	if versions == nil {
+		return connect.PermanentError(fmt.Errorf("%w: %s", ErrUnknownEventType, eventType))
+	}
+	if !ok {
+		return connect.PermanentError(fmt.Errorf("%w: %s v%d", ErrUnknownEventVersion, eventType, version))
+	}
+
+	env, err := decodeEnvelope(msg, eventType, version, route.newPayload())
+	if err != nil {
+		return connect.PermanentError(err)
+	}
+	return route.handler(ctx, env)
+}
+
+func decodeEnvelope(msg kafka.Message, eventType string, version int, payload interface{}) (Envelope, error) {
+	env := Envelope{
+		EventType: eventType,
+		Version:   version,
+		Timestamp: msg.Time,
+		Payload:   payload,
+	}
+	if producer, ok := connect.GetKafkaHeader(msg, HeaderProducer); ok {
+		env.Producer = string(producer)
+	}
+	if ms, ok := connect.GetKafkaHeader(msg, HeaderEventTime); ok {
+		if unixMs, err := strconv.ParseInt(string(ms), 10, 64); err == nil {
+			env.Timestamp = time.Unix(0, unixMs*int64(time.Millisecond))
+		}
+	}
+
+	contentType, _ := connect.GetKafkaHeader(msg, HeaderContentType)
+	codec, err := getMessageCodec(string(contentType))
+	if err != nil {
+		return env, err
+	}
+	if err := codec.Unmarshal(msg.Value, payload); err != nil {
+		return env, fmt.Errorf("decode %s v%d payload: %w", eventType, version, err)
+	}
+	return env, nil
+}
@@ -0,0 +1,138 @@
+package library
+
+import (
+	"context"
+	"errors"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes/wrappers"
+	"github.com/lifenglin/micro-library/connect"
+	"github.com/segmentio/kafka-go"
+	"testing"
+	"time"
+)
+
+type testUserCreated struct {
+	Id   int64  `json:"id"`
+	Name string `json:"name"`
+}
+
+func TestEnvelopeJSONRoundTrip(t *testing.T) {
+	now := time.Unix(1600000000, 123*int64(time.Millisecond))
+	msg, err := EncodeEnvelope(Envelope{
+		EventType: "user.created",
+		Version:   2,
+		Timestamp: now,
+		Producer:  "user",
+		Payload:   &testUserCreated{Id: 1, Name: "a"},
+	}, []byte("1"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if contentType, _ := connect.GetKafkaHeader(msg, HeaderContentType); string(contentType) != ContentTypeJSON {
+		t.Errorf("content type = %s", contentType)
+	}
+
+	env, err := decodeEnvelope(msg, connect.KafkaMessageType(msg), 2, new(testUserCreated))
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload := env.Payload.(*testUserCreated)
+	if env.EventType != "user.created" || env.Producer != "user" || !env.Timestamp.Equal(now) || *payload != (testUserCreated{Id: 1, Name: "a"}) {
+		t.Fatalf("decoded = %+v, payload = %+v", env, payload)
+	}
+}
+
+func TestEnvelopeProtobufRoundTrip(t *testing.T) {
+	msg, err := EncodeEnvelope(Envelope{
+		EventType: "user.renamed",
+		Version:   1,
+		Payload:   &wrappers.StringValue{Value: "b"},
+	}, nil, ContentTypeProtobuf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	env, err := decodeEnvelope(msg, "user.renamed", 1, new(wrappers.StringValue))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if payload := env.Payload.(*wrappers.StringValue); !proto.Equal(payload, &wrappers.StringValue{Value: "b"}) {
+		t.Fatalf("payload = %v", payload)
+	}
+	if env.Timestamp.IsZero() {
+		t.Error("timestamp is not set")
+	}
+
+	//不是proto.Message时编码失败
+	if _, err := EncodeEnvelope(Envelope{EventType: "user.renamed", Payload: &testUserCreated{}}, nil, ContentTypeProtobuf); err == nil {
+		t.Error("expected error for a non protobuf payload")
+	}
+	if _, err := EncodeEnvelope(Envelope{EventType: "user.renamed"}, nil, "application/xml"); !errors.Is(err, ErrUnknownContentType) {
+		t.Errorf("unknown content type error = %v", err)
+	}
+}
+
+func TestEventDispatcherRoutesVersions(t *testing.T) {
+	d := NewEventDispatcher()
+	var got []string
+	d.Handle("user.created", 1, func() interface{} { return new(testUserCreated) }, func(ctx context.Context, env Envelope) error {
+		got = append(got, "v1:"+env.Payload.(*testUserCreated).Name)
+		return nil
+	})
+	d.Handle("user.created", 2, func() interface{} { return new(testUserCreated) }, func(ctx context.Context, env Envelope) error {
+		got = append(got, "v2:"+env.Payload.(*testUserCreated).Name)
+		return nil
+	})
+
+	for _, version := range []int{2, 1} {
+		msg, err := EncodeEnvelope(Envelope{EventType: "user.created", Version: version, Payload: &testUserCreated{Name: "a"}}, nil, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := d.Dispatch(context.Background(), msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(got) != 2 || got[0] != "v2:a" || got[1] != "v1:a" {
+		t.Fatalf("handled = %v", got)
+	}
+}
+
+func TestEventDispatcherUnknown(t *testing.T) {
+	d := NewEventDispatcher()
+	d.Handle("user.created", 1, func() interface{} { return new(testUserCreated) }, func(ctx context.Context, env Envelope) error {
+		t.Error("handler should not be called")
+		return nil
+	})
+
+	encode := func(env Envelope) kafka.Message {
+		msg, err := EncodeEnvelope(env, nil, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return msg
+	}
+	badPayload := encode(Envelope{EventType: "user.created", Version: 1, Payload: &testUserCreated{}})
+	badPayload.Value = []byte("{")
+	noVersion := encode(Envelope{EventType: "user.created", Version: 1, Payload: &testUserCreated{}})
+	connect.SetKafkaHeader(&noVersion, HeaderEventVersion, []byte("x"))
+
+	testData := []struct {
+		name string
+		msg  kafka.Message
+		err  error
+	}{
+		{"unknown type", encode(Envelope{EventType: "user.deleted", Version: 1, Payload: &testUserCreated{}}), ErrUnknownEventType},
+		{"unknown version", encode(Envelope{EventType: "user.created", Version: 3, Payload: &testUserCreated{}}), ErrUnknownEventVersion},
+		{"bad version header", noVersion, ErrUnknownEventVersion},
+		{"bad payload", badPayload, nil},
+	}
+	for _, c := range testData {
+		err := d.Dispatch(context.Background(), c.msg)
+		if !connect.IsPermanentError(err) {
+			t.Errorf("%s: error = %v, want a permanent error", c.name, err)
+		}
+		if c.err != nil && !errors.Is(err, c.err) {
+			t.Errorf("%s: error = %v, want %v", c.name, err, c.err)
+		}
+	}
+}
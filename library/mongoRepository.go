@@ -0,0 +1,401 @@
+package library
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/lifenglin/micro-library/connect"
+	"github.com/lifenglin/micro-library/helper"
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"time"
+)
+
+const defaultSoftDeleteField = "deleted_at"
+
+// MongoRepository 按_id读写一个集合，读走cache-aside缓存，写后删除缓存
+type MongoRepository struct {
+	SrvName    string
+	MongoName  string
+	Database   string
+	Collection string
+	//缓存使用的redis
+	RedisName  string
+	KeyPrefix  string
+	TTL        time.Duration
+	LocalCache bool
+	//软删除时写入删除时间的字段，默认deleted_at，该字段不为空的文档读不到
+	SoftDeleteField string
+
+	//不为空时替换mongo集合和缓存，用于测试
+	coll  mongoCollection
+	cache repositoryCache
+}
+
+// mongoCollection MongoRepository用到的集合操作
+type mongoCollection interface {
+	FindOne(ctx context.Context, filter bson.M, value interface{}) error
+	Find(ctx context.Context, filter bson.M, opts *options.FindOptions) ([]bson.Raw, error)
+	UpdateOne(ctx context.Context, filter bson.M, update bson.M, upsert bool) error
+}
+
+type driverCollection struct {
+	coll *mongo.Collection
+}
+
+func (c driverCollection) FindOne(ctx context.Context, filter bson.M, value interface{}) error {
+	return c.coll.FindOne(ctx, filter).Decode(value)
+}
+
+func (c driverCollection) Find(ctx context.Context, filter bson.M, opts *options.FindOptions) ([]bson.Raw, error) {
+	cursor, err := c.coll.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	var raws []bson.Raw
+	if err := cursor.All(ctx, &raws); err != nil {
+		return nil, err
+	}
+	return raws, nil
+}
+
+func (c driverCollection) UpdateOne(ctx context.Context, filter bson.M, update bson.M, upsert bool) error {
+	_, err := c.coll.UpdateOne(ctx, filter, update, options.Update().SetUpsert(upsert))
+	return err
+}
+
+// repositoryCache MongoRepository用到的缓存操作，默认使用GetCache、MgetCache、SetCache和DelCache
+type repositoryCache interface {
+	Get(ctx context.Context, key string, value interface{}) error
+	MGet(ctx context.Context, keys []string, values interface{}) ([]int, error)
+	Set(ctx context.Context, key string, value interface{}) error
+	Del(ctx context.Context, key string) error
+}
+
+type helperCache struct {
+	repository *MongoRepository
+	hlp        *helper.Helper
+}
+
+func (c helperCache) Get(ctx context.Context, key string, value interface{}) error {
+	r := c.repository
+	return GetCache(ctx, c.hlp, r.SrvName, r.RedisName, r.LocalCache, key, value)
+}
+
+func (c helperCache) MGet(ctx context.Context, keys []string, values interface{}) ([]int, error) {
+	r := c.repository
+	return MgetCache(ctx, c.hlp, r.SrvName, r.RedisName, r.LocalCache, keys, values)
+}
+
+func (c helperCache) Set(ctx context.Context, key string, value interface{}) error {
+	r := c.repository
+	return SetCache(ctx, c.hlp, r.SrvName, r.RedisName, r.LocalCache, key, value, r.TTL)
+}
+
+// Del 删除redis缓存和本机的本地缓存
+func (c helperCache) Del(ctx context.Context, key string) error {
+	r := c.repository
+	if r.LocalCache {
+		bigCache, err := connect.ConnectBigcache()
+		if err == nil && bigCache != nil {
+			_ = bigCache.Delete(filepath.Join(r.SrvName, r.RedisName, key))
+		}
+	}
+	return DelCache(ctx, c.hlp, r.SrvName, r.RedisName, key)
+}
+
+func (r *MongoRepository) collection(ctx context.Context, hlp *helper.Helper) (mongoCollection, error) {
+	if r.coll != nil {
+		return r.coll, nil
+	}
+	db, err := connect.MongoDB(ctx, hlp, r.SrvName, r.MongoName, r.Database)
+	if err != nil {
+		return nil, err
+	}
+	return driverCollection{coll: db.Collection(r.Collection)}, nil
+}
+
+func (r *MongoRepository) cacheFor(hlp *helper.Helper) repositoryCache {
+	if r.cache != nil {
+		return r.cache
+	}
+	return helperCache{repository: r, hlp: hlp}
+}
+
+func (r *MongoRepository) softDeleteField() string {
+	if r.SoftDeleteField == "" {
+		return defaultSoftDeleteField
+	}
+	return r.SoftDeleteField
+}
+
+func (r *MongoRepository) filter(filter bson.M) bson.M {
+	result := bson.M{r.softDeleteField(): nil}
+	for k, v := range filter {
+		result[k] = v
+	}
+	return result
+}
+
+func (r *MongoRepository) cacheKey(id interface{}) string {
+	if oid, ok := id.(primitive.ObjectID); ok {
+		return r.KeyPrefix + oid.Hex()
+	}
+	return r.KeyPrefix + fmt.Sprint(id)
+}
+
+// cacheContext 调用方没有设置缓存namespace时使用collection名
+func (r *MongoRepository) cacheContext(ctx context.Context) context.Context {
+	if _, ok := ctx.Value(cacheNamespaceKey{}).(string); ok {
+		return ctx
+	}
+	return WithCacheNamespace(ctx, r.Collection)
+}
+
+// Get 按_id读取一个文档到value，不存在时返回mongo.ErrNoDocuments
+func (r *MongoRepository) Get(ctx context.Context, hlp *helper.Helper, id interface{}, value interface{}) error {
+	key := r.cacheKey(id)
+	cache := r.cacheFor(hlp)
+	if err := cache.Get(r.cacheContext(ctx), key, value); err == nil {
+		return nil
+	}
+
+	coll, err := r.collection(ctx, hlp)
+	if err != nil {
+		return err
+	}
+	err = coll.FindOne(ctx, r.filter(bson.M{"_id": id}), value)
+	if err != nil {
+		if !errors.Is(err, mongo.ErrNoDocuments) {
+			hlp.Log.WithFields(logrus.Fields{
+				"collection": r.Collection,
+				"id":         id,
+				"error":      err,
+			}).Warn("mongo find one error")
+		}
+		return err
+	}
+	_ = cache.Set(ctx, key, value)
+	return nil
+}
+
+// MGet 按ids批量读取，values为与ids等长的指针切片，nil元素会自动分配
+// 缓存未命中的用一次$in查询补齐，返回数据库中也不存在的下标，这些位置会被置为nil
+func (r *MongoRepository) MGet(ctx context.Context, hlp *helper.Helper, ids []interface{}, values interface{}) (notFoundIndex []int, err error) {
+	slice := reflect.ValueOf(values)
+	if slice.Kind() != reflect.Slice || slice.Type().Elem().Kind() != reflect.Ptr {
+		return nil, errors.New("values need slice of pointer")
+	}
+	if slice.Len() != len(ids) {
+		return nil, errors.New("len is not eq")
+	}
+	for i := 0; i < slice.Len(); i++ {
+		if slice.Index(i).IsNil() {
+			slice.Index(i).Set(reflect.New(slice.Type().Elem().Elem()))
+		}
+	}
+
+	keys := make([]string, len(ids))
+	for i, id := range ids {
+		keys[i] = r.cacheKey(id)
+	}
+	cache := r.cacheFor(hlp)
+	noCacheIndex, err := cache.MGet(r.cacheContext(ctx), keys, values)
+	if err != nil {
+		return nil, err
+	}
+	if len(noCacheIndex) == 0 {
+		return noCacheIndex, nil
+	}
+
+	//同一个id可能出现多次
+	missing := make(map[string][]int, len(noCacheIndex))
+	missIds := make([]interface{}, 0, len(noCacheIndex))
+	for _, index := range noCacheIndex {
+		t, data, err := bson.MarshalValue(ids[index])
+		if err != nil {
+			return nil, fmt.Errorf("marshal id %v: %w", ids[index], err)
+		}
+		idKey := rawIdKey(bson.RawValue{Type: t, Value: data})
+		if _, ok := missing[idKey]; !ok {
+			missIds = append(missIds, ids[index])
+		}
+		missing[idKey] = append(missing[idKey], index)
+	}
+
+	coll, err := r.collection(ctx, hlp)
+	if err != nil {
+		return nil, err
+	}
+	raws, err := coll.Find(ctx, r.filter(bson.M{"_id": bson.M{"$in": missIds}}), options.Find())
+	if err != nil {
+		hlp.Log.WithFields(logrus.Fields{
+			"collection": r.Collection,
+			"ids":        missIds,
+			"error":      err,
+		}).Warn("mongo find error")
+		return nil, err
+	}
+
+	for _, raw := range raws {
+		idKey := rawIdKey(raw.Lookup("_id"))
+		indexes, ok := missing[idKey]
+		if !ok {
+			continue
+		}
+		delete(missing, idKey)
+		for _, index := range indexes {
+			value := slice.Index(index).Interface()
+			if err := bson.Unmarshal(raw, value); err != nil {
+				return nil, err
+			}
+			_ = cache.Set(ctx, keys[index], value)
+		}
+	}
+
+	notFoundIndex = make([]int, 0, len(missing))
+	for _, indexes := range missing {
+		for _, index := range indexes {
+			slice.Index(index).Set(reflect.Zero(slice.Type().Elem()))
+			notFoundIndex = append(notFoundIndex, index)
+		}
+	}
+	return notFoundIndex, nil
+}
+
+// Upsert 用$set更新id对应的文档，不存在时插入，成功后删除缓存。
+// doc中的_id会被忽略，已软删除的文档会被恢复
+func (r *MongoRepository) Upsert(ctx context.Context, hlp *helper.Helper, id interface{}, doc interface{}) error {
+	update, err := r.upsertUpdate(doc)
+	if err != nil {
+		return err
+	}
+	coll, err := r.collection(ctx, hlp)
+	if err != nil {
+		return err
+	}
+	err = coll.UpdateOne(ctx, bson.M{"_id": id}, update, true)
+	if err != nil {
+		hlp.Log.WithFields(logrus.Fields{
+			"collection": r.Collection,
+			"id":         id,
+			"error":      err,
+		}).Warn("mongo upsert error")
+		return err
+	}
+	return r.Invalidate(ctx, hlp, id)
+}
+
+// upsertUpdate _id不能出现在$set中，已存在的文档修改_id会失败
+func (r *MongoRepository) upsertUpdate(doc interface{}) (bson.M, error) {
+	data, err := bson.Marshal(doc)
+	if err != nil {
+		return nil, fmt.Errorf("marshal doc: %w", err)
+	}
+	var set bson.M
+	if err := bson.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("unmarshal doc: %w", err)
+	}
+	delete(set, "_id")
+	delete(set, r.softDeleteField())
+
+	update := bson.M{"$unset": bson.M{r.softDeleteField(): ""}}
+	if len(set) > 0 {
+		update["$set"] = set
+	}
+	return update, nil
+}
+
+// SoftDelete 给文档写入删除时间，之后Get、MGet和Page都读不到
+func (r *MongoRepository) SoftDelete(ctx context.Context, hlp *helper.Helper, id interface{}) error {
+	coll, err := r.collection(ctx, hlp)
+	if err != nil {
+		return err
+	}
+	err = coll.UpdateOne(ctx, r.filter(bson.M{"_id": id}), bson.M{"$set": bson.M{r.softDeleteField(): time.Now().Unix()}}, false)
+	if err != nil {
+		hlp.Log.WithFields(logrus.Fields{
+			"collection": r.Collection,
+			"id":         id,
+			"error":      err,
+		}).Warn("mongo soft delete error")
+		return err
+	}
+	return r.Invalidate(ctx, hlp, id)
+}
+
+// Invalidate 删除id的redis缓存和本机的本地缓存
+func (r *MongoRepository) Invalidate(ctx context.Context, hlp *helper.Helper, id interface{}) error {
+	return r.cacheFor(hlp).Del(ctx, r.cacheKey(id))
+}
+
+// Page 按_id升序分页，afterId为上一页返回的nextId，第一页传nil
+// values为切片指针，没有下一页时nextId为nil
+func (r *MongoRepository) Page(ctx context.Context, hlp *helper.Helper, filter bson.M, afterId interface{}, limit int64, values interface{}) (nextId interface{}, err error) {
+	ptr := reflect.ValueOf(values)
+	if ptr.Kind() != reflect.Ptr || ptr.Elem().Kind() != reflect.Slice {
+		return nil, errors.New("values need pointer of slice")
+	}
+	if limit <= 0 {
+		return nil, errors.New("limit must be positive")
+	}
+
+	query := r.filter(filter)
+	if afterId != nil {
+		query["_id"] = bson.M{"$gt": afterId}
+	}
+	coll, err := r.collection(ctx, hlp)
+	if err != nil {
+		return nil, err
+	}
+	//多取一条判断是否还有下一页
+	raws, err := coll.Find(ctx, query, options.Find().SetSort(bson.M{"_id": 1}).SetLimit(limit+1))
+	if err != nil {
+		hlp.Log.WithFields(logrus.Fields{
+			"collection": r.Collection,
+			"error":      err,
+		}).Warn("mongo page error")
+		return nil, err
+	}
+
+	hasMore := int64(len(raws)) > limit
+	if hasMore {
+		raws = raws[:limit]
+	}
+	sliceType := ptr.Elem().Type()
+	result := reflect.MakeSlice(sliceType, 0, len(raws))
+	for _, raw := range raws {
+		elem := reflect.New(sliceType.Elem())
+		if err := bson.Unmarshal(raw, elem.Interface()); err != nil {
+			return nil, err
+		}
+		result = reflect.Append(result, elem.Elem())
+	}
+	ptr.Elem().Set(result)
+
+	if !hasMore {
+		return nil, nil
+	}
+	if err := raws[len(raws)-1].Lookup("_id").Unmarshal(&nextId); err != nil {
+		return nil, err
+	}
+	return nextId, nil
+}
+
+// rawIdKey 数字类型的_id按数值比较，其他类型按bson编码比较
+func rawIdKey(id bson.RawValue) string {
+	switch id.Type {
+	case bsontype.Int32:
+		return "n" + strconv.FormatInt(int64(id.Int32()), 10)
+	case bsontype.Int64:
+		return "n" + strconv.FormatInt(id.Int64(), 10)
+	}
+	return string([]byte{byte(id.Type)}) + string(id.Value)
+}
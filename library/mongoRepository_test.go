@@ -0,0 +1,352 @@
+package library
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/lifenglin/micro-library/helper"
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+type testArticle struct {
+	Id    int64  `bson:"_id" json:"id"`
+	Title string `bson:"title" json:"title"`
+}
+
+// stubCollection 内存中的集合，只支持MongoRepository用到的查询条件
+type stubCollection struct {
+	docs    map[int64]bson.M
+	updates []bson.M
+}
+
+func newStubCollection(docs ...bson.M) *stubCollection {
+	c := &stubCollection{docs: make(map[int64]bson.M)}
+	for _, doc := range docs {
+		id, _ := toInt64(doc["_id"])
+		c.docs[id] = doc
+	}
+	return c
+}
+
+func toInt64(v interface{}) (int64, bool) {
+	switch n := v.(type) {
+	case int:
+		return int64(n), true
+	case int32:
+		return int64(n), true
+	case int64:
+		return n, true
+	}
+	return 0, false
+}
+
+func stubEqual(a, b interface{}) bool {
+	x, ok1 := toInt64(a)
+	y, ok2 := toInt64(b)
+	if ok1 && ok2 {
+		return x == y
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+func stubMatch(doc bson.M, filter bson.M) bool {
+	for key, cond := range filter {
+		value, exists := doc[key]
+		switch c := cond.(type) {
+		case nil:
+			if exists && value != nil {
+				return false
+			}
+		case bson.M:
+			if in, ok := c["$in"]; ok {
+				found := false
+				for _, item := range in.([]interface{}) {
+					found = found || stubEqual(value, item)
+				}
+				if !found {
+					return false
+				}
+			}
+			if gt, ok := c["$gt"]; ok {
+				x, _ := toInt64(value)
+				y, _ := toInt64(gt)
+				if x <= y {
+					return false
+				}
+			}
+		default:
+			if !stubEqual(value, cond) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (c *stubCollection) matched(filter bson.M) []bson.M {
+	var docs []bson.M
+	for _, doc := range c.docs {
+		if stubMatch(doc, filter) {
+			docs = append(docs, doc)
+		}
+	}
+	sort.Slice(docs, func(i, j int) bool {
+		x, _ := toInt64(docs[i]["_id"])
+		y, _ := toInt64(docs[j]["_id"])
+		return x < y
+	})
+	return docs
+}
+
+func (c *stubCollection) FindOne(ctx context.Context, filter bson.M, value interface{}) error {
+	docs := c.matched(filter)
+	if len(docs) == 0 {
+		return mongo.ErrNoDocuments
+	}
+	data, err := bson.Marshal(docs[0])
+	if err != nil {
+		return err
+	}
+	return bson.Unmarshal(data, value)
+}
+
+func (c *stubCollection) Find(ctx context.Context, filter bson.M, opts *options.FindOptions) ([]bson.Raw, error) {
+	docs := c.matched(filter)
+	if opts != nil && opts.Limit != nil && int64(len(docs)) > *opts.Limit {
+		docs = docs[:*opts.Limit]
+	}
+	raws := make([]bson.Raw, 0, len(docs))
+	for _, doc := range docs {
+		data, err := bson.Marshal(doc)
+		if err != nil {
+			return nil, err
+		}
+		raws = append(raws, data)
+	}
+	return raws, nil
+}
+
+func (c *stubCollection) UpdateOne(ctx context.Context, filter bson.M, update bson.M, upsert bool) error {
+	c.updates = append(c.updates, update)
+	docs := c.matched(filter)
+	var doc bson.M
+	if len(docs) > 0 {
+		doc = docs[0]
+	} else if upsert {
+		id, _ := toInt64(filter["_id"])
+		doc = bson.M{"_id": id}
+		c.docs[id] = doc
+	} else {
+		return nil
+	}
+	if set, ok := update["$set"].(bson.M); ok {
+		if _, ok := set["_id"]; ok && len(docs) > 0 {
+			return errors.New("the (immutable) field '_id' was found to have been altered")
+		}
+		for key, value := range set {
+			doc[key] = value
+		}
+	}
+	if unset, ok := update["$unset"].(bson.M); ok {
+		for key := range unset {
+			delete(doc, key)
+		}
+	}
+	return nil
+}
+
+// stubCache 用json保存的缓存，行为与GetCache、MgetCache一致
+type stubCache struct {
+	data map[string][]byte
+}
+
+func (c *stubCache) Get(ctx context.Context, key string, value interface{}) error {
+	data, ok := c.data[key]
+	if !ok {
+		return errors.New("cache miss")
+	}
+	return json.Unmarshal(data, value)
+}
+
+func (c *stubCache) MGet(ctx context.Context, keys []string, values interface{}) ([]int, error) {
+	slice := reflect.ValueOf(values)
+	var noCacheIndex []int
+	for i, key := range keys {
+		if err := c.Get(ctx, key, slice.Index(i).Interface()); err != nil {
+			noCacheIndex = append(noCacheIndex, i)
+		}
+	}
+	return noCacheIndex, nil
+}
+
+func (c *stubCache) Set(ctx context.Context, key string, value interface{}) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	c.data[key] = data
+	return nil
+}
+
+func (c *stubCache) Del(ctx context.Context, key string) error {
+	delete(c.data, key)
+	return nil
+}
+
+func newTestRepository(docs ...bson.M) (*MongoRepository, *stubCollection, *stubCache) {
+	coll := newStubCollection(docs...)
+	cache := &stubCache{data: make(map[string][]byte)}
+	return &MongoRepository{
+		Collection: "article",
+		KeyPrefix:  "article:",
+		coll:       coll,
+		cache:      cache,
+	}, coll, cache
+}
+
+func newTestHelper() *helper.Helper {
+	return &helper.Helper{Log: logrus.NewEntry(logrus.New())}
+}
+
+func TestMongoRepositoryGet(t *testing.T) {
+	repo, coll, cache := newTestRepository(bson.M{"_id": int64(1), "title": "first"})
+	ctx, hlp := context.Background(), newTestHelper()
+
+	var article testArticle
+	if err := repo.Get(ctx, hlp, int64(1), &article); err != nil || article.Title != "first" {
+		t.Fatalf("get = %+v, %v", article, err)
+	}
+	if _, ok := cache.data["article:1"]; !ok {
+		t.Fatal("value is not cached")
+	}
+
+	//第二次从缓存读取
+	delete(coll.docs, 1)
+	article = testArticle{}
+	if err := repo.Get(ctx, hlp, int64(1), &article); err != nil || article.Title != "first" {
+		t.Fatalf("cached get = %+v, %v", article, err)
+	}
+
+	if err := repo.Get(ctx, hlp, int64(2), &article); !errors.Is(err, mongo.ErrNoDocuments) {
+		t.Fatalf("missing get error = %v", err)
+	}
+}
+
+func TestMongoRepositoryMGet(t *testing.T) {
+	repo, _, cache := newTestRepository(
+		bson.M{"_id": int64(1), "title": "first"},
+		bson.M{"_id": int64(2), "title": "deleted", "deleted_at": int64(100)},
+	)
+	ctx, hlp := context.Background(), newTestHelper()
+	_ = cache.Set(ctx, "article:3", &testArticle{Id: 3, Title: "cached"})
+
+	ids := []interface{}{int64(1), int64(2), int64(3), int64(1)}
+	values := make([]*testArticle, len(ids))
+	notFound, err := repo.MGet(ctx, hlp, ids, values)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(notFound, []int{1}) {
+		t.Errorf("not found = %v", notFound)
+	}
+	if values[0] == nil || values[0].Title != "first" || values[3] == nil || values[3].Title != "first" {
+		t.Errorf("duplicated id values = %+v, %+v", values[0], values[3])
+	}
+	if values[1] != nil {
+		t.Errorf("soft deleted value = %+v", values[1])
+	}
+	if values[2] == nil || values[2].Title != "cached" {
+		t.Errorf("cached value = %+v", values[2])
+	}
+}
+
+func TestMongoRepositoryUpsert(t *testing.T) {
+	repo, coll, cache := newTestRepository(bson.M{"_id": int64(1), "title": "old", "deleted_at": int64(100)})
+	ctx, hlp := context.Background(), newTestHelper()
+	_ = cache.Set(ctx, "article:1", &testArticle{Id: 1, Title: "old"})
+
+	if err := repo.Upsert(ctx, hlp, int64(1), testArticle{Id: 1, Title: "new"}); err != nil {
+		t.Fatal(err)
+	}
+	update := coll.updates[len(coll.updates)-1]
+	if _, ok := update["$set"].(bson.M)["_id"]; ok {
+		t.Errorf("_id in $set: %v", update)
+	}
+	if _, ok := update["$unset"].(bson.M)["deleted_at"]; !ok {
+		t.Errorf("soft delete field is not unset: %v", update)
+	}
+	if _, ok := cache.data["article:1"]; ok {
+		t.Error("cache is not invalidated")
+	}
+
+	//软删除的文档恢复可读
+	var article testArticle
+	if err := repo.Get(ctx, hlp, int64(1), &article); err != nil || article.Title != "new" {
+		t.Fatalf("get after upsert = %+v, %v", article, err)
+	}
+
+	if err := repo.Upsert(ctx, hlp, int64(2), testArticle{Id: 2, Title: "inserted"}); err != nil {
+		t.Fatal(err)
+	}
+	if doc, ok := coll.docs[2]; !ok || doc["title"] != "inserted" {
+		t.Errorf("inserted doc = %v", doc)
+	}
+}
+
+func TestMongoRepositorySoftDelete(t *testing.T) {
+	repo, coll, cache := newTestRepository(bson.M{"_id": int64(1), "title": "first"})
+	ctx, hlp := context.Background(), newTestHelper()
+	_ = cache.Set(ctx, "article:1", &testArticle{Id: 1, Title: "first"})
+
+	if err := repo.SoftDelete(ctx, hlp, int64(1)); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := coll.docs[1]["deleted_at"]; !ok {
+		t.Fatalf("deleted_at is not set: %v", coll.docs[1])
+	}
+	if _, ok := cache.data["article:1"]; ok {
+		t.Error("cache is not invalidated")
+	}
+	var article testArticle
+	if err := repo.Get(ctx, hlp, int64(1), &article); !errors.Is(err, mongo.ErrNoDocuments) {
+		t.Fatalf("get after soft delete = %+v, %v", article, err)
+	}
+}
+
+func TestMongoRepositoryPage(t *testing.T) {
+	repo, _, _ := newTestRepository(
+		bson.M{"_id": int64(1), "title": "a"},
+		bson.M{"_id": int64(2), "title": "b"},
+		bson.M{"_id": int64(3), "title": "c", "deleted_at": int64(100)},
+		bson.M{"_id": int64(4), "title": "d"},
+		bson.M{"_id": int64(5), "title": "e"},
+	)
+	ctx, hlp := context.Background(), newTestHelper()
+
+	var page []testArticle
+	nextId, err := repo.Page(ctx, hlp, bson.M{}, nil, 2, &page)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page) != 2 || page[0].Id != 1 || page[1].Id != 2 || nextId != int64(2) {
+		t.Fatalf("first page = %+v, next = %v", page, nextId)
+	}
+
+	nextId, err = repo.Page(ctx, hlp, bson.M{}, nextId, 2, &page)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page) != 2 || page[0].Id != 4 || page[1].Id != 5 || nextId != nil {
+		t.Fatalf("second page = %+v, next = %v", page, nextId)
+	}
+
+	if _, err := repo.Page(ctx, hlp, bson.M{}, nil, 0, &page); err == nil {
+		t.Error("zero limit should fail")
+	}
+}
@@ -1,19 +1,10 @@
 package library
 
 import (
-	"github.com/percona/go-mysql/query"
-	"regexp"
+	"github.com/lifenglin/micro-library/helper"
 )
 
+// TransferSQLToTpl 只替换参数和分表后缀，不合并参数列表，慢sql统计使用helper.SqlFingerprint
 func TransferSQLToTpl(sql string) (tpl string, err error) {
-	queryTpl := query.Fingerprint(sql)
-
-	re, err := regexp.Compile("([a-zA-Z_]+)(?:\\d+)")
-	if nil != err {
-		return "", nil
-	}
-
-	tpl = re.ReplaceAllString(queryTpl, "${1}xxx")
-
-	return tpl, nil
-}
\ No newline at end of file
+	return helper.SqlTemplate(sql), nil
+}
@@ -42,7 +42,12 @@ func (w wrapCodec) Unmarshal(data []byte, v interface{}) error {
 }
 
 func RegisterJSONCodec() {
-	encoding.RegisterCodec(wrapCodec{jsonCodec{}})
+	encoding.RegisterCodec(NewCodec())
+}
+
+// NewCodec 返回与RegisterJSONCodec注册的相同的json编解码器，用于grpc之外的场景
+func NewCodec() encoding.Codec {
+	return wrapCodec{jsonCodec{}}
 }
 
 type jsonCodec struct{}
@@ -0,0 +1,140 @@
+package prometheus
+
+import (
+	"context"
+	"github.com/micro/go-micro/v2/client"
+	"github.com/micro/go-micro/v2/errors"
+	"github.com/micro/go-micro/v2/registry"
+	"github.com/micro/go-micro/v2/server"
+	"github.com/prometheus/client_golang/prometheus"
+	"strconv"
+	"time"
+)
+
+// CodeOK 成功请求的code标签，失败时为go-micro errors的Code，不是go-micro错误时为CodeUnknown
+const (
+	CodeOK      = "ok"
+	CodeUnknown = "unknown"
+)
+
+var DefaultBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+type Options struct {
+	Buckets    []float64
+	Registerer prometheus.Registerer
+}
+
+type Option func(*Options)
+
+// Buckets 延迟直方图的桶，单位秒，默认DefaultBuckets。
+// 同一个registry上只有第一次创建wrapper时的桶生效，之后创建的wrapper复用已注册的直方图
+func Buckets(buckets []float64) Option {
+	return func(o *Options) {
+		o.Buckets = buckets
+	}
+}
+
+// Registerer 注册指标的registry，默认prometheus.DefaultRegisterer
+func Registerer(r prometheus.Registerer) Option {
+	return func(o *Options) {
+		o.Registerer = r
+	}
+}
+
+type metrics struct {
+	requests *prometheus.CounterVec
+	latency  *prometheus.HistogramVec
+	inFlight *prometheus.GaugeVec
+}
+
+// newMetrics side为server或client，同一个registry上重复创建时复用已注册的指标，
+// Buckets等选项只在第一次创建时生效
+func newMetrics(side string, opts ...Option) *metrics {
+	options := Options{
+		Buckets:    DefaultBuckets,
+		Registerer: prometheus.DefaultRegisterer,
+	}
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	m := &metrics{
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "micro_" + side + "_requests_total",
+			Help: "Number of " + side + " requests by result code.",
+		}, []string{"service", "endpoint", "code"}),
+		latency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "micro_" + side + "_request_duration_seconds",
+			Help:    "Latency of " + side + " requests.",
+			Buckets: options.Buckets,
+		}, []string{"service", "endpoint"}),
+		inFlight: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "micro_" + side + "_in_flight_requests",
+			Help: "Number of " + side + " requests in progress.",
+		}, []string{"service", "endpoint"}),
+	}
+	m.requests = register(options.Registerer, m.requests).(*prometheus.CounterVec)
+	m.latency = register(options.Registerer, m.latency).(*prometheus.HistogramVec)
+	m.inFlight = register(options.Registerer, m.inFlight).(*prometheus.GaugeVec)
+	return m
+}
+
+// register 已经注册过时返回已有的指标，其他错误(如同名指标的标签不同)和MustRegister一样panic
+func register(r prometheus.Registerer, c prometheus.Collector) prometheus.Collector {
+	if err := r.Register(c); err != nil {
+		if are, ok := err.(prometheus.AlreadyRegisteredError); ok {
+			return are.ExistingCollector
+		}
+		panic(err)
+	}
+	return c
+}
+
+func (m *metrics) observe(service, endpoint string, f func() error) error {
+	inFlight := m.inFlight.WithLabelValues(service, endpoint)
+	inFlight.Inc()
+	defer inFlight.Dec()
+
+	start := time.Now()
+	err := f()
+	m.latency.WithLabelValues(service, endpoint).Observe(time.Since(start).Seconds())
+	m.requests.WithLabelValues(service, endpoint, errorCode(err)).Inc()
+	return err
+}
+
+func errorCode(err error) string {
+	if err == nil {
+		return CodeOK
+	}
+	if microErr, ok := err.(*errors.Error); ok && microErr.Code != 0 {
+		return strconv.Itoa(int(microErr.Code))
+	}
+	if parsed := errors.Parse(err.Error()); parsed.Code != 0 {
+		return strconv.Itoa(int(parsed.Code))
+	}
+	return CodeUnknown
+}
+
+// NewHandlerWrapper 记录服务端每个endpoint的请求数、错误码、延迟和处理中的请求数
+func NewHandlerWrapper(opts ...Option) server.HandlerWrapper {
+	m := newMetrics("server", opts...)
+	return func(fn server.HandlerFunc) server.HandlerFunc {
+		return func(ctx context.Context, req server.Request, rsp interface{}) error {
+			return m.observe(req.Service(), req.Endpoint(), func() error {
+				return fn(ctx, req, rsp)
+			})
+		}
+	}
+}
+
+// NewCallWrapper 记录调用其他服务的请求数、错误码、延迟和进行中的请求数，重试的每次调用分别记录
+func NewCallWrapper(opts ...Option) client.CallWrapper {
+	m := newMetrics("client", opts...)
+	return func(fn client.CallFunc) client.CallFunc {
+		return func(ctx context.Context, node *registry.Node, req client.Request, rsp interface{}, opts client.CallOptions) error {
+			return m.observe(req.Service(), req.Endpoint(), func() error {
+				return fn(ctx, node, req, rsp, opts)
+			})
+		}
+	}
+}
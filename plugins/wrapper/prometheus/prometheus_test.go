@@ -0,0 +1,87 @@
+package prometheus
+
+import (
+	"context"
+	"errors"
+	"github.com/micro/go-micro/v2/client"
+	microErrors "github.com/micro/go-micro/v2/errors"
+	"github.com/micro/go-micro/v2/registry"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"testing"
+)
+
+func TestErrorCode(t *testing.T) {
+	cases := map[string]error{
+		CodeOK:      nil,
+		"404":       microErrors.NotFound("test", "not found"),
+		"408":       errors.New(microErrors.Timeout("test", "timeout").Error()),
+		CodeUnknown: errors.New("plain error"),
+	}
+	for want, err := range cases {
+		if got := errorCode(err); got != want {
+			t.Errorf("errorCode(%v) = %s, want %s", err, got, want)
+		}
+	}
+}
+
+func TestCallWrapper(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	wrapper := NewCallWrapper(Registerer(reg), Buckets([]float64{0.1, 1}))
+	//重复创建时复用已注册的指标
+	_ = NewCallWrapper(Registerer(reg))
+
+	var inFlight float64
+	m := newMetrics("client", Registerer(reg))
+	call := wrapper(func(ctx context.Context, node *registry.Node, req client.Request, rsp interface{}, opts client.CallOptions) error {
+		inFlight = testutil.ToFloat64(m.inFlight.WithLabelValues("user", "User.Get"))
+		if req.Body() == "fail" {
+			return microErrors.InternalServerError("user", "fail")
+		}
+		return nil
+	})
+
+	_ = call(context.Background(), nil, client.NewRequest("user", "User.Get", "ok"), nil, client.CallOptions{})
+	_ = call(context.Background(), nil, client.NewRequest("user", "User.Get", "fail"), nil, client.CallOptions{})
+
+	if inFlight != 1 {
+		t.Errorf("in flight during call = %v", inFlight)
+	}
+	if v := testutil.ToFloat64(m.inFlight.WithLabelValues("user", "User.Get")); v != 0 {
+		t.Errorf("in flight after call = %v", v)
+	}
+	if v := testutil.ToFloat64(m.requests.WithLabelValues("user", "User.Get", CodeOK)); v != 1 {
+		t.Errorf("ok requests = %v", v)
+	}
+	if v := testutil.ToFloat64(m.requests.WithLabelValues("user", "User.Get", "500")); v != 1 {
+		t.Errorf("500 requests = %v", v)
+	}
+	if n := testutil.CollectAndCount(m.latency); n != 1 {
+		t.Errorf("latency series = %d", n)
+	}
+}
+
+func TestRegisterConflict(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	//同名但标签不同的指标
+	reg.MustRegister(prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "micro_server_requests_total",
+		Help: "Conflicting metric.",
+	}, []string{"service"}))
+
+	defer func() {
+		if recover() == nil {
+			t.Error("expected panic on conflicting registration")
+		}
+	}()
+	NewHandlerWrapper(Registerer(reg))
+}
+
+func TestBucketsOnlyFirstTime(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	first := newMetrics("server", Registerer(reg), Buckets([]float64{1}))
+	second := newMetrics("server", Registerer(reg), Buckets([]float64{1, 2, 3}))
+	if first.latency != second.latency {
+		t.Fatal("the latency histogram is not reused")
+	}
+}